@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"tunnel-go/pkg/daemon"
+	"tunnel-go/pkg/tunnel"
+)
+
+// daemonStartTimeout is how long startDaemon waits for the control socket
+const daemonStartTimeout = 10 * time.Second
+
+// startDaemon re-executes tunnel-go as a detached daemon and waits until its
+// control socket answers. It returns the process exit code.
+func startDaemon(configPath string, args []string) int {
+	paths, err := daemon.PathsFor(configPath)
+	if err != nil {
+		log.Printf("Failed to locate daemon files: %v", err)
+		return 1
+	}
+
+	client := daemon.NewClient(paths.Socket)
+	if resp, err := client.Ping(); err == nil {
+		log.Printf("Daemon already running for %s with pid %d", configPath, resp.PID)
+		return 1
+	}
+
+	if err := os.MkdirAll(paths.Dir, 0700); err != nil {
+		log.Printf("Failed to create %s: %v", paths.Dir, err)
+		return 1
+	}
+	logFile, err := os.OpenFile(paths.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Failed to open daemon log: %v", err)
+		return 1
+	}
+	defer logFile.Close()
+
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		log.Printf("Failed to resolve config path: %v", err)
+		return 1
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("Failed to find tunnel-go executable: %v", err)
+		return 1
+	}
+
+	// Later flags override earlier ones, so the resolved config path wins
+	childArgs := append([]string{"daemon"}, args...)
+	childArgs = append(childArgs, "-foreground", "-config", absConfig)
+	cmd := exec.Command(exe, childArgs...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to start daemon: %v", err)
+		return 1
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.After(daemonStartTimeout)
+	for {
+		select {
+		case err := <-exited:
+			log.Printf("Daemon exited during startup (%v), see %s", err, paths.LogFile)
+			return 1
+		case <-deadline:
+			log.Printf("Daemon did not start within %s, see %s", daemonStartTimeout, paths.LogFile)
+			return 1
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if resp, err := client.Ping(); err == nil {
+			fmt.Printf("Daemon started for environment %s (pid %d)\n", resp.Env, resp.PID)
+			fmt.Printf("Control socket: %s\n", paths.Socket)
+			fmt.Printf("Log file: %s\n", paths.LogFile)
+			return 0
+		}
+	}
+}
+
+// runDaemon runs the tunnel manager in the current process until SIGINT or
+// SIGTERM, serving control requests on the daemon socket. SIGHUP is ignored
+// so the daemon survives its terminal closing. It returns the process exit
+// code.
+func runDaemon(opts managerOptions, services []string) int {
+	configPath, env := opts.configPath, opts.env
+
+	paths, err := daemon.PathsFor(configPath)
+	if err != nil {
+		log.Printf("Failed to locate daemon files: %v", err)
+		return 1
+	}
+	if err := os.MkdirAll(paths.Dir, 0700); err != nil {
+		log.Printf("Failed to create %s: %v", paths.Dir, err)
+		return 1
+	}
+
+	pidFile, err := daemon.AcquirePIDFile(paths.PIDFile)
+	if err != nil {
+		if errors.Is(err, daemon.ErrAlreadyRunning) {
+			log.Printf("Refusing to start a second daemon for %s: %v", configPath, err)
+		} else {
+			log.Printf("Failed to start daemon: %v", err)
+		}
+		return 1
+	}
+	defer pidFile.Release()
+
+	// Ignore SIGHUP before anything slow, such as the MFA prompt or the
+	// account lookup of newManager
+	signal.Ignore(syscall.SIGHUP)
+
+	manager, _ := newManager(opts)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	server, err := daemon.Listen(paths.Socket, manager, slog.Default())
+	if err != nil {
+		slog.Error("Failed to start control socket", "error", err)
+		return 1
+	}
+	go func() {
+		if err := server.Serve(); err != nil {
+			slog.Error("Control socket failed", "error", err)
+		}
+	}()
+
+	slog.Info("Daemon running", "env", env, "pid", os.Getpid(), "socket", paths.Socket)
+
+	// Failing startup tunnels are reported but do not stop the daemon, so
+	// they can be added again later
+	if len(services) > 0 {
+		if err := manager.CreateTunnels(services); err != nil {
+			slog.Error("Failed to create tunnels", "error", err)
+		}
+	}
+
+	sig := <-sigChan
+	slog.Info("Received signal, stopping daemon", "signal", sig)
+	server.Close()
+	return shutdown(manager, sigChan)
+}
+
+// addToDaemon creates tunnels on the daemon running for configPath. It
+// returns false if no daemon is running, so the caller creates the tunnels
+// itself, and otherwise the process exit code. overrides are the flags given
+// that change how tunnels are created; the daemon was started with its own,
+// so they are rejected rather than ignored.
+func addToDaemon(configPath, env string, services []string, overrides []string, wait waitOptions) (int, bool) {
+	paths, err := daemon.PathsFor(configPath)
+	if err != nil {
+		return 0, false
+	}
+	client := daemon.NewClient(paths.Socket)
+
+	if len(overrides) > 0 {
+		if _, err := client.Ping(); errors.Is(err, daemon.ErrNotRunning) {
+			return 0, false
+		}
+		err := fmt.Errorf("%s cannot be used while a daemon is running for this config: start the daemon with them instead, or stop it first", strings.Join(overrides, ", "))
+		if wait.enabled {
+			return printNotReady(env, tunnel.ReasonConfig, err), true
+		}
+		log.Printf("Failed to create tunnels on daemon: %v", err)
+		return exitConfig, true
+	}
+
+	ctx, cancel := wait.context()
+	defer cancel()
+
+	type addResult struct {
+		resp *daemon.Response
+		err  error
+	}
+	var timeout time.Duration
+	if wait.enabled {
+		timeout = wait.timeout
+	}
+	added := make(chan addResult, 1)
+	go func() {
+		resp, err := client.Add(env, services, timeout)
+		added <- addResult{resp, err}
+	}()
+
+	var result addResult
+	select {
+	case result = <-added:
+	case <-ctx.Done():
+		// The daemon stops creating tunnels at the same timeout. Those it
+		// created before stay on it until stop closes them.
+		return printNotReady(env, reasonTimeout, fmt.Errorf("tunnels not ready within %s", wait.timeout)), true
+	}
+	resp, err := result.resp, result.err
+	if errors.Is(err, daemon.ErrNotRunning) {
+		return 0, false
+	}
+	if err != nil {
+		reason := ""
+		if resp != nil {
+			reason = resp.Reason
+		}
+		if wait.enabled {
+			return printNotReady(env, reason, err), true
+		}
+		if resp != nil {
+			printTunnels(resp.Tunnels)
+		}
+		log.Printf("Failed to create tunnels on daemon: %v", err)
+		return exitCode(reason), true
+	}
+
+	if wait.enabled {
+		list := func() ([]tunnel.TunnelStatus, error) {
+			resp, err := client.List()
+			if err != nil {
+				return nil, err
+			}
+			return resp.Tunnels, nil
+		}
+		tunnels, err := waitReady(ctx, services, list)
+		if err != nil {
+			return printNotReady(env, reasonTimeout, err), true
+		}
+		printReady(env, tunnels)
+		return 0, true
+	}
+	printTunnels(resp.Tunnels)
+	fmt.Printf("Tunnels created on daemon (pid %d)\n", resp.PID)
+	return 0, true
+}
+
+// printTunnels prints one line per tunnel
+func printTunnels(tunnels []tunnel.TunnelStatus) {
+	for _, t := range tunnels {
+		fmt.Printf("%s: %s -> %s\n", t.Service, t.LocalAddress(), t.RemoteAddress())
+	}
+}
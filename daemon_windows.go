@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// detachedProcAttr starts the daemon in a process group of its own, so
+// Ctrl+C in the console does not reach it
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
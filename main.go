@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"tunnel-go/pkg/aws"
+	"tunnel-go/pkg/cache"
 	"tunnel-go/pkg/config"
+	"tunnel-go/pkg/daemon"
+	"tunnel-go/pkg/logging"
+	"tunnel-go/pkg/ports"
 	"tunnel-go/pkg/tunnel"
 )
 
@@ -23,6 +33,11 @@ Usage:
 Commands:
   create-tunnel    Create SSH tunnels to specified services
   service-details  Query SSM parameters for specified services
+  daemon           Run tunnels in the background, controlled through a local socket
+  status           Show the tunnels of the running daemon
+  stop             Close tunnels on the running daemon
+  list             List the services configured in the config file
+  validate-config  Check the config file and report every problem found
 
 Flags:
   -config string
@@ -33,19 +48,59 @@ Flags:
         Comma-separated list of services to tunnel to (e.g., "database,redis")
   -region string
         AWS region (overrides config file)
+  -var KEY=VALUE
+        Set a template variable, overriding the config's vars (repeatable)
+  -log-level string
+        Log level: debug, info, warn or error (default: log-level from the config, or info)
+  -log-format string
+        Log format: text or json (default: log-format from the config, or text)
   -verbose
-        Enable verbose logging
+        Enable debug logging, same as -log-level debug
+  -concurrency int
+        (create-tunnel, daemon) Number of tunnels created at once (default: concurrency from the config, or 4)
+  -jumphost string
+        (create-tunnel, daemon) Instance ID of the jumphost to use instead of looking one up
+  -lazy
+        (create-tunnel, daemon) Start each session on the first connection to its local port
+  -wait
+        (create-tunnel only) Print a JSON line once every tunnel has an established session
+  -timeout duration
+        (create-tunnel only) How long -wait waits for the tunnels to be created and ready (default: 2m)
+  -offline
+        Use cached SSM parameters and jumphosts, even expired ones, when AWS cannot be reached
+  -refresh
+        Ignore the cache and look everything up again
+  -foreground
+        (daemon only) Run the daemon in the current terminal instead of detaching
+  -output string
+        (status, list) Output format: table or json (default: table)
+  -all
+        (stop only) Close every tunnel on the daemon
 
 Examples:
   # Create tunnels for database and redis in production
   tunnel-go create-tunnel -env prod -services "database,redis"
 
+  # Wait for the tunnels in a script, failing after a minute
+  tunnel-go create-tunnel -env dev -services "database" -wait -timeout 1m
+
   # Query service details from SSM
   tunnel-go service-details -env prod -services "database"
 
   # Use a specific config file
   tunnel-go create-tunnel -config /path/to/config.yaml -services "database"
 
+  # Start a background daemon, then add tunnels to it
+  tunnel-go daemon -env prod
+  tunnel-go create-tunnel -env prod -services "database"
+
+  # Show running tunnels, then close one
+  tunnel-go status
+  tunnel-go stop -services "database"
+
+  # Check a config file before using it
+  tunnel-go validate-config -config /path/to/config.yaml
+
   # Create tunnels in a specific region
   tunnel-go create-tunnel -region us-west-2 -env staging -services "database"
 
@@ -54,26 +109,61 @@ Configuration:
   
   aws:
     default_region: us-west-2
+  vars:
+    app: billing
   tunnel-go-config:
-    placeholder: environment
-    jumphost-filter: "${PLACEHOLDER}-autoscaled"
+    jumphost-filter: "${ENV}-autoscaled"
     services:
       database:
         host:
-          ssm_param: "/${PLACEHOLDER}/path/to/parameter/DB_HOST"
+          ssm_param: "/${ENV}/${app}/${SERVICE}/DB_HOST"
           value: ""
         remote-port:
-          ssm_param: "/${PLACEHOLDER}/path/to/parameter/DB_PORT"
+          ssm_param: "/${ENV}/${app}/${SERVICE}/DB_PORT"
           value: ""
         local-port-range:
           start: 5000
           end: 5009
         service-details:
-          - /${PLACEHOLDER}/path/to/parameter/DB_HOST
+          - /${ENV}/${app}/${SERVICE}/DB_USER
+  environments:
+    prod:
+      region: us-east-1
+      jumphost-filter: "prod-bastion-*"
+      services:
+        database:
+          local-port-range:
+            start: 6000
+            end: 6009
+
+Exit codes:
+  0  success
+  1  other failure
+  3  invalid flags or config
+  4  AWS authentication failure
+  5  no jumphost found
+  6  no local port available
+  7  session failed or service not reachable
+  8  tunnels not ready within -timeout
 
 For more information, visit: https://github.com/WinstonN/tunnel-go
 `
 
+// varFlags collects repeated -var KEY=VALUE flags
+type varFlags []string
+
+func (v *varFlags) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *varFlags) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+// shutdownTimeout is how long sessions get to terminate before being dropped
+const shutdownTimeout = 15 * time.Second
+
 func findConfigFile(configPath string) (string, error) {
 	// If config path is provided, use it
 	if configPath != "" {
@@ -101,135 +191,475 @@ func findConfigFile(configPath string) (string, error) {
 	return "", fmt.Errorf("no config file found in standard locations")
 }
 
+// managerOptions are the flags of the commands that create a tunnel manager
+type managerOptions struct {
+	configPath string
+	env        string
+	region     string
+	vars       []string
+	offline    bool
+	refresh    bool
+	verbose    bool
+	logLevel   string
+	logFormat  string
+	// concurrency overrides the config's concurrency when positive
+	concurrency int
+	// jumphost overrides the config's jumphost when set
+	jumphost string
+	// lazy makes every tunnel lazy
+	lazy bool
+}
+
+// setupLogging configures the default logger from the flags and the config.
+// -log-level takes precedence over -verbose, and both over the config.
+func setupLogging(cfg *config.Config, opts managerOptions) (*slog.Logger, error) {
+	level := slog.LevelInfo
+	switch {
+	case opts.logLevel != "":
+		l, err := logging.ParseLevel(opts.logLevel)
+		if err != nil {
+			return nil, err
+		}
+		level = l
+	case opts.verbose:
+		level = slog.LevelDebug
+	case cfg.TunnelConfig.LogLevel != "":
+		l, err := logging.ParseLevel(cfg.TunnelConfig.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		level = l
+	}
+
+	format := cfg.TunnelConfig.LogFormat
+	if opts.logFormat != "" {
+		format = opts.logFormat
+	}
+
+	// The log file stays open until the process exits
+	logger, _, err := logging.New(os.Stderr, logging.Options{
+		Level:      level,
+		Format:     format,
+		File:       cfg.TunnelConfig.LogfileLocation,
+		MaxSize:    int64(cfg.TunnelConfig.LogRotation.MaxSizeMB) << 20,
+		MaxBackups: cfg.TunnelConfig.LogRotation.MaxBackups,
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	fatalWith(exitFailure, msg, args...)
+}
+
+// fatalWith logs an error and exits with code
+func fatalWith(code int, msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(code)
+}
+
+// configError reports a problem with the config or the flags, before logging
+// is set up, and exits
+func configError(format string, args ...any) {
+	log.Printf(format, args...)
+	os.Exit(exitConfig)
+}
+
+// parseFlags parses the flags of a command. Invalid flags exit with
+// exitConfig once the flag package has printed the problem, and -h exits
+// successfully after the usage.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(exitConfig)
+	}
+}
+
+// setFlags returns those of names that were given on the command line, as
+// they are written there
+func setFlags(fs *flag.FlagSet, names ...string) []string {
+	var set []string
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			if f.Name == name {
+				set = append(set, "-"+name)
+			}
+		}
+	})
+	return set
+}
+
+// newManager loads the config, applies the overrides for the environment and
+// creates a tunnel manager for it, exiting on failure with the exit code for
+// the kind of failure. The region flag
+// overrides the region from the config.
+func newManager(opts managerOptions) (*tunnel.Manager, *config.Config) {
+	// Load the configuration
+	cfg, err := config.LoadConfig(opts.configPath)
+	if err != nil {
+		configError("Failed to load config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		printValidationErrors(opts.configPath, err)
+		configError("Invalid config, run tunnel-go validate-config for details")
+	}
+	cfg = cfg.ForEnvironment(opts.env)
+	if opts.concurrency > 0 {
+		cfg.TunnelConfig.Concurrency = opts.concurrency
+	}
+	if opts.jumphost != "" {
+		cfg.TunnelConfig.Jumphost = opts.jumphost
+	}
+	if opts.lazy {
+		cfg.TunnelConfig.Lazy = true
+	}
+
+	logger, err := setupLogging(cfg, opts)
+	if err != nil {
+		configError("Failed to set up logging: %v", err)
+	}
+
+	// Use region from flag if provided, otherwise use default from config
+	region := cfg.Region()
+	if opts.region != "" {
+		region = opts.region
+	}
+
+	// Initialize AWS client, assuming the environment's role if one is configured
+	var role *aws.AssumeRole
+	identity := []string{region, cfg.AWS.Profile}
+	if r := cfg.GetRole(opts.env); r != nil {
+		role = &aws.AssumeRole{
+			RoleARN:     r.RoleARN,
+			ExternalID:  r.ExternalID,
+			SessionName: r.SessionName,
+			MFASerial:   r.MFASerial,
+		}
+		identity = append(identity, r.RoleARN)
+	}
+	awsClient, err := aws.NewClient(region, cfg.AWS.Profile, role, logger)
+	if err != nil {
+		fatalWith(exitAuth, "Failed to create AWS client", "error", err)
+	}
+
+	// Cache parameters and jumphost lookups per account, region and environment
+	cachePath := cfg.TunnelConfig.CachefileLocation
+	if cachePath == "" {
+		if cachePath, err = cache.DefaultPath(); err != nil {
+			fatal("Failed to locate cache", "error", err)
+		}
+	}
+	lookups, err := cache.Open(cachePath, cache.Options{
+		ParameterTTL: cfg.TunnelConfig.CacheTTL.Parameters,
+		JumphostTTL:  cfg.TunnelConfig.CacheTTL.Jumphosts,
+		Offline:      opts.offline,
+		Refresh:      opts.refresh,
+	})
+	if err != nil {
+		fatal("Failed to open cache", "error", err)
+	}
+	// The account is only looked up once a cached lookup or ${ACCOUNT_ID}
+	// needs it, and then only once
+	accountID := sync.OnceValues(func() (string, error) {
+		return lookups.AccountID(strings.Join(identity, "/"), awsClient.AccountID)
+	})
+	namespace := cache.Namespace(awsClient.GetRegion(), accountID, opts.env)
+
+	deps := tunnel.AWSDependencies(awsClient)
+	deps.Instances = lookups.Instances(namespace, deps.Instances)
+	deps.Parameters = lookups.Parameters(namespace, deps.Parameters)
+
+	// Reserve local ports in the runtime directory shared by every tunnel-go
+	// process, so parallel invocations never pick the same port, and
+	// remember the port of each service so it gets the same one next time
+	runtimeDir, err := daemon.RuntimeDir()
+	if err != nil {
+		fatal("Failed to locate runtime directory", "error", err)
+	}
+	historyPath, err := ports.DefaultHistoryPath()
+	if err != nil {
+		fatal("Failed to locate port history", "error", err)
+	}
+	deps.Ports = ports.Open(runtimeDir, historyPath)
+
+	// Template variables, with -var flags taking precedence over the config
+	overrides, err := config.ParseVarFlags(opts.vars)
+	if err != nil {
+		fatalWith(exitConfig, "Failed to parse -var", "error", err)
+	}
+	vars := cfg.Vars(opts.env, awsClient.GetRegion(), overrides)
+	vars.SetFunc(config.VarAccountID, accountID)
+
+	return tunnel.NewManagerWithDependencies(deps, cfg, opts.env, vars, logger), cfg
+}
+
+// shutdown closes all tunnels, reporting the result for each service, and
+// returns the process exit code. A second signal skips waiting for sessions
+// to terminate.
+func shutdown(manager *tunnel.Manager, sigChan <-chan os.Signal) int {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	go func() {
+		select {
+		case sig := <-sigChan:
+			slog.Warn("Received signal again, forcing shutdown", "signal", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	exitCode := 0
+	for _, result := range manager.Shutdown(ctx) {
+		switch {
+		case result.Forced:
+			fmt.Printf("%s: forced close (%v)\n", result.Service, result.Err)
+			exitCode = 1
+		case result.Err != nil:
+			fmt.Printf("%s: close failed (%v)\n", result.Service, result.Err)
+			exitCode = 1
+		default:
+			fmt.Printf("%s: closed\n", result.Service)
+		}
+	}
+	return exitCode
+}
+
+// runCreateTunnel creates tunnels for services and keeps them open until a
+// termination signal. It returns the process exit code, which tells the
+// kind of failure when tunnels cannot be created.
+func runCreateTunnel(manager *tunnel.Manager, services []string, wait waitOptions) int {
+	// Handle signals from the start so tunnels created before an
+	// interrupt are still closed
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	ctx, cancel := wait.context()
+	defer cancel()
+
+	// Create tunnels, giving up on those not created in time
+	created := make(chan error, 1)
+	go func() { created <- manager.CreateTunnelsContext(ctx, services) }()
+
+	select {
+	case err := <-created:
+		if err != nil {
+			slog.Error("Failed to create tunnels", "error", err)
+			reason := tunnel.FailureReason(err)
+			if ctx.Err() != nil {
+				// Creation was cut short by the timeout
+				reason = reasonTimeout
+			}
+			code := exitCode(reason)
+			if wait.enabled {
+				code = printNotReady(manager.Env(), reason, err)
+			}
+			shutdown(manager, sigChan)
+			return code
+		}
+	case <-ctx.Done():
+		slog.Error("Tunnels not created in time", "timeout", wait.timeout)
+		// Creation stops with ctx; wait for it so the tunnels already
+		// created are closed too
+		<-created
+		code := printNotReady(manager.Env(), reasonTimeout, fmt.Errorf("tunnels not ready within %s", wait.timeout))
+		shutdown(manager, sigChan)
+		return code
+	case sig := <-sigChan:
+		slog.Info("Received signal while creating tunnels", "signal", sig)
+		// Wait for the tunnels being created so they are closed too
+		<-created
+		return shutdown(manager, sigChan)
+	}
+
+	if wait.enabled {
+		list := func() ([]tunnel.TunnelStatus, error) { return manager.Tunnels(), nil }
+		tunnels, err := waitReady(ctx, services, list)
+		if err != nil {
+			slog.Error("Tunnels not ready in time", "timeout", wait.timeout, "error", err)
+			code := printNotReady(manager.Env(), reasonTimeout, err)
+			shutdown(manager, sigChan)
+			return code
+		}
+		printReady(manager.Env(), tunnels)
+	} else {
+		fmt.Println("Tunnels created successfully. Press Ctrl+C to exit and close all tunnels")
+	}
+
+	// Wait for a termination signal
+	sig := <-sigChan
+	slog.Info("Received signal, closing tunnels", "signal", sig)
+	return shutdown(manager, sigChan)
+}
+
 func main() {
 	// Define flags
-	createTunnelCmd := flag.NewFlagSet("create-tunnel", flag.ExitOnError)
+	createTunnelCmd := flag.NewFlagSet("create-tunnel", flag.ContinueOnError)
 	createTunnelConfig := createTunnelCmd.String("config", "", "Path to config file")
 	createTunnelEnv := createTunnelCmd.String("env", "", "Environment name")
 	createTunnelServices := createTunnelCmd.String("services", "", "Comma-separated list of services")
 	createTunnelRegion := createTunnelCmd.String("region", "", "AWS region (optional, overrides config default_region)")
-	createTunnelVerbose := createTunnelCmd.Bool("verbose", false, "Enable verbose logging")
-
-	serviceDetailsCmd := flag.NewFlagSet("service-details", flag.ExitOnError)
+	var createTunnelVars varFlags
+	createTunnelCmd.Var(&createTunnelVars, "var", "Template variable as KEY=VALUE (repeatable)")
+	createTunnelOffline := createTunnelCmd.Bool("offline", false, "Use cached lookups, even expired ones, when AWS cannot be reached")
+	createTunnelRefresh := createTunnelCmd.Bool("refresh", false, "Ignore cached lookups and fetch everything again")
+	createTunnelConcurrency := createTunnelCmd.Int("concurrency", 0, "Number of tunnels created at once (overrides concurrency in the config)")
+	createTunnelJumphost := createTunnelCmd.String("jumphost", "", "Instance ID of the jumphost to use (overrides jumphost in the config)")
+	createTunnelLazy := createTunnelCmd.Bool("lazy", false, "Start each session on the first connection to its local port")
+	createTunnelWait := createTunnelCmd.Bool("wait", false, "Print a JSON line once every tunnel has an established session, failing after -timeout")
+	createTunnelTimeout := createTunnelCmd.Duration("timeout", defaultWaitTimeout, "How long -wait waits for the tunnels to be created and ready")
+	createTunnelVerbose := createTunnelCmd.Bool("verbose", false, "Enable debug logging (same as -log-level debug)")
+	createTunnelLogLevel := createTunnelCmd.String("log-level", "", "Log level: debug, info, warn or error (overrides log-level in the config)")
+	createTunnelLogFormat := createTunnelCmd.String("log-format", "", "Log format: text or json (overrides log-format in the config)")
+
+	serviceDetailsCmd := flag.NewFlagSet("service-details", flag.ContinueOnError)
 	serviceDetailsConfig := serviceDetailsCmd.String("config", "", "Path to config file")
 	serviceDetailsEnv := serviceDetailsCmd.String("env", "", "Environment name")
 	serviceDetailsServices := serviceDetailsCmd.String("services", "", "Comma-separated list of services")
 	serviceDetailsRegion := serviceDetailsCmd.String("region", "", "AWS region (optional, overrides config default_region)")
-	serviceDetailsVerbose := serviceDetailsCmd.Bool("verbose", false, "Enable verbose logging")
+	var serviceDetailsVars varFlags
+	serviceDetailsCmd.Var(&serviceDetailsVars, "var", "Template variable as KEY=VALUE (repeatable)")
+	serviceDetailsOffline := serviceDetailsCmd.Bool("offline", false, "Use cached lookups, even expired ones, when AWS cannot be reached")
+	serviceDetailsRefresh := serviceDetailsCmd.Bool("refresh", false, "Ignore cached lookups and fetch everything again")
+	serviceDetailsVerbose := serviceDetailsCmd.Bool("verbose", false, "Enable debug logging (same as -log-level debug)")
+	serviceDetailsLogLevel := serviceDetailsCmd.String("log-level", "", "Log level: debug, info, warn or error (overrides log-level in the config)")
+	serviceDetailsLogFormat := serviceDetailsCmd.String("log-format", "", "Log format: text or json (overrides log-format in the config)")
+
+	daemonCmd := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	daemonConfig := daemonCmd.String("config", "", "Path to config file")
+	daemonEnv := daemonCmd.String("env", "", "Environment name")
+	daemonServices := daemonCmd.String("services", "", "Comma-separated list of services to create on startup (optional)")
+	daemonRegion := daemonCmd.String("region", "", "AWS region (optional, overrides config default_region)")
+	var daemonVars varFlags
+	daemonCmd.Var(&daemonVars, "var", "Template variable as KEY=VALUE (repeatable)")
+	daemonForeground := daemonCmd.Bool("foreground", false, "Run in the foreground instead of detaching")
+	daemonOffline := daemonCmd.Bool("offline", false, "Use cached lookups, even expired ones, when AWS cannot be reached")
+	daemonRefresh := daemonCmd.Bool("refresh", false, "Ignore cached lookups and fetch everything again")
+	daemonConcurrency := daemonCmd.Int("concurrency", 0, "Number of tunnels created at once (overrides concurrency in the config)")
+	daemonJumphost := daemonCmd.String("jumphost", "", "Instance ID of the jumphost to use (overrides jumphost in the config)")
+	daemonLazy := daemonCmd.Bool("lazy", false, "Start each session on the first connection to its local port")
+	daemonVerbose := daemonCmd.Bool("verbose", false, "Enable debug logging (same as -log-level debug)")
+	daemonLogLevel := daemonCmd.String("log-level", "", "Log level: debug, info, warn or error (overrides log-level in the config)")
+	daemonLogFormat := daemonCmd.String("log-format", "", "Log format: text or json (overrides log-format in the config)")
+
+	statusCmd := flag.NewFlagSet("status", flag.ContinueOnError)
+	statusConfig := statusCmd.String("config", "", "Path to config file")
+	statusOutput := statusCmd.String("output", outputTable, "Output format: table or json")
+
+	stopCmd := flag.NewFlagSet("stop", flag.ContinueOnError)
+	stopConfig := stopCmd.String("config", "", "Path to config file")
+	stopServices := stopCmd.String("services", "", "Comma-separated list of services")
+	stopAll := stopCmd.Bool("all", false, "Stop all tunnels")
+
+	listCmd := flag.NewFlagSet("list", flag.ContinueOnError)
+	listConfig := listCmd.String("config", "", "Path to config file")
+	listEnv := listCmd.String("env", "", "Environment name (optional, applies its overrides)")
+	listOutput := listCmd.String("output", outputTable, "Output format: table or json")
+
+	validateConfigCmd := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	validateConfigConfig := validateConfigCmd.String("config", "", "Path to config file")
 
 	// Parse command line arguments
 	if len(os.Args) < 2 {
-		fmt.Println(helpText)
+		fmt.Print(helpText)
 		os.Exit(1)
 	}
 
 	switch os.Args[1] {
 	case "create-tunnel":
-		err := createTunnelCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Fatalf("Failed to parse flags: %v", err)
-		}
+		parseFlags(createTunnelCmd, os.Args[2:])
 
 		if *createTunnelEnv == "" {
-			log.Fatal("Environment name is required")
+			configError("Environment name is required")
 		}
 		if *createTunnelServices == "" {
-			log.Fatal("Services list is required")
+			configError("Services list is required")
 		}
 
 		// Find config file
 		foundConfigPath, err := findConfigFile(*createTunnelConfig)
 		if err != nil {
-			log.Fatalf("Failed to find config file: %v", err)
-		}
-
-		// Load the configuration
-		cfg, err := config.LoadConfig(foundConfigPath)
-		if err != nil {
-			log.Fatalf("Failed to load config: %v", err)
+			configError("Failed to find config file: %v", err)
 		}
 
-		// Use region from flag if provided, otherwise use default from config
-		region := cfg.DefaultRegion
-		if *createTunnelRegion != "" {
-			region = *createTunnelRegion
-		}
-
-		// Initialize AWS client
-		awsClient, err := aws.NewClient(region, *createTunnelVerbose)
-		if err != nil {
-			log.Fatalf("Failed to create AWS client: %v", err)
-		}
-
-		// Create tunnel manager
-		manager := tunnel.NewManager(awsClient, cfg, *createTunnelEnv, *createTunnelVerbose)
-
-		// Parse services list
+		// Hand the tunnels to a running daemon for this config, if any
 		services := strings.Split(*createTunnelServices, ",")
-
-		// Create tunnels
-		if err := manager.CreateTunnels(services); err != nil {
-			log.Fatalf("Failed to create tunnels: %v", err)
+		wait := waitOptions{enabled: *createTunnelWait, timeout: *createTunnelTimeout}
+		overrides := setFlags(createTunnelCmd, "region", "var", "offline", "refresh", "concurrency", "jumphost", "lazy")
+		if code, ok := addToDaemon(foundConfigPath, *createTunnelEnv, services, overrides, wait); ok {
+			os.Exit(code)
 		}
 
-		fmt.Print("Tunnels created successfully. Press Ctrl+C to exit and close all tunnels")
-
-		// Wait for interrupt signal
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt)
-		<-sigChan
+		// Create tunnel manager
+		manager, _ := newManager(managerOptions{
+			configPath:  foundConfigPath,
+			env:         *createTunnelEnv,
+			region:      *createTunnelRegion,
+			vars:        createTunnelVars,
+			offline:     *createTunnelOffline,
+			refresh:     *createTunnelRefresh,
+			verbose:     *createTunnelVerbose,
+			logLevel:    *createTunnelLogLevel,
+			logFormat:   *createTunnelLogFormat,
+			concurrency: *createTunnelConcurrency,
+			jumphost:    *createTunnelJumphost,
+			lazy:        *createTunnelLazy,
+		})
+
+		os.Exit(runCreateTunnel(manager, services, wait))
 
 	case "service-details":
-		err := serviceDetailsCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Fatalf("Failed to parse flags: %v", err)
-		}
+		parseFlags(serviceDetailsCmd, os.Args[2:])
 
 		if *serviceDetailsEnv == "" {
-			log.Fatal("Environment name is required")
+			configError("Environment name is required")
 		}
 		if *serviceDetailsServices == "" {
-			log.Fatal("Services list is required")
+			configError("Services list is required")
 		}
 
 		// Find config file
 		foundConfigPath, err := findConfigFile(*serviceDetailsConfig)
 		if err != nil {
-			log.Fatalf("Failed to find config file: %v", err)
-		}
-
-		// Load the configuration
-		cfg, err := config.LoadConfig(foundConfigPath)
-		if err != nil {
-			log.Fatalf("Failed to load config: %v", err)
-		}
-
-		// Use region from flag if provided, otherwise use default from config
-		region := cfg.DefaultRegion
-		if *serviceDetailsRegion != "" {
-			region = *serviceDetailsRegion
-		}
-
-		// Initialize AWS client
-		awsClient, err := aws.NewClient(region, *serviceDetailsVerbose)
-		if err != nil {
-			log.Fatalf("Failed to create AWS client: %v", err)
+			configError("Failed to find config file: %v", err)
 		}
 
 		// Create tunnel manager
-		manager := tunnel.NewManager(awsClient, cfg, *serviceDetailsEnv, *serviceDetailsVerbose)
+		manager, cfg := newManager(managerOptions{
+			configPath: foundConfigPath,
+			env:        *serviceDetailsEnv,
+			region:     *serviceDetailsRegion,
+			vars:       serviceDetailsVars,
+			offline:    *serviceDetailsOffline,
+			refresh:    *serviceDetailsRefresh,
+			verbose:    *serviceDetailsVerbose,
+			logLevel:   *serviceDetailsLogLevel,
+			logFormat:  *serviceDetailsLogFormat,
+		})
 
-		// Get details for each service
 		services := strings.Split(*serviceDetailsServices, ",")
 		for _, serviceName := range services {
-			serviceConfig, err := cfg.GetServiceConfig(serviceName)
-			if err != nil {
-				log.Fatalf("Failed to get config for %s: %v", serviceName, err)
+			if _, err := cfg.GetServiceConfig(serviceName); err != nil {
+				fatal("Failed to get service config", "service", serviceName, "error", err)
 			}
+		}
 
-			details, err := manager.GetServiceDetails(serviceName, serviceConfig)
-			if err != nil {
-				log.Printf("Warning: Failed to get details for %s: %v", serviceName, err)
+		// Get the details of all services at once, reporting every missing
+		// parameter together
+		allDetails, err := manager.ServiceDetails(services)
+		if err != nil {
+			slog.Warn("Failed to get service details", "error", err)
+		}
+		for _, serviceName := range services {
+			details, ok := allDetails[serviceName]
+			if !ok {
 				continue
 			}
 
@@ -251,6 +681,100 @@ func main() {
 			}
 			fmt.Println()
 		}
+	case "daemon":
+		parseFlags(daemonCmd, os.Args[2:])
+
+		if *daemonEnv == "" {
+			configError("Environment name is required")
+		}
+
+		// Find config file
+		foundConfigPath, err := findConfigFile(*daemonConfig)
+		if err != nil {
+			configError("Failed to find config file: %v", err)
+		}
+
+		services := splitServices(*daemonServices)
+
+		if !*daemonForeground {
+			os.Exit(startDaemon(foundConfigPath, os.Args[2:]))
+		}
+		os.Exit(runDaemon(managerOptions{
+			configPath:  foundConfigPath,
+			env:         *daemonEnv,
+			region:      *daemonRegion,
+			vars:        daemonVars,
+			offline:     *daemonOffline,
+			refresh:     *daemonRefresh,
+			verbose:     *daemonVerbose,
+			logLevel:    *daemonLogLevel,
+			logFormat:   *daemonLogFormat,
+			concurrency: *daemonConcurrency,
+			jumphost:    *daemonJumphost,
+			lazy:        *daemonLazy,
+		}, services))
+
+	case "status":
+		parseFlags(statusCmd, os.Args[2:])
+		checkOutputFormat(*statusOutput)
+
+		// Find config file
+		foundConfigPath, err := findConfigFile(*statusConfig)
+		if err != nil {
+			configError("Failed to find config file: %v", err)
+		}
+
+		os.Exit(runStatus(foundConfigPath, *statusOutput))
+
+	case "stop":
+		parseFlags(stopCmd, os.Args[2:])
+
+		services := splitServices(*stopServices)
+		if len(services) == 0 && !*stopAll {
+			configError("Services list or -all is required")
+		}
+
+		// Find config file
+		foundConfigPath, err := findConfigFile(*stopConfig)
+		if err != nil {
+			configError("Failed to find config file: %v", err)
+		}
+
+		os.Exit(runStop(foundConfigPath, services, *stopAll))
+
+	case "list":
+		parseFlags(listCmd, os.Args[2:])
+		checkOutputFormat(*listOutput)
+
+		// Find config file
+		foundConfigPath, err := findConfigFile(*listConfig)
+		if err != nil {
+			configError("Failed to find config file: %v", err)
+		}
+
+		// Load the configuration
+		cfg, err := config.LoadConfig(foundConfigPath)
+		if err != nil {
+			configError("Failed to load config: %v", err)
+		}
+
+		if *listEnv != "" {
+			cfg = cfg.ForEnvironment(*listEnv)
+		}
+
+		os.Exit(runList(cfg, *listEnv, *listOutput))
+
+	case "validate-config":
+		parseFlags(validateConfigCmd, os.Args[2:])
+
+		// Find config file
+		foundConfigPath, err := findConfigFile(*validateConfigConfig)
+		if err != nil {
+			configError("Failed to find config file: %v", err)
+		}
+
+		os.Exit(runValidateConfig(foundConfigPath))
+
 	default:
 		fmt.Printf("Unknown command: %s\n", os.Args[1])
 		os.Exit(1)
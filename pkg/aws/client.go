@@ -3,9 +3,10 @@ package aws
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
 	"time"
-	"math/rand"
-	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -13,45 +14,122 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
-	"log"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
+// EC2API is the subset of the EC2 client used by Client
+type EC2API interface {
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	DescribeNetworkInterfaces(ctx context.Context, params *ec2.DescribeNetworkInterfacesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error)
+}
+
+// SSMAPI is the subset of the SSM client used by Client and for sessions
+type SSMAPI interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+	GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error)
+	StartSession(ctx context.Context, params *ssm.StartSessionInput, optFns ...func(*ssm.Options)) (*ssm.StartSessionOutput, error)
+	DescribeSessions(ctx context.Context, params *ssm.DescribeSessionsInput, optFns ...func(*ssm.Options)) (*ssm.DescribeSessionsOutput, error)
+	DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, optFns ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error)
+	TerminateSession(ctx context.Context, params *ssm.TerminateSessionInput, optFns ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error)
+}
+
+// STSAPI is the subset of the STS client used by Client
+type STSAPI interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
 // Client wraps AWS SDK clients
 type Client struct {
-	ctx context.Context
-	EC2 *ec2.Client
-	SSM *ssm.Client
+	ctx    context.Context
+	EC2    EC2API
+	SSM    SSMAPI
+	STS    STSAPI
 	region string
-	verbose bool
+	log    *slog.Logger
 }
 
-// NewClient creates a new AWS client
-func NewClient(region string, verbose bool) (*Client, error) {
+// NewClient creates a new AWS client. A non-empty profile selects the shared
+// config profile used for the base credentials, and a non-nil role is assumed
+// on top of them. Messages are logged to logger, or to the default logger
+// when it is nil.
+func NewClient(region, profile string, role *AssumeRole, logger *slog.Logger) (*Client, error) {
 	ctx := context.Background()
+	if logger == nil {
+		logger = slog.Default()
+	}
 
 	// Load AWS configuration
-	cfg, err := config.LoadDefaultConfig(ctx,
+	opts := []func(*config.LoadOptions) error{
 		config.WithRegion(region),
-	)
+	}
+	if profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
+	if role != nil {
+		logger.Debug("Assuming role", "role", role.RoleARN)
+		creds, err := assumeRoleCredentials(cfg, profile, *role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up role %s: %w", role.RoleARN, err)
+		}
+		cfg.Credentials = creds
+	}
+
+	// Resolve credentials up front so a failing profile, role or MFA code is
+	// reported before any tunnel is started
+	if cfg.Credentials != nil {
+		if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+			return nil, fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+		}
+	}
+
 	// Create service clients
 	return &Client{
-		ctx: ctx,
-		EC2: ec2.NewFromConfig(cfg),
-		SSM: ssm.NewFromConfig(cfg),
-		region: region,
-		verbose: verbose,
+		ctx:    ctx,
+		EC2:    ec2.NewFromConfig(cfg),
+		SSM:    ssm.NewFromConfig(cfg),
+		STS:    sts.NewFromConfig(cfg),
+		region: cfg.Region,
+		log:    logger,
 	}, nil
 }
 
+// NewClientWithAPIs creates a client around existing service clients. STS
+// is left unset and can be assigned if AccountID is needed.
+func NewClientWithAPIs(ssmAPI SSMAPI, ec2API EC2API, region string, logger *slog.Logger) *Client {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Client{
+		ctx:    context.Background(),
+		EC2:    ec2API,
+		SSM:    ssmAPI,
+		region: region,
+		log:    logger,
+	}
+}
+
 // GetRegion returns the configured AWS region
 func (c *Client) GetRegion() string {
 	return c.region
 }
 
+// AccountID returns the ID of the account the credentials belong to
+func (c *Client) AccountID() (string, error) {
+	if c.STS == nil {
+		return "", fmt.Errorf("no STS client configured")
+	}
+	output, err := c.STS.GetCallerIdentity(c.ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller identity: %w", err)
+	}
+	return aws.ToString(output.Account), nil
+}
+
 // GetSSMEndpoint returns the SSM endpoint for the configured region
 func (c *Client) GetSSMEndpoint() string {
 	return fmt.Sprintf("https://ssm.%s.amazonaws.com", c.region)
@@ -88,100 +166,131 @@ func (c *Client) GetParameter(name string) (string, error) {
 
 // GetParametersByPath gets parameters by their exact names
 func (c *Client) GetParametersByPath(paths []string) ([]ssmtypes.Parameter, error) {
-	// Create a context with timeout for the parameter fetch
-	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
-	defer cancel()
+	parameters, _, err := c.getParameters(paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(parameters) == 0 {
+		return nil, fmt.Errorf("no parameters found")
+	}
 
-	var parameters []ssmtypes.Parameter
-	batchSize := 10 // AWS allows up to 10 parameters per batch
+	c.log.Debug("Found parameters", "count", len(parameters))
 
-	// Process parameters in batches
-	for i := 0; i < len(paths); i += batchSize {
-		end := i + batchSize
-		if end > len(paths) {
-			end = len(paths)
-		}
-		batch := paths[i:end]
+	return parameters, nil
+}
 
-		if c.verbose {
-			log.Printf("Fetching batch of %d parameters", len(batch))
+// GetParameters gets the decrypted values of the named parameters, returning
+// the names that do not exist separately rather than failing on them
+func (c *Client) GetParameters(names []string) (map[string]string, []string, error) {
+	parameters, invalid, err := c.getParameters(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make(map[string]string, len(parameters))
+	for _, param := range parameters {
+		if param.Name != nil && param.Value != nil {
+			values[*param.Name] = *param.Value
 		}
+	}
+	return values, invalid, nil
+}
 
-		input := &ssm.GetParametersInput{
-			Names:          batch,
-			WithDecryption: aws.Bool(true),
-		}
+const (
+	// parameterBatchSize is the most names GetParameters accepts per call
+	parameterBatchSize = 10
 
-		output, err := c.SSM.GetParameters(ctx, input)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get parameters: %w", err)
-		}
+	// parameterConcurrency bounds the batches fetched at the same time
+	parameterConcurrency = 4
+)
 
-		if c.verbose {
-			log.Printf("Found %d parameters in batch", len(output.Parameters))
-			if len(output.InvalidParameters) > 0 {
-				log.Printf("Invalid parameters: %v", output.InvalidParameters)
-			}
-		}
+// getParameters fetches the de-duplicated names in concurrent batches,
+// returning the parameters found and the invalid names in sorted order
+func (c *Client) getParameters(names []string) ([]ssmtypes.Parameter, []string, error) {
+	// Create a context with timeout for the parameter fetch
+	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
+	defer cancel()
 
-		parameters = append(parameters, output.Parameters...)
+	seen := make(map[string]bool, len(names))
+	var unique []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
 	}
 
-	if len(parameters) == 0 {
-		return nil, fmt.Errorf("no parameters found")
+	var batches [][]string
+	for i := 0; i < len(unique); i += parameterBatchSize {
+		end := i + parameterBatchSize
+		if end > len(unique) {
+			end = len(unique)
+		}
+		batches = append(batches, unique[i:end])
 	}
 
-	if c.verbose {
-		log.Printf("Found total of %d parameters", len(parameters))
+	outputs := make([]*ssm.GetParametersOutput, len(batches))
+	errs := make([]error, len(batches))
+	sem := make(chan struct{}, parameterConcurrency)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		go func(i int, batch []string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			c.log.Debug("Fetching batch of parameters", "count", len(batch))
+			outputs[i], errs[i] = c.SSM.GetParameters(ctx, &ssm.GetParametersInput{
+				Names:          batch,
+				WithDecryption: aws.Bool(true),
+			})
+		}(i, batch)
 	}
+	wg.Wait()
 
-	return parameters, nil
-}
-
-// GetJumphost returns a random EC2 instance that matches the filter pattern
-func (c *Client) GetJumphost(env string, filter string) (*types.Instance, error) {
-	// Replace environment placeholder in filter
-	filter = strings.ReplaceAll(filter, "${PLACEHOLDER}", env)
-
-	// Create EC2 filter for the Name tag
-	filters := []types.Filter{
-		{
-			Name:   aws.String("tag:Name"),
-			Values: []string{filter},
-		},
-		{
-			Name:   aws.String("instance-state-name"),
-			Values: []string{"running"},
-		},
+	var parameters []ssmtypes.Parameter
+	var invalid []string
+	for i, output := range outputs {
+		if errs[i] != nil {
+			return nil, nil, fmt.Errorf("failed to get parameters: %w", errs[i])
+		}
+		c.log.Debug("Found parameters in batch", "count", len(output.Parameters))
+		if len(output.InvalidParameters) > 0 {
+			c.log.Debug("Invalid parameters", "names", output.InvalidParameters)
+		}
+		parameters = append(parameters, output.Parameters...)
+		invalid = append(invalid, output.InvalidParameters...)
 	}
+	sort.Strings(invalid)
+	return parameters, invalid, nil
+}
 
-	// Describe instances with filter
+// IsInstanceRunning reports whether the instance with the given ID exists and is running
+func (c *Client) IsInstanceRunning(instanceID string) (bool, error) {
+	// Filtering by instance-id instead of passing InstanceIds avoids an error
+	// for instances that have already been terminated and purged
 	input := &ec2.DescribeInstancesInput{
-		Filters: filters,
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: []string{instanceID},
+			},
+		},
 	}
 
-	output, err := c.EC2.DescribeInstances(context.TODO(), input)
+	output, err := c.EC2.DescribeInstances(c.ctx, input)
 	if err != nil {
-		return nil, fmt.Errorf("failed to describe instances: %w", err)
+		return false, fmt.Errorf("failed to describe instance %s: %w", instanceID, err)
 	}
 
-	// Collect all instances
-	var instances []types.Instance
 	for _, reservation := range output.Reservations {
 		for _, instance := range reservation.Instances {
 			if instance.State != nil && instance.State.Name == types.InstanceStateNameRunning {
-				instances = append(instances, instance)
+				return true, nil
 			}
 		}
 	}
-
-	if len(instances) == 0 {
-		return nil, fmt.Errorf("no running instances found matching filter: %s", filter)
-	}
-
-	// Return a random instance
-	rand.Seed(time.Now().UnixNano())
-	return &instances[rand.Intn(len(instances))], nil
+	return false, nil
 }
 
 // Helper function to get instance name from tags
@@ -2,18 +2,35 @@ package aws
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
 )
 
 type mockSSMClient struct {
 	getParameterOutput *ssm.GetParameterOutput
-	err               error
+	err                error
+
+	// parameters are returned by GetParameters, which records each batch
+	parameters map[string]string
+	mu         sync.Mutex
+	batches    [][]string
+
+	// sessions are returned by DescribeSessions
+	sessions []ssmtypes.Session
+
+	// agents are returned by DescribeInstanceInformation for the requested
+	// instances. When nil, every instance has a current agent that is online.
+	agents map[string]ssmtypes.InstanceInformation
 }
 
 func (m *mockSSMClient) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
@@ -23,46 +40,127 @@ func (m *mockSSMClient) GetParameter(ctx context.Context, params *ssm.GetParamet
 	return m.getParameterOutput, nil
 }
 
+func (m *mockSSMClient) GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error) {
+	m.mu.Lock()
+	m.batches = append(m.batches, params.Names)
+	m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	output := &ssm.GetParametersOutput{}
+	for _, name := range params.Names {
+		if value, ok := m.parameters[name]; ok {
+			output.Parameters = append(output.Parameters, ssmtypes.Parameter{Name: aws.String(name), Value: aws.String(value)})
+		} else {
+			output.InvalidParameters = append(output.InvalidParameters, name)
+		}
+	}
+	return output, nil
+}
+
+func (m *mockSSMClient) StartSession(ctx context.Context, params *ssm.StartSessionInput, optFns ...func(*ssm.Options)) (*ssm.StartSessionOutput, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *mockSSMClient) DescribeSessions(ctx context.Context, params *ssm.DescribeSessionsInput, optFns ...func(*ssm.Options)) (*ssm.DescribeSessionsOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &ssm.DescribeSessionsOutput{Sessions: m.sessions}, nil
+}
+
+func (m *mockSSMClient) DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, optFns ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	output := &ssm.DescribeInstanceInformationOutput{}
+	for _, id := range params.Filters[0].Values {
+		info, ok := m.agents[id]
+		if m.agents == nil {
+			info, ok = agent(id, ssmtypes.PingStatusOnline, minAgentVersion), true
+		}
+		if ok {
+			output.InstanceInformationList = append(output.InstanceInformationList, info)
+		}
+	}
+	return output, nil
+}
+
+func (m *mockSSMClient) TerminateSession(ctx context.Context, params *ssm.TerminateSessionInput, optFns ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error) {
+	return nil, errors.New("not implemented")
+}
+
 type mockEC2Client struct {
 	describeInstancesOutput *ec2.DescribeInstancesOutput
-	err                    error
+	err                     error
+	input                   *ec2.DescribeInstancesInput
+
+	// networkInterfaces are returned by DescribeNetworkInterfaces
+	networkInterfaces []ec2types.NetworkInterface
 }
 
 func (m *mockEC2Client) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	m.input = params
 	if m.err != nil {
 		return nil, m.err
 	}
 	return m.describeInstancesOutput, nil
 }
 
-func TestGetEC2InstancesByFilter(t *testing.T) {
+func (m *mockEC2Client) DescribeNetworkInterfaces(ctx context.Context, params *ec2.DescribeNetworkInterfacesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: m.networkInterfaces}, nil
+}
+
+func instance(id string, state ec2types.InstanceStateName) ec2types.Instance {
+	return ec2types.Instance{
+		InstanceId: aws.String(id),
+		State:      &ec2types.InstanceState{Name: state},
+	}
+}
+
+func TestGetJumphost(t *testing.T) {
 	tests := []struct {
 		name    string
-		filter  string
 		output  *ec2.DescribeInstancesOutput
 		err     error
 		want    []string
 		wantErr bool
 	}{
 		{
-			name:   "Success",
-			filter: "test-filter",
+			name: "Success",
 			output: &ec2.DescribeInstancesOutput{
 				Reservations: []ec2types.Reservation{
 					{
 						Instances: []ec2types.Instance{
-							{
-								PrivateIpAddress: aws.String("10.0.0.1"),
-							},
-							{
-								PrivateIpAddress: aws.String("10.0.0.2"),
-							},
+							instance("i-1", ec2types.InstanceStateNameRunning),
+							instance("i-2", ec2types.InstanceStateNameRunning),
 						},
 					},
 				},
 			},
-			want:    []string{"10.0.0.1", "10.0.0.2"},
-			wantErr: false,
+			want: []string{"i-1", "i-2"},
+		},
+		{
+			name: "NoRunningInstances",
+			output: &ec2.DescribeInstancesOutput{
+				Reservations: []ec2types.Reservation{
+					{
+						Instances: []ec2types.Instance{
+							instance("i-1", ec2types.InstanceStateNameStopped),
+						},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "Error",
+			err:     errors.New("test error"),
+			wantErr: true,
 		},
 	}
 
@@ -70,26 +168,71 @@ func TestGetEC2InstancesByFilter(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockEC2 := &mockEC2Client{
 				describeInstancesOutput: tt.output,
-				err:                    tt.err,
+				err:                     tt.err,
 			}
 
-			client := NewClient(nil, mockEC2)
+			client := NewClientWithAPIs(&mockSSMClient{}, mockEC2, "us-east-1", nil)
 
-			got, err := client.GetEC2InstancesByFilter(tt.filter)
+			got, err := client.GetJumphost(JumphostQuery{Filters: NameFilter("dev-jumphost")})
 			if (err != nil) != tt.wantErr {
-				t.Errorf("GetEC2InstancesByFilter() error = %v, wantErr %v", err, tt.wantErr)
+				t.Fatalf("GetJumphost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if filter := mockEC2.input.Filters[0].Values[0]; filter != "dev-jumphost" {
+				t.Errorf("GetJumphost() filtered on %q, want dev-jumphost", filter)
+			}
+			if tt.wantErr {
 				return
 			}
-			if !tt.wantErr {
-				if len(got) != len(tt.want) {
-					t.Errorf("GetEC2InstancesByFilter() got %v, want %v", got, tt.want)
-				}
-				for i, ip := range got {
-					if ip != tt.want[i] {
-						t.Errorf("GetEC2InstancesByFilter() got[%d] = %v, want %v", i, ip, tt.want[i])
-					}
+			found := false
+			for _, id := range tt.want {
+				if *got.InstanceId == id {
+					found = true
 				}
 			}
+			if !found {
+				t.Errorf("GetJumphost() = %s, want one of %v", *got.InstanceId, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsInstanceRunning(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances []ec2types.Instance
+		want      bool
+	}{
+		{
+			name:      "Running",
+			instances: []ec2types.Instance{instance("i-1", ec2types.InstanceStateNameRunning)},
+			want:      true,
+		},
+		{
+			name:      "Stopped",
+			instances: []ec2types.Instance{instance("i-1", ec2types.InstanceStateNameStopped)},
+		},
+		{
+			name: "Missing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockEC2 := &mockEC2Client{
+				describeInstancesOutput: &ec2.DescribeInstancesOutput{
+					Reservations: []ec2types.Reservation{{Instances: tt.instances}},
+				},
+			}
+
+			client := NewClientWithAPIs(nil, mockEC2, "us-east-1", nil)
+
+			got, err := client.IsInstanceRunning("i-1")
+			if err != nil {
+				t.Fatalf("IsInstanceRunning() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("IsInstanceRunning() = %v, want %v", got, tt.want)
+			}
 		})
 	}
 }
@@ -114,16 +257,22 @@ func TestGetParameter(t *testing.T) {
 			want:    "test-value",
 			wantErr: false,
 		},
+		{
+			name:    "Error",
+			param:   "/test/param",
+			err:     errors.New("test error"),
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mockSSM := &mockSSMClient{
 				getParameterOutput: tt.output,
-				err:               tt.err,
+				err:                tt.err,
 			}
 
-			client := NewClient(mockSSM, nil)
+			client := NewClientWithAPIs(mockSSM, nil, "us-east-1", nil)
 
 			got, err := client.GetParameter(tt.param)
 			if (err != nil) != tt.wantErr {
@@ -136,3 +285,67 @@ func TestGetParameter(t *testing.T) {
 		})
 	}
 }
+
+func TestGetParameters(t *testing.T) {
+	mockSSM := &mockSSMClient{parameters: make(map[string]string)}
+	var names []string
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("/test/param%d", i)
+		mockSSM.parameters[name] = fmt.Sprintf("value%d", i)
+		names = append(names, name)
+	}
+	// Duplicates are only requested once
+	names = append(names, "/test/param0", "/test/missing2", "/test/missing1", "/test/missing2")
+
+	client := NewClientWithAPIs(mockSSM, nil, "us-east-1", nil)
+	values, invalid, err := client.GetParameters(names)
+	if err != nil {
+		t.Fatalf("GetParameters() error = %v", err)
+	}
+
+	if len(values) != 25 || values["/test/param24"] != "value24" {
+		t.Errorf("GetParameters() returned %d values, want 25", len(values))
+	}
+	if len(invalid) != 2 || invalid[0] != "/test/missing1" || invalid[1] != "/test/missing2" {
+		t.Errorf("GetParameters() invalid = %v, want [/test/missing1 /test/missing2]", invalid)
+	}
+
+	requested := 0
+	for _, batch := range mockSSM.batches {
+		if len(batch) > 10 {
+			t.Errorf("batch of %d names, want at most 10", len(batch))
+		}
+		requested += len(batch)
+	}
+	if len(mockSSM.batches) != 3 || requested != 27 {
+		t.Errorf("requested %d names in %d batches, want 27 in 3", requested, len(mockSSM.batches))
+	}
+}
+
+func TestGetParametersError(t *testing.T) {
+	mockSSM := &mockSSMClient{err: errors.New("access denied")}
+	client := NewClientWithAPIs(mockSSM, nil, "us-east-1", nil)
+
+	if _, _, err := client.GetParameters([]string{"/test/param"}); err == nil {
+		t.Error("GetParameters() error = nil, want access denied")
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"AccessDenied", &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized"}, true},
+		{"Wrapped", fmt.Errorf("failed to start session: %w", &smithy.GenericAPIError{Code: "ExpiredTokenException"}), true},
+		{"NoCredentials", &smithy.OperationError{ServiceID: "SSM", Err: &v4.SigningError{Err: errors.New("failed to retrieve credentials")}}, true},
+		{"Throttled", &smithy.GenericAPIError{Code: "ThrottlingException"}, false},
+		{"Other", errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := IsAuthError(tt.err); got != tt.want {
+			t.Errorf("IsAuthError(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package aws
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// assumeRoleDuration is how long assumed role credentials are requested for
+	assumeRoleDuration = time.Hour
+
+	// credentialsExpiryWindow refreshes cached credentials this long before
+	// they expire, so sessions are not started with nearly expired credentials
+	credentialsExpiryWindow = 5 * time.Minute
+
+	defaultSessionName = "tunnel-go"
+)
+
+// AssumeRole describes a role assumed on top of the base credentials
+type AssumeRole struct {
+	RoleARN     string
+	ExternalID  string
+	SessionName string
+	// MFASerial is the ARN or serial number of the MFA device. When set the
+	// token code is prompted for on the terminal.
+	MFASerial string
+}
+
+// ErrNoMFAPrompt is returned when a role needs a new MFA code but stdin is
+// not a terminal to prompt on, as in the daemon once the credentials cached
+// at startup expire
+var ErrNoMFAPrompt = errors.New("MFA role credentials expired and there is no terminal to prompt for a code; run tunnel-go service-details in a terminal to enter a new one")
+
+// mfaMu serializes MFA prompts, which all read from stdin
+var mfaMu sync.Mutex
+
+// mfaTokenProvider prompts for an MFA token code
+func mfaTokenProvider() (string, error) {
+	if !stdinIsTerminal() {
+		return "", ErrNoMFAPrompt
+	}
+	mfaMu.Lock()
+	defer mfaMu.Unlock()
+	return stscreds.StdinTokenProvider()
+}
+
+// stdinIsTerminal reports whether stdin can be prompted on. /dev/null, which
+// the daemon runs with, is a character device like a terminal.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// assumeRoleCredentials returns a provider for role's credentials, assumed
+// with the base credentials in cfg. Credentials are cached on disk until
+// shortly before they expire, so MFA codes are not asked for on every run.
+func assumeRoleCredentials(cfg aws.Config, profile string, role AssumeRole) (aws.CredentialsProvider, error) {
+	sessionName := role.SessionName
+	if sessionName == "" {
+		sessionName = defaultSessionName
+	}
+
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), role.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = sessionName
+		o.Duration = assumeRoleDuration
+		if role.ExternalID != "" {
+			o.ExternalID = aws.String(role.ExternalID)
+		}
+		if role.MFASerial != "" {
+			o.SerialNumber = aws.String(role.MFASerial)
+			o.TokenProvider = mfaTokenProvider
+		}
+	})
+
+	dir, err := CredentialsCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s\x00%s",
+		cfg.Region, profile, role.RoleARN, role.ExternalID, sessionName, role.MFASerial)))
+
+	return aws.NewCredentialsCache(&fileCachedCredentials{
+		path:     filepath.Join(dir, hex.EncodeToString(key[:8])+".json"),
+		provider: provider,
+	}, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = credentialsExpiryWindow
+	}), nil
+}
+
+// CredentialsCacheDir returns the directory assumed role credentials are cached in
+func CredentialsCacheDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".tunnel-go", "credentials"), nil
+}
+
+// cachedCredentials is the on-disk form of temporary credentials
+type cachedCredentials struct {
+	AccessKeyID     string    `json:"access_key_id"`
+	SecretAccessKey string    `json:"secret_access_key"`
+	SessionToken    string    `json:"session_token"`
+	Expires         time.Time `json:"expires"`
+}
+
+// fileCachedCredentials reuses credentials stored in a file until they are
+// about to expire, retrieving and storing new ones from provider otherwise
+type fileCachedCredentials struct {
+	path     string
+	provider aws.CredentialsProvider
+}
+
+// Retrieve returns cached credentials if they are still valid
+func (f *fileCachedCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	if creds, ok := f.load(); ok {
+		return creds, nil
+	}
+
+	creds, err := f.provider.Retrieve(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+
+	// Failing to cache only means the role is assumed again next time
+	if err := f.store(creds); err != nil {
+		slog.Warn("Failed to cache credentials", "error", err)
+	}
+	return creds, nil
+}
+
+// load reads credentials from the cache file
+func (f *fileCachedCredentials) load() (aws.Credentials, bool) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return aws.Credentials{}, false
+	}
+	var cached cachedCredentials
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return aws.Credentials{}, false
+	}
+	if time.Until(cached.Expires) < credentialsExpiryWindow {
+		return aws.Credentials{}, false
+	}
+	return aws.Credentials{
+		AccessKeyID:     cached.AccessKeyID,
+		SecretAccessKey: cached.SecretAccessKey,
+		SessionToken:    cached.SessionToken,
+		Source:          "tunnel-go credentials cache",
+		CanExpire:       true,
+		Expires:         cached.Expires,
+	}, true
+}
+
+// store writes credentials to the cache file, readable by the owner only
+func (f *fileCachedCredentials) store(creds aws.Credentials) error {
+	if !creds.CanExpire {
+		return nil
+	}
+	data, err := json.Marshal(cachedCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expires:         creds.Expires,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so concurrent runs never read a
+	// partially written cache
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".credentials-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,93 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+type countingProvider struct {
+	calls   int
+	expires time.Time
+}
+
+func (p *countingProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	p.calls++
+	return aws.Credentials{
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+		SessionToken:    "TOKEN",
+		CanExpire:       true,
+		Expires:         p.expires,
+	}, nil
+}
+
+func TestFileCachedCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds.json")
+	provider := &countingProvider{expires: time.Now().Add(time.Hour)}
+
+	first := &fileCachedCredentials{path: path, provider: provider}
+	if _, err := first.Retrieve(context.Background()); err != nil {
+		t.Fatalf("Retrieve() error = %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("credentials were not cached: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("cache file permissions = %o, want 600", perm)
+	}
+
+	// A second run reuses the cached credentials without assuming the role
+	second := &fileCachedCredentials{path: path, provider: provider}
+	creds, err := second.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Retrieve() error = %v", err)
+	}
+	if provider.calls != 1 {
+		t.Errorf("provider called %d times, want 1", provider.calls)
+	}
+	if creds.AccessKeyID != "AKID" || creds.SessionToken != "TOKEN" || !creds.CanExpire {
+		t.Errorf("Retrieve() = %+v, want cached credentials", creds)
+	}
+}
+
+func TestFileCachedCredentialsRefreshesExpiring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds.json")
+	provider := &countingProvider{expires: time.Now().Add(time.Minute)}
+
+	cached := &fileCachedCredentials{path: path, provider: provider}
+	for i := 0; i < 2; i++ {
+		if _, err := cached.Retrieve(context.Background()); err != nil {
+			t.Fatalf("Retrieve() error = %v", err)
+		}
+	}
+	if provider.calls != 2 {
+		t.Errorf("provider called %d times, want 2 for credentials inside the expiry window", provider.calls)
+	}
+}
+
+func TestMFATokenProviderWithoutTerminal(t *testing.T) {
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	stdin := os.Stdin
+	os.Stdin = null
+	defer func() { os.Stdin = stdin }()
+
+	if _, err := mfaTokenProvider(); !errors.Is(err, ErrNoMFAPrompt) {
+		t.Errorf("mfaTokenProvider() error = %v, want ErrNoMFAPrompt", err)
+	}
+	if !IsAuthError(fmt.Errorf("failed to refresh credentials: %w", ErrNoMFAPrompt)) {
+		t.Error("IsAuthError(ErrNoMFAPrompt) = false, want true")
+	}
+}
@@ -0,0 +1,39 @@
+package aws
+
+import (
+	"errors"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/smithy-go"
+)
+
+// authErrorCodes are the error codes AWS APIs answer with when credentials
+// are invalid or expired, or lack the permission for a request
+var authErrorCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"AuthFailure":                 true,
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"InvalidClientTokenId":        true,
+	"InvalidSignatureException":   true,
+	"MissingAuthenticationToken":  true,
+	"SignatureDoesNotMatch":       true,
+	"UnauthorizedOperation":       true,
+	"UnrecognizedClientException": true,
+}
+
+// IsAuthError reports whether err, or an error it wraps, is AWS refusing a
+// request for its credentials or permissions, a request that could not be
+// signed because there are no usable credentials, or ErrNoMFAPrompt
+func IsAuthError(err error) bool {
+	if errors.Is(err, ErrNoMFAPrompt) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && authErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	var signErr *v4.SigningError
+	return errors.As(err, &signErr)
+}
@@ -0,0 +1,391 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"tunnel-go/pkg/version"
+)
+
+// JumphostStrategy decides which of the matching instances is used as the
+// jumphost
+type JumphostStrategy string
+
+const (
+	// StrategyRandom picks any matching instance
+	StrategyRandom JumphostStrategy = "random"
+	// StrategyFirstByLaunchTime picks the instance launched first, so every
+	// run uses the same jumphost while it is up
+	StrategyFirstByLaunchTime JumphostStrategy = "first-by-launch-time"
+	// StrategySameAZ prefers instances in the availability zone of the
+	// remote hosts
+	StrategySameAZ JumphostStrategy = "same-az"
+	// StrategyLeastUsed picks the instance with the fewest active Session
+	// Manager sessions
+	StrategyLeastUsed JumphostStrategy = "least-used"
+)
+
+// JumphostStrategies lists the known strategies
+var JumphostStrategies = []JumphostStrategy{StrategyRandom, StrategyFirstByLaunchTime, StrategySameAZ, StrategyLeastUsed}
+
+// Filter is an EC2 filter matching instances whose attribute Name has one of
+// Values, which may contain * and ? wildcards. Tags are matched with names
+// like tag:Role.
+type Filter struct {
+	Name   string
+	Values []string
+}
+
+// Filters are EC2 filters an instance must all match
+type Filters []Filter
+
+// NameFilter returns the filters matching the Name tag against pattern
+func NameFilter(pattern string) Filters {
+	return Filters{{Name: "tag:Name", Values: []string{pattern}}}
+}
+
+// String formats the filters for messages, as the pattern alone if they
+// only match the Name tag
+func (f Filters) String() string {
+	if len(f) == 1 && f[0].Name == "tag:Name" && len(f[0].Values) == 1 {
+		return f[0].Values[0]
+	}
+	parts := make([]string, len(f))
+	for i, filter := range f {
+		parts[i] = filter.Name + "=" + strings.Join(filter.Values, ",")
+	}
+	return strings.Join(parts, " ")
+}
+
+// JumphostQuery describes the jumphost to look for
+type JumphostQuery struct {
+	// InstanceID selects an instance explicitly. Filters and Strategy are
+	// ignored, and the instance must be running with a usable SSM agent.
+	InstanceID string
+	// Filters select the candidates
+	Filters Filters
+	// Strategy picks one of the candidates, StrategyRandom if empty
+	Strategy JumphostStrategy
+	// Hosts are the remote hosts tunnels are opened to, used by StrategySameAZ
+	Hosts []string
+}
+
+// jumphostLookupTimeout bounds the lookups made to pick a jumphost
+const jumphostLookupTimeout = 30 * time.Second
+
+// minAgentVersion is the first SSM agent version that forwards ports to
+// remote hosts
+const minAgentVersion = "3.1.1374.0"
+
+// agentBatchSize is the most instance IDs looked up in SSM at once
+const agentBatchSize = 50
+
+// GetJumphost returns the running EC2 instance selected by query. The strategy
+// ranks the candidates, and the first one whose SSM agent is online and recent
+// enough to forward ports to remote hosts is used.
+func (c *Client) GetJumphost(query JumphostQuery) (*types.Instance, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, jumphostLookupTimeout)
+	defer cancel()
+
+	if query.InstanceID != "" {
+		instance, err := c.describeJumphost(ctx, query.InstanceID)
+		if err != nil {
+			return nil, err
+		}
+		problems, err := c.agentProblems(ctx, []types.Instance{*instance})
+		if err != nil {
+			return nil, err
+		}
+		if problem, ok := problems[query.InstanceID]; ok {
+			return nil, fmt.Errorf("jumphost %s %s", query.InstanceID, problem)
+		}
+		return instance, nil
+	}
+
+	if len(query.Filters) == 0 {
+		return nil, fmt.Errorf("no jumphost filter configured")
+	}
+	instances, err := c.findJumphosts(ctx, query.Filters)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no running instances found matching filter: %s", query.Filters)
+	}
+
+	candidates, err := c.rankJumphosts(ctx, instances, query)
+	if err != nil {
+		return nil, err
+	}
+	problems, err := c.agentProblems(ctx, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	var skipped []string
+	for i := range candidates {
+		id := aws.ToString(candidates[i].InstanceId)
+		if problem, ok := problems[id]; ok {
+			c.log.Warn("Skipping jumphost", "instance", id, "reason", problem)
+			skipped = append(skipped, id+" "+problem)
+			continue
+		}
+		return &candidates[i], nil
+	}
+	return nil, fmt.Errorf("no usable jumphost matching filter %s: %s", query.Filters, strings.Join(skipped, "; "))
+}
+
+// JumphostProblem returns why the instance with the given ID can no longer
+// be used as a jumphost, or "" if it is running and its SSM agent is online
+// and recent enough to forward ports to remote hosts
+func (c *Client) JumphostProblem(instanceID string) (string, error) {
+	running, err := c.IsInstanceRunning(instanceID)
+	if err != nil {
+		return "", err
+	}
+	if !running {
+		return "is not running", nil
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, jumphostLookupTimeout)
+	defer cancel()
+	problems, err := c.agentProblems(ctx, []types.Instance{{InstanceId: aws.String(instanceID)}})
+	if err != nil {
+		return "", err
+	}
+	return problems[instanceID], nil
+}
+
+// rankJumphosts orders instances by preference according to the strategy of
+// query
+func (c *Client) rankJumphosts(ctx context.Context, instances []types.Instance, query JumphostQuery) ([]types.Instance, error) {
+	switch query.Strategy {
+	case StrategyRandom, "":
+		shuffle(instances)
+		return instances, nil
+	case StrategyFirstByLaunchTime:
+		return byLaunchTime(instances), nil
+	case StrategySameAZ:
+		return c.sameAZ(ctx, instances, query.Hosts), nil
+	case StrategyLeastUsed:
+		return c.leastUsed(ctx, instances)
+	default:
+		return nil, fmt.Errorf("unknown jumphost strategy %q", query.Strategy)
+	}
+}
+
+// describeJumphost returns the instance with the given ID if it is running
+func (c *Client) describeJumphost(ctx context.Context, instanceID string) (*types.Instance, error) {
+	output, err := c.EC2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("instance-id"), Values: []string{instanceID}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instance %s: %w", instanceID, err)
+	}
+	for _, reservation := range output.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.State != nil && instance.State.Name == types.InstanceStateNameRunning {
+				return &instance, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("jumphost %s is not running", instanceID)
+}
+
+// findJumphosts returns the running instances matching filters
+func (c *Client) findJumphosts(ctx context.Context, filters Filters) ([]types.Instance, error) {
+	input := &ec2.DescribeInstancesInput{}
+	for _, filter := range filters {
+		input.Filters = append(input.Filters, types.Filter{Name: aws.String(filter.Name), Values: filter.Values})
+	}
+	input.Filters = append(input.Filters, types.Filter{Name: aws.String("instance-state-name"), Values: []string{"running"}})
+
+	var instances []types.Instance
+	paginator := ec2.NewDescribeInstancesPaginator(c.EC2, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %w", err)
+		}
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.State != nil && instance.State.Name == types.InstanceStateNameRunning {
+					instances = append(instances, instance)
+				}
+			}
+		}
+	}
+	return instances, nil
+}
+
+// shuffle puts instances in random order
+func shuffle(instances []types.Instance) {
+	rand.Shuffle(len(instances), func(i, j int) { instances[i], instances[j] = instances[j], instances[i] })
+}
+
+// byLaunchTime sorts instances by launch time, breaking ties by ID
+func byLaunchTime(instances []types.Instance) []types.Instance {
+	sort.SliceStable(instances, func(i, j int) bool {
+		a, b := aws.ToTime(instances[i].LaunchTime), aws.ToTime(instances[j].LaunchTime)
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return aws.ToString(instances[i].InstanceId) < aws.ToString(instances[j].InstanceId)
+	})
+	return instances
+}
+
+// sameAZ puts the instances in the availability zone holding most of hosts
+// first, each group in random order. If none is there or the zone cannot be
+// found, all instances are in random order.
+func (c *Client) sameAZ(ctx context.Context, instances []types.Instance, hosts []string) []types.Instance {
+	zone, err := c.hostsZone(ctx, hosts)
+	if err != nil {
+		c.log.Debug("Could not find availability zone of remote hosts", "error", err)
+	}
+
+	shuffle(instances)
+	inZone := func(i int) bool {
+		return zone != "" && instances[i].Placement != nil && aws.ToString(instances[i].Placement.AvailabilityZone) == zone
+	}
+	sort.SliceStable(instances, func(i, j int) bool { return inZone(i) && !inZone(j) })
+	if !inZone(0) {
+		c.log.Debug("No jumphost in the availability zone of the remote hosts, picking any", "zone", zone)
+	} else {
+		c.log.Debug("Picking jumphost in the availability zone of the remote hosts", "zone", zone)
+	}
+	return instances
+}
+
+// hostsZone returns the availability zone most of hosts are in. Hosts are
+// resolved to IP addresses, which are located through the network interfaces
+// of the account.
+func (c *Client) hostsZone(ctx context.Context, hosts []string) (string, error) {
+	var ips []string
+	for _, host := range hosts {
+		if net.ParseIP(host) != nil {
+			ips = append(ips, host)
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			c.log.Debug("Failed to resolve remote host", "host", host, "error", err)
+			continue
+		}
+		ips = append(ips, addrs...)
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no remote host could be resolved")
+	}
+
+	output, err := c.EC2.DescribeNetworkInterfaces(ctx, &ec2.DescribeNetworkInterfacesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("addresses.private-ip-address"), Values: ips},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe network interfaces: %w", err)
+	}
+
+	votes := make(map[string]int)
+	for _, iface := range output.NetworkInterfaces {
+		if zone := aws.ToString(iface.AvailabilityZone); zone != "" {
+			votes[zone]++
+		}
+	}
+	var zone string
+	for z, n := range votes {
+		if n > votes[zone] || (n == votes[zone] && z < zone) {
+			zone = z
+		}
+	}
+	if zone == "" {
+		return "", fmt.Errorf("no network interface found for %v", ips)
+	}
+	return zone, nil
+}
+
+// leastUsed orders instances by their number of active sessions, breaking
+// ties at random
+func (c *Client) leastUsed(ctx context.Context, instances []types.Instance) ([]types.Instance, error) {
+	counts := make(map[string]int)
+	paginator := ssm.NewDescribeSessionsPaginator(c.SSM, &ssm.DescribeSessionsInput{
+		State: ssmtypes.SessionStateActive,
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe sessions: %w", err)
+		}
+		for _, s := range output.Sessions {
+			counts[aws.ToString(s.Target)]++
+		}
+	}
+
+	shuffle(instances)
+	sort.SliceStable(instances, func(i, j int) bool {
+		return counts[aws.ToString(instances[i].InstanceId)] < counts[aws.ToString(instances[j].InstanceId)]
+	})
+	c.log.Debug("Ranked jumphosts by active sessions", "instance", aws.ToString(instances[0].InstanceId), "sessions", counts[aws.ToString(instances[0].InstanceId)])
+	return instances, nil
+}
+
+// agentProblems looks up the SSM agents of instances and returns why each
+// unusable one cannot be used as a jumphost, by instance ID. An instance is
+// usable if its agent is online and supports port forwarding to remote hosts.
+func (c *Client) agentProblems(ctx context.Context, instances []types.Instance) (map[string]string, error) {
+	agents := make(map[string]ssmtypes.InstanceInformation)
+	for start := 0; start < len(instances); start += agentBatchSize {
+		end := start + agentBatchSize
+		if end > len(instances) {
+			end = len(instances)
+		}
+		var ids []string
+		for _, instance := range instances[start:end] {
+			ids = append(ids, aws.ToString(instance.InstanceId))
+		}
+
+		paginator := ssm.NewDescribeInstanceInformationPaginator(c.SSM, &ssm.DescribeInstanceInformationInput{
+			Filters: []ssmtypes.InstanceInformationStringFilter{
+				{Key: aws.String("InstanceIds"), Values: ids},
+			},
+		})
+		for paginator.HasMorePages() {
+			output, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe SSM managed instances: %w", err)
+			}
+			for _, info := range output.InstanceInformationList {
+				agents[aws.ToString(info.InstanceId)] = info
+			}
+		}
+	}
+
+	problems := make(map[string]string)
+	for _, instance := range instances {
+		id := aws.ToString(instance.InstanceId)
+		info, ok := agents[id]
+		switch {
+		case !ok:
+			problems[id] = "is not managed by SSM"
+		case info.PingStatus != ssmtypes.PingStatusOnline:
+			problems[id] = fmt.Sprintf("has SSM agent status %s", info.PingStatus)
+		case version.Compare(aws.ToString(info.AgentVersion), minAgentVersion) < 0:
+			problems[id] = fmt.Sprintf("runs SSM agent %s, port forwarding to remote hosts needs %s or later", aws.ToString(info.AgentVersion), minAgentVersion)
+		}
+	}
+	return problems, nil
+}
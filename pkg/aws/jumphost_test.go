@@ -0,0 +1,258 @@
+package aws
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// jumphost returns a running instance launched at launched in zone
+func jumphost(id, zone string, launched time.Time) ec2types.Instance {
+	i := instance(id, ec2types.InstanceStateNameRunning)
+	i.LaunchTime = aws.Time(launched)
+	i.Placement = &ec2types.Placement{AvailabilityZone: aws.String(zone)}
+	return i
+}
+
+// agent returns the SSM information of an instance
+func agent(id string, status ssmtypes.PingStatus, version string) ssmtypes.InstanceInformation {
+	return ssmtypes.InstanceInformation{InstanceId: aws.String(id), PingStatus: status, AgentVersion: aws.String(version)}
+}
+
+func TestGetJumphostStrategies(t *testing.T) {
+	now := time.Now()
+	instances := []ec2types.Instance{
+		jumphost("i-new", "eu-central-1a", now),
+		jumphost("i-old", "eu-central-1b", now.Add(-time.Hour)),
+		jumphost("i-mid", "eu-central-1c", now.Add(-time.Minute)),
+	}
+
+	tests := []struct {
+		name     string
+		query    JumphostQuery
+		sessions []ssmtypes.Session
+		ifaces   []ec2types.NetworkInterface
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:  "FirstByLaunchTime",
+			query: JumphostQuery{Strategy: StrategyFirstByLaunchTime},
+			want:  "i-old",
+		},
+		{
+			name:  "SameAZ",
+			query: JumphostQuery{Strategy: StrategySameAZ, Hosts: []string{"10.0.3.10", "10.0.3.11", "10.0.1.10"}},
+			ifaces: []ec2types.NetworkInterface{
+				{AvailabilityZone: aws.String("eu-central-1c")},
+				{AvailabilityZone: aws.String("eu-central-1c")},
+				{AvailabilityZone: aws.String("eu-central-1a")},
+			},
+			want: "i-mid",
+		},
+		{
+			name:  "LeastUsed",
+			query: JumphostQuery{Strategy: StrategyLeastUsed},
+			sessions: []ssmtypes.Session{
+				{Target: aws.String("i-new")},
+				{Target: aws.String("i-new")},
+				{Target: aws.String("i-old")},
+				{Target: aws.String("i-old")},
+				{Target: aws.String("i-mid")},
+				{Target: aws.String("i-other")},
+			},
+			want: "i-mid",
+		},
+		{
+			name:    "Unknown",
+			query:   JumphostQuery{Strategy: "fastest"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockEC2 := &mockEC2Client{
+				describeInstancesOutput: &ec2.DescribeInstancesOutput{
+					Reservations: []ec2types.Reservation{{Instances: append([]ec2types.Instance(nil), instances...)}},
+				},
+				networkInterfaces: tt.ifaces,
+			}
+			client := NewClientWithAPIs(&mockSSMClient{sessions: tt.sessions}, mockEC2, "eu-central-1", nil)
+
+			tt.query.Filters = NameFilter("dev-jumphost")
+			got, err := client.GetJumphost(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetJumphost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && aws.ToString(got.InstanceId) != tt.want {
+				t.Errorf("GetJumphost() = %s, want %s", aws.ToString(got.InstanceId), tt.want)
+			}
+		})
+	}
+}
+
+func TestGetJumphostSameAZFallsBack(t *testing.T) {
+	mockEC2 := &mockEC2Client{
+		describeInstancesOutput: &ec2.DescribeInstancesOutput{
+			Reservations: []ec2types.Reservation{{Instances: []ec2types.Instance{
+				jumphost("i-1", "eu-central-1a", time.Now()),
+			}}},
+		},
+		networkInterfaces: []ec2types.NetworkInterface{{AvailabilityZone: aws.String("eu-central-1b")}},
+	}
+	client := NewClientWithAPIs(&mockSSMClient{}, mockEC2, "eu-central-1", nil)
+
+	got, err := client.GetJumphost(JumphostQuery{Filters: NameFilter("dev-jumphost"), Strategy: StrategySameAZ, Hosts: []string{"10.0.2.10"}})
+	if err != nil {
+		t.Fatalf("GetJumphost() error = %v", err)
+	}
+	if aws.ToString(got.InstanceId) != "i-1" {
+		t.Errorf("GetJumphost() = %s, want i-1 from another zone", aws.ToString(got.InstanceId))
+	}
+}
+
+func TestGetJumphostByInstanceID(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   ec2types.InstanceStateName
+		agents  map[string]ssmtypes.InstanceInformation
+		wantErr bool
+	}{
+		{name: "Running", state: ec2types.InstanceStateNameRunning},
+		{name: "Stopped", state: ec2types.InstanceStateNameStopped, wantErr: true},
+		{
+			name:    "AgentOffline",
+			state:   ec2types.InstanceStateNameRunning,
+			agents:  map[string]ssmtypes.InstanceInformation{"i-123": agent("i-123", ssmtypes.PingStatusConnectionLost, minAgentVersion)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockEC2 := &mockEC2Client{
+				describeInstancesOutput: &ec2.DescribeInstancesOutput{
+					Reservations: []ec2types.Reservation{{Instances: []ec2types.Instance{instance("i-123", tt.state)}}},
+				},
+			}
+			client := NewClientWithAPIs(&mockSSMClient{agents: tt.agents}, mockEC2, "eu-central-1", nil)
+
+			got, err := client.GetJumphost(JumphostQuery{InstanceID: "i-123", Filters: NameFilter("ignored")})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetJumphost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if f := mockEC2.input.Filters[0]; aws.ToString(f.Name) != "instance-id" || f.Values[0] != "i-123" {
+				t.Errorf("GetJumphost() filtered on %s=%v, want instance-id=i-123", aws.ToString(f.Name), f.Values)
+			}
+			if !tt.wantErr && aws.ToString(got.InstanceId) != "i-123" {
+				t.Errorf("GetJumphost() = %s, want i-123", aws.ToString(got.InstanceId))
+			}
+		})
+	}
+}
+
+func TestGetJumphostSkipsUnusableAgents(t *testing.T) {
+	now := time.Now()
+	mockEC2 := &mockEC2Client{
+		describeInstancesOutput: &ec2.DescribeInstancesOutput{
+			Reservations: []ec2types.Reservation{{Instances: []ec2types.Instance{
+				jumphost("i-lost", "eu-central-1a", now.Add(-3*time.Hour)),
+				jumphost("i-old-agent", "eu-central-1a", now.Add(-2*time.Hour)),
+				jumphost("i-unmanaged", "eu-central-1a", now.Add(-time.Hour)),
+				jumphost("i-ok", "eu-central-1a", now),
+			}}},
+		},
+	}
+	agents := map[string]ssmtypes.InstanceInformation{
+		"i-lost":      agent("i-lost", ssmtypes.PingStatusConnectionLost, "3.2.582.0"),
+		"i-old-agent": agent("i-old-agent", ssmtypes.PingStatusOnline, "3.0.1124.0"),
+		"i-ok":        agent("i-ok", ssmtypes.PingStatusOnline, "3.1.1374.0"),
+	}
+	client := NewClientWithAPIs(&mockSSMClient{agents: agents}, mockEC2, "eu-central-1", nil)
+	query := JumphostQuery{Filters: NameFilter("dev-jumphost"), Strategy: StrategyFirstByLaunchTime}
+
+	got, err := client.GetJumphost(query)
+	if err != nil {
+		t.Fatalf("GetJumphost() error = %v", err)
+	}
+	if aws.ToString(got.InstanceId) != "i-ok" {
+		t.Errorf("GetJumphost() = %s, want i-ok, the oldest usable instance", aws.ToString(got.InstanceId))
+	}
+
+	delete(agents, "i-ok")
+	_, err = client.GetJumphost(query)
+	want := "no usable jumphost matching filter dev-jumphost: " +
+		"i-lost has SSM agent status ConnectionLost; " +
+		"i-old-agent runs SSM agent 3.0.1124.0, port forwarding to remote hosts needs 3.1.1374.0 or later; " +
+		"i-unmanaged is not managed by SSM; " +
+		"i-ok is not managed by SSM"
+	if err == nil || err.Error() != want {
+		t.Errorf("GetJumphost() error = %v, want %s", err, want)
+	}
+}
+
+func TestJumphostProblem(t *testing.T) {
+	mockEC2 := &mockEC2Client{
+		describeInstancesOutput: &ec2.DescribeInstancesOutput{
+			Reservations: []ec2types.Reservation{{Instances: []ec2types.Instance{jumphost("i-1", "eu-central-1a", time.Now())}}},
+		},
+	}
+	agents := map[string]ssmtypes.InstanceInformation{
+		"i-1": agent("i-1", ssmtypes.PingStatusOnline, "3.1.1374.0"),
+	}
+	client := NewClientWithAPIs(&mockSSMClient{agents: agents}, mockEC2, "eu-central-1", nil)
+
+	if problem, err := client.JumphostProblem("i-1"); err != nil || problem != "" {
+		t.Errorf("JumphostProblem() = %q, %v, want no problem", problem, err)
+	}
+
+	// A running instance whose agent went offline is no longer usable
+	agents["i-1"] = agent("i-1", ssmtypes.PingStatusConnectionLost, "3.1.1374.0")
+	if problem, err := client.JumphostProblem("i-1"); err != nil || problem != "has SSM agent status ConnectionLost" {
+		t.Errorf("JumphostProblem() = %q, %v, want the agent status", problem, err)
+	}
+
+	mockEC2.describeInstancesOutput = &ec2.DescribeInstancesOutput{}
+	if problem, err := client.JumphostProblem("i-1"); err != nil || problem != "is not running" {
+		t.Errorf("JumphostProblem() = %q, %v, want not running", problem, err)
+	}
+}
+
+func TestGetJumphostFilters(t *testing.T) {
+	mockEC2 := &mockEC2Client{
+		describeInstancesOutput: &ec2.DescribeInstancesOutput{
+			Reservations: []ec2types.Reservation{{Instances: []ec2types.Instance{jumphost("i-1", "eu-central-1a", time.Now())}}},
+		},
+	}
+	client := NewClientWithAPIs(&mockSSMClient{}, mockEC2, "eu-central-1", nil)
+
+	filters := Filters{
+		{Name: "tag:Role", Values: []string{"bastion"}},
+		{Name: "vpc-id", Values: []string{"vpc-1", "vpc-2"}},
+	}
+	if _, err := client.GetJumphost(JumphostQuery{Filters: filters}); err != nil {
+		t.Fatalf("GetJumphost() error = %v", err)
+	}
+	want := []string{"tag:Role=[bastion]", "vpc-id=[vpc-1 vpc-2]", "instance-state-name=[running]"}
+	if len(mockEC2.input.Filters) != len(want) {
+		t.Fatalf("GetJumphost() sent %d filters, want %v", len(mockEC2.input.Filters), want)
+	}
+	for i, f := range mockEC2.input.Filters {
+		if got := fmt.Sprintf("%s=%v", aws.ToString(f.Name), f.Values); got != want[i] {
+			t.Errorf("filter %d = %s, want %s", i, got, want[i])
+		}
+	}
+	if got := filters.String(); got != "tag:Role=bastion vpc-id=vpc-1,vpc-2" {
+		t.Errorf("String() = %s", got)
+	}
+
+	if _, err := client.GetJumphost(JumphostQuery{}); err == nil {
+		t.Error("GetJumphost() without filters error = nil, want an error")
+	}
+}
@@ -0,0 +1,308 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	awsclient "tunnel-go/pkg/aws"
+)
+
+// ParameterStore looks up SSM parameters
+type ParameterStore interface {
+	GetParameter(name string) (string, error)
+	GetParametersByPath(paths []string) ([]ssmtypes.Parameter, error)
+	// GetParameters returns the values of the named parameters and, apart,
+	// the names that do not exist
+	GetParameters(names []string) (map[string]string, []string, error)
+}
+
+// InstanceFinder discovers jumphost instances
+type InstanceFinder interface {
+	GetJumphost(query awsclient.JumphostQuery) (*types.Instance, error)
+	JumphostProblem(instanceID string) (string, error)
+}
+
+// NamespaceFunc returns the namespace lookups are cached under. It is only
+// called once a lookup is made, as finding the account may take a call to
+// AWS.
+type NamespaceFunc func() (string, error)
+
+// Namespace identifies the AWS account, region and environment lookups are
+// cached for, so entries are never shared between them. accountID is called
+// each time the namespace is needed and should remember its result.
+func Namespace(region string, accountID func() (string, error), env string) NamespaceFunc {
+	return func() (string, error) {
+		id, err := accountID()
+		if err != nil {
+			return "", fmt.Errorf("failed to determine AWS account: %w", err)
+		}
+		return strings.Join([]string{region, id, env}, "/"), nil
+	}
+}
+
+func parameterKey(namespace, name string) string {
+	return namespace + "|parameter|" + name
+}
+
+// jumphostKey identifies a jumphost lookup by everything that affects the
+// instance picked
+func jumphostKey(namespace string, query awsclient.JumphostQuery) string {
+	key := namespace + "|jumphost|" + query.Filters.String()
+	if query.Strategy != "" && query.Strategy != awsclient.StrategyRandom {
+		key += "|" + string(query.Strategy)
+	}
+	if query.Strategy == awsclient.StrategySameAZ {
+		key += "|" + strings.Join(query.Hosts, ",")
+	}
+	return key
+}
+
+// AccountID returns the account ID cached for identity, a description of
+// the credentials in use, calling fetch if it is not cached
+func (c *Cache) AccountID(identity string, fetch func() (string, error)) (string, error) {
+	return c.Get("account|"+identity, DefaultAccountTTL, fetch)
+}
+
+// Parameters caches the lookups of next under namespace
+func (c *Cache) Parameters(namespace NamespaceFunc, next ParameterStore) *Parameters {
+	return &Parameters{cache: c, namespace: namespace, next: next}
+}
+
+// Parameters is a ParameterStore backed by the cache
+type Parameters struct {
+	cache     *Cache
+	namespace NamespaceFunc
+	next      ParameterStore
+}
+
+// GetParameter returns a cached parameter value
+func (p *Parameters) GetParameter(name string) (string, error) {
+	ns, err := p.namespace()
+	if err != nil {
+		return "", err
+	}
+	return p.cache.Get(parameterKey(ns, name), p.cache.opts.ParameterTTL, func() (string, error) {
+		return p.next.GetParameter(name)
+	})
+}
+
+// GetParametersByPath returns the cached parameters among paths, looking up
+// the ones that are not cached in a single call
+func (p *Parameters) GetParametersByPath(paths []string) ([]ssmtypes.Parameter, error) {
+	ns, err := p.namespace()
+	if err != nil {
+		return nil, err
+	}
+	var parameters []ssmtypes.Parameter
+	var missing []string
+	for _, name := range paths {
+		if value, ok := p.cache.lookup(parameterKey(ns, name), false); ok {
+			parameters = append(parameters, parameter(name, value))
+			continue
+		}
+		missing = append(missing, name)
+	}
+	if len(missing) == 0 {
+		return parameters, nil
+	}
+
+	fetched, err := p.next.GetParametersByPath(missing)
+	if err != nil {
+		if !p.cache.opts.Offline {
+			// The store fails when none of the missing names exist, which is
+			// not an error if some were cached
+			if len(parameters) > 0 {
+				return parameters, nil
+			}
+			return nil, err
+		}
+
+		// Offline, fall back to expired entries for the missing names
+		for _, name := range missing {
+			if value, ok := p.cache.lookup(parameterKey(ns, name), true); ok {
+				parameters = append(parameters, parameter(name, value))
+			}
+		}
+		if len(parameters) == 0 {
+			return nil, err
+		}
+		slog.Warn("Using cached parameters", "error", err)
+		return parameters, nil
+	}
+
+	entries := make(map[string]string, len(fetched))
+	for _, param := range fetched {
+		if param.Name != nil && param.Value != nil {
+			entries[parameterKey(ns, *param.Name)] = *param.Value
+		}
+	}
+	p.cache.putAll(entries, p.cache.opts.ParameterTTL)
+	return append(parameters, fetched...), nil
+}
+
+// GetParameters returns the cached values among names, looking up the ones
+// that are not cached in a single call. Names that do not exist are not
+// cached, so they are looked up again next time.
+func (p *Parameters) GetParameters(names []string) (map[string]string, []string, error) {
+	ns, err := p.namespace()
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make(map[string]string, len(names))
+	var missing []string
+	for _, name := range names {
+		if value, ok := p.cache.lookup(parameterKey(ns, name), false); ok {
+			values[name] = value
+			continue
+		}
+		missing = append(missing, name)
+	}
+	if len(missing) == 0 {
+		return values, nil, nil
+	}
+
+	fetched, invalid, err := p.next.GetParameters(missing)
+	if err != nil {
+		if !p.cache.opts.Offline {
+			return nil, nil, err
+		}
+
+		// Offline, fall back to expired entries for the missing names
+		for _, name := range missing {
+			value, ok := p.cache.lookup(parameterKey(ns, name), true)
+			if !ok {
+				return nil, nil, err
+			}
+			values[name] = value
+		}
+		slog.Warn("Using cached parameters", "error", err)
+		return values, nil, nil
+	}
+
+	entries := make(map[string]string, len(fetched))
+	for name, value := range fetched {
+		entries[parameterKey(ns, name)] = value
+		values[name] = value
+	}
+	p.cache.putAll(entries, p.cache.opts.ParameterTTL)
+	return values, invalid, nil
+}
+
+func parameter(name, value string) ssmtypes.Parameter {
+	return ssmtypes.Parameter{Name: aws.String(name), Value: aws.String(value)}
+}
+
+// cachedInstance is the part of an instance kept in the cache
+type cachedInstance struct {
+	ID   string            `json:"id"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// Instances caches the jumphost lookups of next under namespace
+func (c *Cache) Instances(namespace NamespaceFunc, next InstanceFinder) *Instances {
+	return &Instances{cache: c, namespace: namespace, next: next}
+}
+
+// Instances is an InstanceFinder backed by the cache. Only jumphost lookups
+// are cached; whether an instance can still be used is always checked with AWS.
+type Instances struct {
+	cache     *Cache
+	namespace NamespaceFunc
+	next      InstanceFinder
+}
+
+// GetJumphost returns the jumphost cached for query, after checking that it
+// can still be used. Jumphosts selected by instance ID are always looked up,
+// to check that they are running, and so are least used ones, since the
+// number of sessions on each jumphost changes with every session started.
+func (i *Instances) GetJumphost(query awsclient.JumphostQuery) (*types.Instance, error) {
+	if query.InstanceID != "" || query.Strategy == awsclient.StrategyLeastUsed {
+		return i.next.GetJumphost(query)
+	}
+
+	ns, err := i.namespace()
+	if err != nil {
+		return nil, err
+	}
+	key := jumphostKey(ns, query)
+	if value, ok := i.cache.lookup(key, false); ok {
+		if instance, err := decodeInstance(value); err == nil && i.usable(instance) {
+			return instance, nil
+		}
+	}
+
+	value, err := i.cache.Get(key, i.cache.opts.JumphostTTL, func() (string, error) {
+		instance, err := i.next.GetJumphost(query)
+		if err != nil {
+			return "", err
+		}
+		cached := cachedInstance{ID: aws.ToString(instance.InstanceId), Tags: make(map[string]string)}
+		for _, tag := range instance.Tags {
+			cached.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+		data, err := json.Marshal(cached)
+		return string(data), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodeInstance(value)
+}
+
+// usable checks a cached jumphost with AWS, dropping it from the cache if
+// it can no longer be used. A jumphost that cannot be checked is used.
+func (i *Instances) usable(instance *types.Instance) bool {
+	id := aws.ToString(instance.InstanceId)
+	problem, err := i.JumphostProblem(id)
+	if err != nil {
+		slog.Debug("Failed to check cached jumphost", "instance", id, "error", err)
+		return true
+	}
+	if problem != "" {
+		slog.Warn("Cached jumphost is no longer usable, looking up another", "instance", id, "reason", problem)
+		return false
+	}
+	return true
+}
+
+// decodeInstance returns the instance cached as value
+func decodeInstance(value string) (*types.Instance, error) {
+	var cached cachedInstance
+	if err := json.Unmarshal([]byte(value), &cached); err != nil {
+		return nil, fmt.Errorf("invalid cached jumphost: %w", err)
+	}
+	instance := &types.Instance{
+		InstanceId: aws.String(cached.ID),
+		State:      &types.InstanceState{Name: types.InstanceStateNameRunning},
+	}
+	for key, value := range cached.Tags {
+		instance.Tags = append(instance.Tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return instance, nil
+}
+
+// JumphostProblem checks the instance with AWS. Cached lookups returning an
+// instance that can no longer be used are dropped.
+func (i *Instances) JumphostProblem(instanceID string) (string, error) {
+	problem, err := i.next.JumphostProblem(instanceID)
+	if err != nil || problem == "" {
+		return problem, err
+	}
+	if ns, err := i.namespace(); err == nil {
+		prefix := ns + "|jumphost|"
+		i.cache.Delete(func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			var cached cachedInstance
+			return json.Unmarshal([]byte(value), &cached) == nil && cached.ID == instanceID
+		})
+	}
+	return problem, nil
+}
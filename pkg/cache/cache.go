@@ -0,0 +1,249 @@
+// Package cache keeps resolved SSM parameters, jumphost lookups and account
+// IDs on disk so repeated runs do not query AWS for values that rarely change.
+//
+// Entries expire after a per-entry TTL. In offline mode expired entries are
+// still used when refreshing them fails, and in refresh mode cached entries
+// are ignored and replaced.
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnel-go/pkg/filelock"
+)
+
+// Default TTLs, used when the configuration does not set them
+const (
+	DefaultParameterTTL = time.Hour
+	DefaultJumphostTTL  = 5 * time.Minute
+	DefaultAccountTTL   = 24 * time.Hour
+)
+
+// Options control how cached entries are used
+type Options struct {
+	ParameterTTL time.Duration
+	JumphostTTL  time.Duration
+	// Offline uses expired entries when AWS cannot be reached
+	Offline bool
+	// Refresh ignores cached entries, replacing them with fresh lookups
+	Refresh bool
+}
+
+// entry is a cached value
+type entry struct {
+	Value     string    `json:"value"`
+	FetchedAt time.Time `json:"fetched_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Cache is an on-disk cache of string values. It is safe for concurrent use.
+type Cache struct {
+	path string
+	opts Options
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+// DefaultPath returns the cache file used when cachefile-location is not set
+func DefaultPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".tunnel-go", "cache.json"), nil
+}
+
+// Open loads the cache stored at path. A missing file gives an empty cache,
+// and so does an unreadable one, since its entries can be looked up again.
+func Open(path string, opts Options) (*Cache, error) {
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find home directory: %w", err)
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	if opts.ParameterTTL <= 0 {
+		opts.ParameterTTL = DefaultParameterTTL
+	}
+	if opts.JumphostTTL <= 0 {
+		opts.JumphostTTL = DefaultJumphostTTL
+	}
+
+	c := &Cache{path: path, opts: opts, entries: make(map[string]entry)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		slog.Warn("Ignoring corrupt cache", "path", path, "error", err)
+		c.entries = make(map[string]entry)
+	}
+	return c, nil
+}
+
+// Path returns the cache file location
+func (c *Cache) Path() string {
+	return c.path
+}
+
+// Get returns the value cached under key, calling fetch and caching its
+// result for ttl if there is no fresh entry
+func (c *Cache) Get(key string, ttl time.Duration, fetch func() (string, error)) (string, error) {
+	c.mu.Lock()
+	cached, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if ok && !c.opts.Refresh && time.Now().Before(cached.ExpiresAt) {
+		return cached.Value, nil
+	}
+
+	value, err := fetch()
+	if err != nil {
+		if ok && c.opts.Offline {
+			slog.Warn("Using cached value", "key", key, "fetched_at", cached.FetchedAt.Format(time.RFC3339), "error", err)
+			return cached.Value, nil
+		}
+		return "", err
+	}
+
+	c.Put(key, value, ttl)
+	return value, nil
+}
+
+// lookup returns the value cached under key if it has not expired, or also
+// if it has when stale is set. Nothing is returned in refresh mode.
+func (c *Cache) lookup(key string, stale bool) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[key]
+	if !ok || c.opts.Refresh {
+		return "", false
+	}
+	if stale || time.Now().Before(cached.ExpiresAt) {
+		return cached.Value, true
+	}
+	return "", false
+}
+
+// Put caches value under key for ttl and writes the cache to disk. Failing
+// to write is logged, since the value is still cached in memory.
+func (c *Cache) Put(key, value string, ttl time.Duration) {
+	c.putAll(map[string]string{key: value}, ttl)
+}
+
+// putAll caches several values for ttl, writing the cache to disk once
+func (c *Cache) putAll(values map[string]string, ttl time.Duration) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.update(func(entries map[string]entry) {
+		for key, value := range values {
+			entries[key] = entry{Value: value, FetchedAt: now, ExpiresAt: now.Add(ttl)}
+		}
+	})
+	if err != nil {
+		slog.Warn("Failed to write cache", "path", c.path, "error", err)
+	}
+}
+
+// Delete removes the entries for which match returns true
+func (c *Cache) Delete(match func(key, value string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deleted := false
+	for key, e := range c.entries {
+		if match(key, e.Value) {
+			deleted = true
+			break
+		}
+	}
+	if !deleted {
+		return
+	}
+	err := c.update(func(entries map[string]entry) {
+		for key, e := range entries {
+			if match(key, e.Value) {
+				delete(entries, key)
+			}
+		}
+	})
+	if err != nil {
+		slog.Warn("Failed to write cache", "path", c.path, "error", err)
+	}
+}
+
+// update applies change to the cache in memory and on disk. Other tunnel-go
+// processes write the same file, so while holding its lock file the file is
+// read again, change is applied to what it holds and the result written
+// back; entries other processes fetched more recently are picked up in
+// memory too. Callers hold mu.
+func (c *Cache) update(change func(entries map[string]entry)) error {
+	change(c.entries)
+
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	lock, err := filelock.Acquire(c.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	entries := make(map[string]entry)
+	data, err := os.ReadFile(c.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && json.Unmarshal(data, &entries) != nil {
+		// A corrupt file is replaced, as its entries can be looked up again
+		entries = make(map[string]entry)
+	}
+	change(entries)
+
+	for key, e := range entries {
+		if cur, ok := c.entries[key]; !ok || e.FetchedAt.After(cur.FetchedAt) {
+			c.entries[key] = e
+		}
+	}
+	return save(c.path, entries)
+}
+
+// save writes entries to path atomically. The file is readable by the owner
+// only, as parameters may be decrypted SecureString values.
+func save(path string, entries map[string]entry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, ".cache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
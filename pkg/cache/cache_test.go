@@ -0,0 +1,448 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	awsclient "tunnel-go/pkg/aws"
+)
+
+var errUnreachable = errors.New("AWS unreachable")
+
+func openCache(t *testing.T, path string, opts Options) *Cache {
+	t.Helper()
+	c, err := Open(path, opts)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	return c
+}
+
+// account returns an account ID lookup that always finds id
+func account(id string) func() (string, error) {
+	return func() (string, error) { return id, nil }
+}
+
+// counter returns a fetch function returning value and counting its calls
+func counter(value string, err error) (func() (string, error), *int) {
+	calls := 0
+	return func() (string, error) {
+		calls++
+		return value, err
+	}, &calls
+}
+
+func TestGet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	c := openCache(t, path, Options{})
+
+	fetch, calls := counter("db.internal", nil)
+	for i := 0; i < 2; i++ {
+		value, err := c.Get("key", time.Hour, fetch)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if value != "db.internal" {
+			t.Errorf("Get() = %q, want db.internal", value)
+		}
+	}
+	if *calls != 1 {
+		t.Errorf("fetch called %d times, want 1", *calls)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("cache was not written: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("cache file permissions = %o, want 600", perm)
+	}
+
+	// A later run reads the entry from disk
+	reopened := openCache(t, path, Options{})
+	if _, err := reopened.Get("key", time.Hour, fetch); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("fetch called %d times after reopening, want 1", *calls)
+	}
+}
+
+func TestConcurrentCachesKeepEachOthersEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	// Two processes open the cache before either has written to it
+	first := openCache(t, path, Options{})
+	second := openCache(t, path, Options{})
+
+	first.Put("first", "1", time.Hour)
+	second.Put("second", "2", time.Hour)
+
+	reopened := openCache(t, path, Options{})
+	for key, want := range map[string]string{"first": "1", "second": "2"} {
+		if got, ok := reopened.lookup(key, false); !ok || got != want {
+			t.Errorf("lookup(%q) = %q, %v, want %q", key, got, ok, want)
+		}
+	}
+	// Writing picks up what the other process cached
+	if got, ok := second.lookup("first", false); !ok || got != "1" {
+		t.Errorf("lookup(first) in the second cache = %q, %v, want 1", got, ok)
+	}
+}
+
+func TestGetExpired(t *testing.T) {
+	c := openCache(t, filepath.Join(t.TempDir(), "cache.json"), Options{})
+	c.Put("key", "old", -time.Second)
+
+	fetch, calls := counter("new", nil)
+	value, err := c.Get("key", time.Hour, fetch)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if value != "new" || *calls != 1 {
+		t.Errorf("Get() = %q after %d fetches, want new after 1", value, *calls)
+	}
+}
+
+func TestGetRefresh(t *testing.T) {
+	c := openCache(t, filepath.Join(t.TempDir(), "cache.json"), Options{Refresh: true})
+	c.Put("key", "old", time.Hour)
+
+	fetch, _ := counter("new", nil)
+	value, err := c.Get("key", time.Hour, fetch)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if value != "new" {
+		t.Errorf("Get() = %q, want new", value)
+	}
+}
+
+func TestGetOffline(t *testing.T) {
+	tests := []struct {
+		name    string
+		offline bool
+		want    string
+		wantErr bool
+	}{
+		{name: "offline uses the expired entry", offline: true, want: "old"},
+		{name: "online fails", offline: false, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := openCache(t, filepath.Join(t.TempDir(), "cache.json"), Options{Offline: tt.offline})
+			c.Put("key", "old", -time.Second)
+
+			fetch, _ := counter("", errUnreachable)
+			value, err := c.Get("key", time.Hour, fetch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if value != tt.want {
+				t.Errorf("Get() = %q, want %q", value, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := openCache(t, path, Options{})
+	fetch, calls := counter("value", nil)
+	if _, err := c.Get("key", time.Hour, fetch); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("fetch called %d times, want 1", *calls)
+	}
+}
+
+type mockParameters struct {
+	values map[string]string
+	err    error
+	calls  [][]string
+}
+
+func (m *mockParameters) GetParameter(name string) (string, error) {
+	m.calls = append(m.calls, []string{name})
+	if m.err != nil {
+		return "", m.err
+	}
+	return m.values[name], nil
+}
+
+func (m *mockParameters) GetParametersByPath(paths []string) ([]ssmtypes.Parameter, error) {
+	m.calls = append(m.calls, paths)
+	if m.err != nil {
+		return nil, m.err
+	}
+	var params []ssmtypes.Parameter
+	for _, name := range paths {
+		if value, ok := m.values[name]; ok {
+			params = append(params, parameter(name, value))
+		}
+	}
+	return params, nil
+}
+
+func (m *mockParameters) GetParameters(names []string) (map[string]string, []string, error) {
+	m.calls = append(m.calls, names)
+	if m.err != nil {
+		return nil, nil, m.err
+	}
+	values := make(map[string]string)
+	var invalid []string
+	for _, name := range names {
+		if value, ok := m.values[name]; ok {
+			values[name] = value
+		} else {
+			invalid = append(invalid, name)
+		}
+	}
+	return values, invalid, nil
+}
+
+func TestParametersGetParameters(t *testing.T) {
+	c := openCache(t, filepath.Join(t.TempDir(), "cache.json"), Options{})
+	store := &mockParameters{values: map[string]string{"/dev/a": "1", "/dev/b": "2"}}
+	params := c.Parameters(Namespace("eu-central-1", account("123456789012"), "dev"), store)
+
+	if _, err := params.GetParameter("/dev/a"); err != nil {
+		t.Fatalf("GetParameter() error = %v", err)
+	}
+
+	values, invalid, err := params.GetParameters([]string{"/dev/a", "/dev/b", "/dev/missing"})
+	if err != nil {
+		t.Fatalf("GetParameters() error = %v", err)
+	}
+	if values["/dev/a"] != "1" || values["/dev/b"] != "2" || len(values) != 2 {
+		t.Errorf("GetParameters() values = %v, want /dev/a and /dev/b", values)
+	}
+	if len(invalid) != 1 || invalid[0] != "/dev/missing" {
+		t.Errorf("GetParameters() invalid = %v, want [/dev/missing]", invalid)
+	}
+	if last := store.calls[len(store.calls)-1]; len(last) != 2 {
+		t.Errorf("GetParameters() looked up %v, want only the uncached names", last)
+	}
+
+	// Missing names are looked up again, found ones are not
+	if _, _, err := params.GetParameters([]string{"/dev/b", "/dev/missing"}); err != nil {
+		t.Fatalf("GetParameters() error = %v", err)
+	}
+	if last := store.calls[len(store.calls)-1]; len(last) != 1 || last[0] != "/dev/missing" {
+		t.Errorf("GetParameters() looked up %v, want [/dev/missing]", last)
+	}
+}
+
+func TestParametersByPath(t *testing.T) {
+	c := openCache(t, filepath.Join(t.TempDir(), "cache.json"), Options{})
+	store := &mockParameters{values: map[string]string{"/dev/a": "1", "/dev/b": "2"}}
+	params := c.Parameters(Namespace("eu-central-1", account("123456789012"), "dev"), store)
+
+	if _, err := params.GetParameter("/dev/a"); err != nil {
+		t.Fatalf("GetParameter() error = %v", err)
+	}
+
+	got, err := params.GetParametersByPath([]string{"/dev/a", "/dev/b"})
+	if err != nil {
+		t.Fatalf("GetParametersByPath() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("GetParametersByPath() returned %d parameters, want 2", len(got))
+	}
+
+	// Only the parameter that was not cached is looked up
+	if last := store.calls[len(store.calls)-1]; len(last) != 1 || last[0] != "/dev/b" {
+		t.Errorf("GetParametersByPath() looked up %v, want [/dev/b]", last)
+	}
+
+	// Everything is cached now
+	calls := len(store.calls)
+	if _, err := params.GetParametersByPath([]string{"/dev/a", "/dev/b"}); err != nil {
+		t.Fatalf("GetParametersByPath() error = %v", err)
+	}
+	if len(store.calls) != calls {
+		t.Errorf("GetParametersByPath() called the store with everything cached")
+	}
+}
+
+func TestParametersNamespaces(t *testing.T) {
+	c := openCache(t, filepath.Join(t.TempDir(), "cache.json"), Options{})
+	dev := c.Parameters(Namespace("eu-central-1", account("111111111111"), "dev"), &mockParameters{values: map[string]string{"/host": "dev"}})
+	prod := c.Parameters(Namespace("eu-central-1", account("222222222222"), "prod"), &mockParameters{values: map[string]string{"/host": "prod"}})
+
+	for _, tt := range []struct {
+		params *Parameters
+		want   string
+	}{{dev, "dev"}, {prod, "prod"}, {dev, "dev"}} {
+		value, err := tt.params.GetParameter("/host")
+		if err != nil {
+			t.Fatalf("GetParameter() error = %v", err)
+		}
+		if value != tt.want {
+			t.Errorf("GetParameter() = %q, want %q", value, tt.want)
+		}
+	}
+}
+
+func TestParametersNamespaceLookedUpOnUse(t *testing.T) {
+	c := openCache(t, filepath.Join(t.TempDir(), "cache.json"), Options{})
+	fetch, calls := counter("", errUnreachable)
+
+	params := c.Parameters(Namespace("eu-central-1", fetch, "dev"), &mockParameters{values: map[string]string{"/host": "db"}})
+	if *calls != 0 {
+		t.Fatalf("account looked up %d times before any lookup, want 0", *calls)
+	}
+	if _, err := params.GetParameter("/host"); !errors.Is(err, errUnreachable) {
+		t.Errorf("GetParameter() error = %v, want %v", err, errUnreachable)
+	}
+	if *calls != 1 {
+		t.Errorf("account looked up %d times, want 1", *calls)
+	}
+}
+
+func TestParametersByPathOffline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	ns := Namespace("eu-central-1", account("123456789012"), "dev")
+
+	online := openCache(t, path, Options{ParameterTTL: time.Nanosecond})
+	store := &mockParameters{values: map[string]string{"/dev/a": "1"}}
+	if _, err := online.Parameters(ns, store).GetParametersByPath([]string{"/dev/a"}); err != nil {
+		t.Fatalf("GetParametersByPath() error = %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	store.err = errUnreachable
+	if _, err := online.Parameters(ns, store).GetParametersByPath([]string{"/dev/a"}); !errors.Is(err, errUnreachable) {
+		t.Errorf("GetParametersByPath() error = %v, want %v", err, errUnreachable)
+	}
+
+	offline := openCache(t, path, Options{Offline: true})
+	got, err := offline.Parameters(ns, store).GetParametersByPath([]string{"/dev/a"})
+	if err != nil {
+		t.Fatalf("GetParametersByPath() offline error = %v", err)
+	}
+	if len(got) != 1 || aws.ToString(got[0].Value) != "1" {
+		t.Errorf("GetParametersByPath() offline = %v, want the expired /dev/a", got)
+	}
+}
+
+type mockInstances struct {
+	running map[string]bool
+	// problems are the agent problems of running instances
+	problems map[string]string
+	lookups  int
+}
+
+func (m *mockInstances) GetJumphost(query awsclient.JumphostQuery) (*types.Instance, error) {
+	m.lookups++
+	for id, running := range m.running {
+		if running && m.problems[id] == "" {
+			return &types.Instance{
+				InstanceId: aws.String(id),
+				Tags:       []types.Tag{{Key: aws.String("Name"), Value: aws.String(query.Filters.String())}},
+			}, nil
+		}
+	}
+	return nil, errors.New("no running jumphost")
+}
+
+func (m *mockInstances) JumphostProblem(instanceID string) (string, error) {
+	if !m.running[instanceID] {
+		return "is not running", nil
+	}
+	return m.problems[instanceID], nil
+}
+
+func TestInstances(t *testing.T) {
+	c := openCache(t, filepath.Join(t.TempDir(), "cache.json"), Options{})
+	finder := &mockInstances{running: map[string]bool{"i-123": true}}
+	instances := c.Instances(Namespace("eu-central-1", account("123456789012"), "dev"), finder)
+
+	for i := 0; i < 2; i++ {
+		instance, err := instances.GetJumphost(awsclient.JumphostQuery{Filters: awsclient.NameFilter("dev-jumphost")})
+		if err != nil {
+			t.Fatalf("GetJumphost() error = %v", err)
+		}
+		if id := aws.ToString(instance.InstanceId); id != "i-123" {
+			t.Errorf("GetJumphost() = %s, want i-123", id)
+		}
+		if len(instance.Tags) != 1 || aws.ToString(instance.Tags[0].Value) != "dev-jumphost" {
+			t.Errorf("GetJumphost() tags = %v, want the Name tag", instance.Tags)
+		}
+	}
+	if finder.lookups != 1 {
+		t.Errorf("jumphost looked up %d times, want 1", finder.lookups)
+	}
+
+	// Finding the cached jumphost stopped drops it from the cache
+	finder.running = map[string]bool{"i-123": false, "i-456": true}
+	if problem, err := instances.JumphostProblem("i-123"); err != nil || problem == "" {
+		t.Fatalf("JumphostProblem() = %q, %v, want not running", problem, err)
+	}
+	instance, err := instances.GetJumphost(awsclient.JumphostQuery{Filters: awsclient.NameFilter("dev-jumphost")})
+	if err != nil {
+		t.Fatalf("GetJumphost() error = %v", err)
+	}
+	if id := aws.ToString(instance.InstanceId); id != "i-456" {
+		t.Errorf("GetJumphost() = %s after the cached one stopped, want i-456", id)
+	}
+
+	// So is a cached jumphost whose agent went offline, found when it is
+	// served from the cache
+	finder.running = map[string]bool{"i-456": true, "i-789": true}
+	finder.problems = map[string]string{"i-456": "has SSM agent status ConnectionLost"}
+	instance, err = instances.GetJumphost(awsclient.JumphostQuery{Filters: awsclient.NameFilter("dev-jumphost")})
+	if err != nil {
+		t.Fatalf("GetJumphost() error = %v", err)
+	}
+	if id := aws.ToString(instance.InstanceId); id != "i-789" {
+		t.Errorf("GetJumphost() = %s after the cached agent went offline, want i-789", id)
+	}
+}
+
+func TestInstancesQueries(t *testing.T) {
+	c := openCache(t, filepath.Join(t.TempDir(), "cache.json"), Options{})
+	finder := &mockInstances{running: map[string]bool{"i-123": true}}
+	instances := c.Instances(Namespace("eu-central-1", account("123456789012"), "dev"), finder)
+
+	// Each strategy is cached apart, and so is each set of hosts for
+	// same-az. Least used jumphosts are never cached.
+	for _, query := range []awsclient.JumphostQuery{
+		{Filters: awsclient.NameFilter("dev-jumphost")},
+		{Filters: awsclient.NameFilter("dev-jumphost"), Strategy: awsclient.StrategyRandom},
+		{Filters: awsclient.NameFilter("dev-jumphost"), Strategy: awsclient.StrategyLeastUsed},
+		{Filters: awsclient.NameFilter("dev-jumphost"), Strategy: awsclient.StrategyLeastUsed},
+		{Filters: awsclient.NameFilter("dev-jumphost"), Strategy: awsclient.StrategySameAZ, Hosts: []string{"db"}},
+		{Filters: awsclient.NameFilter("dev-jumphost"), Strategy: awsclient.StrategySameAZ, Hosts: []string{"cache"}},
+		{Filters: awsclient.NameFilter("dev-jumphost"), Strategy: awsclient.StrategySameAZ, Hosts: []string{"cache"}},
+	} {
+		if _, err := instances.GetJumphost(query); err != nil {
+			t.Fatalf("GetJumphost(%+v) error = %v", query, err)
+		}
+	}
+	if finder.lookups != 5 {
+		t.Errorf("jumphost looked up %d times, want 5", finder.lookups)
+	}
+
+	// Explicit instances are always checked
+	for i := 0; i < 2; i++ {
+		if _, err := instances.GetJumphost(awsclient.JumphostQuery{InstanceID: "i-123"}); err != nil {
+			t.Fatalf("GetJumphost() error = %v", err)
+		}
+	}
+	if finder.lookups != 7 {
+		t.Errorf("jumphost looked up %d times, want 7", finder.lookups)
+	}
+}
@@ -3,7 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
-	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,10 +14,75 @@ type ConfigValue struct {
 	SSMParam string `yaml:"ssm_param"`
 }
 
+// UnmarshalYAML decodes a config value, replacing both fields so that an
+// environment override of value does not inherit the base ssm_param or the
+// other way around
+func (cv *ConfigValue) UnmarshalYAML(node *yaml.Node) error {
+	type plain ConfigValue
+	var v plain
+	if err := node.Decode(&v); err != nil {
+		return err
+	}
+	*cv = ConfigValue(v)
+	return nil
+}
+
 // PortRange represents a range of ports
 type PortRange struct {
-	Start int `yaml:"start"`
-	End   int `yaml:"end"`
+	Start int `yaml:"start" json:"start"`
+	End   int `yaml:"end" json:"end"`
+}
+
+// String formats the range as start-end, or as the port alone if it has one
+func (r PortRange) String() string {
+	if r.Start == r.End {
+		return fmt.Sprintf("%d", r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// Offset returns the range moved up by n ports
+func (r PortRange) Offset(n int) PortRange {
+	return PortRange{Start: r.Start + n, End: r.End + n}
+}
+
+// EC2Filter is an EC2 filter on the instances considered as jumphost, such as
+// tag:Role or vpc-id. Values may contain * and ? wildcards.
+type EC2Filter struct {
+	Name   string   `yaml:"name"`
+	Values []string `yaml:"values"`
+}
+
+// JumphostFilter selects the instances that may be used as the jumphost. It
+// is written either as a pattern matched against the Name tag, or as a list
+// of EC2 filters that must all match.
+type JumphostFilter []EC2Filter
+
+// NameFilter returns the filter matching the Name tag against pattern, as
+// written in the shorthand form
+func NameFilter(pattern string) JumphostFilter {
+	if pattern == "" {
+		return nil
+	}
+	return JumphostFilter{{Name: "tag:Name", Values: []string{pattern}}}
+}
+
+// UnmarshalYAML decodes either form of a jumphost filter
+func (f *JumphostFilter) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var pattern string
+		if err := node.Decode(&pattern); err != nil {
+			return err
+		}
+		*f = NameFilter(pattern)
+		return nil
+	}
+	var filters []EC2Filter
+	if err := node.Decode(&filters); err != nil {
+		return err
+	}
+	*f = filters
+	return nil
 }
 
 // ServiceConfig represents the configuration for a service
@@ -25,22 +90,138 @@ type ServiceConfig struct {
 	Host           ConfigValue `yaml:"host"`
 	RemotePort     ConfigValue `yaml:"remote-port"`
 	LocalPortRange PortRange   `yaml:"local-port-range"`
-	ServiceDetails []string    `yaml:"service-details,omitempty"`
+	// LocalPort pins the service to one local port instead of a range. The
+	// tunnel fails if the port is taken rather than use another one.
+	LocalPort      int      `yaml:"local-port,omitempty"`
+	ServiceDetails []string `yaml:"service-details,omitempty"`
+	// Lazy defers resolving the service and starting its session until a
+	// client first connects to the local port
+	Lazy bool `yaml:"lazy,omitempty"`
+	// IdleTimeout closes the tunnel once it has had no connection for that
+	// long. Keepalive is how often a connection is opened through the
+	// session to keep it in use, and the TCP keepalive period of local
+	// connections.
+	IdleTimeout time.Duration `yaml:"idle-timeout,omitempty"`
+	Keepalive   time.Duration `yaml:"keepalive,omitempty"`
+	// HealthCheck checks that the service is reachable through the tunnel
+	HealthCheck *HealthCheck `yaml:"health-check,omitempty"`
+}
+
+// HealthCheck configures how the service behind a tunnel is checked, once
+// when the tunnel is created and then periodically
+type HealthCheck struct {
+	// Type is tcp, tls, http, https, redis, mysql or postgres
+	Type string `yaml:"type"`
+	// Interval is how often the check runs and Timeout how long each run
+	// may take. Failures is how many runs in a row must fail before the
+	// session is reconnected, and how many attempts the check gets when
+	// the tunnel is created.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	Failures int           `yaml:"failures,omitempty"`
+	// ServerName is the name TLS certificates are verified against and HTTP
+	// requests are sent for, the remote host when it is empty
+	ServerName         string `yaml:"server-name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify,omitempty"`
+	// Path and Status are the path HTTP checks request and the status they
+	// expect, / and 200 by default
+	Path   string `yaml:"path,omitempty"`
+	Status int    `yaml:"status,omitempty"`
+}
+
+// LocalPorts returns the ports a tunnel for the service may listen on: the
+// pinned local port alone, or the local port range
+func (s ServiceConfig) LocalPorts() PortRange {
+	if s.LocalPort != 0 {
+		return PortRange{Start: s.LocalPort, End: s.LocalPort}
+	}
+	return s.LocalPortRange
+}
+
+// AWSRole is an IAM role assumed for an environment
+type AWSRole struct {
+	RoleARN     string `yaml:"role_arn"`
+	ExternalID  string `yaml:"external_id"`
+	SessionName string `yaml:"session_name"`
+	MFASerial   string `yaml:"mfa_serial"`
+}
+
+// TunnelGoConfig is the tunnel-go-config section of the configuration file
+type TunnelGoConfig struct {
+	Placeholder       string `yaml:"placeholder"`
+	CachefileLocation string `yaml:"cachefile-location"`
+	// CacheTTL sets how long cached lookups are used before being refreshed
+	CacheTTL struct {
+		Parameters time.Duration `yaml:"parameters"`
+		Jumphosts  time.Duration `yaml:"jumphosts"`
+	} `yaml:"cache-ttl"`
+	LogfileLocation string `yaml:"logfile-location"`
+	// LogRotation limits the size of the log file and how many rotated
+	// files are kept
+	LogRotation struct {
+		MaxSizeMB  int `yaml:"max-size-mb"`
+		MaxBackups int `yaml:"max-backups"`
+	} `yaml:"log-rotation"`
+	// LogLevel and LogFormat apply unless overridden by -log-level and
+	// -log-format
+	LogLevel  string `yaml:"log-level"`
+	LogFormat string `yaml:"log-format"`
+	// Concurrency is how many tunnels are created at once
+	Concurrency int `yaml:"concurrency"`
+	// Lazy makes the tunnels of every service lazy. LazyIdleTimeout is how
+	// long the session of a lazy tunnel stays open without connections.
+	Lazy            bool          `yaml:"lazy"`
+	LazyIdleTimeout time.Duration `yaml:"lazy-idle-timeout"`
+	// BindAddress is the IP address tunnels listen on, 127.0.0.1 by default.
+	// Addresses other than loopback ones expose the tunnels to the network
+	// and must be allowed with AllowExternalBind.
+	BindAddress       string `yaml:"bind-address"`
+	AllowExternalBind bool   `yaml:"allow-external-bind"`
+	// JumphostFilter selects the instances that may be used as the jumphost
+	JumphostFilter JumphostFilter `yaml:"jumphost-filter"`
+	// JumphostStrategy picks one of the instances matching JumphostFilter:
+	// random (the default), first-by-launch-time, same-az or least-used
+	JumphostStrategy string `yaml:"jumphost-strategy"`
+	// Jumphost is the ID of an instance to use as the jumphost instead of
+	// looking one up
+	Jumphost string                   `yaml:"jumphost"`
+	Services map[string]ServiceConfig `yaml:"services"`
 }
 
 // Config represents the configuration file structure
 type Config struct {
 	DefaultRegion string `yaml:"default_region"`
 	AWS           struct {
-		Profile string `yaml:"profile"`
+		// DefaultRegion is used when the top-level default_region is not set
+		DefaultRegion string             `yaml:"default_region"`
+		Profile       string             `yaml:"profile"`
+		Roles         map[string]AWSRole `yaml:"roles"`
 	} `yaml:"aws"`
-	TunnelConfig struct {
-		Placeholder       string                   `yaml:"placeholder"`
-		CachefileLocation string                   `yaml:"cachefile-location"`
-		LogfileLocation   string                   `yaml:"logfile-location"`
-		JumphostFilter    string                   `yaml:"jumphost-filter"`
-		Services          map[string]ServiceConfig `yaml:"services"`
-	} `yaml:"tunnel-go-config"`
+	TunnelConfig TunnelGoConfig `yaml:"tunnel-go-config"`
+	// Variables are user-defined template variables
+	Variables    map[string]string      `yaml:"vars"`
+	Environments map[string]Environment `yaml:"environments"`
+
+	// doc is the parsed file, kept for the line numbers reported by Validate
+	doc *yaml.Node
+}
+
+// Environment overrides the base configuration for one environment
+type Environment struct {
+	Region           string         `yaml:"region"`
+	Profile          string         `yaml:"profile"`
+	JumphostFilter   JumphostFilter `yaml:"jumphost-filter"`
+	JumphostStrategy string         `yaml:"jumphost-strategy"`
+	Jumphost         string         `yaml:"jumphost"`
+	// PortOffset is added to the local ports of every service in the
+	// environment, so each environment can get ports of its own
+	PortOffset int `yaml:"port-offset"`
+	// Variables are merged over the base template variables
+	Variables map[string]string `yaml:"vars"`
+	// Services holds the environment's services. LoadConfig merges the
+	// overrides over the base definitions, so each entry is complete.
+	// Services only defined for the environment are included as they are.
+	Services map[string]ServiceConfig `yaml:"services"`
 }
 
 // SSMClient interface for AWS SSM operations
@@ -48,27 +229,71 @@ type SSMClient interface {
 	GetParameter(name string) (string, error)
 }
 
-// GetValue returns either the direct value or fetches from SSM if SSMParam is set
-func (cv *ConfigValue) GetValue(ssmClient SSMClient, placeholder string) (string, error) {
+// GetValue returns either the direct value or fetches from SSM if SSMParam is
+// set. Template variables are expanded in both the value and the parameter path.
+func (cv *ConfigValue) GetValue(ssmClient SSMClient, vars *Vars) (string, error) {
+	value, paramPath, err := cv.Expand(vars)
+	if err != nil || paramPath == "" {
+		return value, err
+	}
+	return ssmClient.GetParameter(paramPath)
+}
+
+// Expand returns the literal value with template variables expanded or, if
+// the value is read from SSM, the expanded parameter name, so parameters can
+// be looked up together
+func (cv *ConfigValue) Expand(vars *Vars) (value, ssmParam string, err error) {
 	// Check if both value and SSM parameter are specified
 	if cv.SSMParam != "" && cv.Value != "" {
-		return "", fmt.Errorf("cannot specify both value and SSM parameter")
+		return "", "", fmt.Errorf("cannot specify both value and SSM parameter")
 	}
 
 	if cv.SSMParam != "" {
-		// Replace placeholder in SSM parameter path
-		paramPath := strings.ReplaceAll(cv.SSMParam, "${PLACEHOLDER}", placeholder)
-		return ssmClient.GetParameter(paramPath)
+		ssmParam, err = vars.Expand(cv.SSMParam)
+		return "", ssmParam, err
 	}
 	if cv.Value != "" {
-		return cv.Value, nil
+		value, err = vars.Expand(cv.Value)
+		return value, "", err
 	}
-	return "", fmt.Errorf("no value or SSM parameter specified")
+	return "", "", fmt.Errorf("no value or SSM parameter specified")
 }
 
-// GetJumphostFilter returns the jumphost filter pattern for the given environment
-func (c *Config) GetJumphostFilter(env string) string {
-	return strings.ReplaceAll(c.TunnelConfig.JumphostFilter, "${PLACEHOLDER}", env)
+// GetJumphostFilter returns the jumphost filter with template variables
+// expanded in the names and values of the filters
+func (c *Config) GetJumphostFilter(vars *Vars) (JumphostFilter, error) {
+	var expanded JumphostFilter
+	for _, filter := range c.TunnelConfig.JumphostFilter {
+		name, err := vars.Expand(filter.Name)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]string, len(filter.Values))
+		for i, value := range filter.Values {
+			if values[i], err = vars.Expand(value); err != nil {
+				return nil, err
+			}
+		}
+		expanded = append(expanded, EC2Filter{Name: name, Values: values})
+	}
+	return expanded, nil
+}
+
+// Region returns the configured AWS region, which may be empty
+func (c *Config) Region() string {
+	if c.DefaultRegion != "" {
+		return c.DefaultRegion
+	}
+	return c.AWS.DefaultRegion
+}
+
+// GetRole returns the role to assume for the given environment, or nil if the
+// environment uses the base credentials
+func (c *Config) GetRole(env string) *AWSRole {
+	if role, ok := c.AWS.Roles[env]; ok && role.RoleARN != "" {
+		return &role
+	}
+	return nil
 }
 
 // GetServiceConfig returns the configuration for a specific service
@@ -86,10 +311,106 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("error reading config file: %w", err)
 	}
 
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %w", err)
+	}
+
+	config := Config{doc: &doc}
+	if len(doc.Content) == 0 {
+		return &config, nil
+	}
+	if err := doc.Decode(&config); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %w", err)
+	}
+	if err := config.mergeEnvironments(&doc); err != nil {
 		return nil, fmt.Errorf("error parsing config file: %w", err)
 	}
 
 	return &config, nil
 }
+
+// mergeEnvironments resolves the service overrides of every environment.
+// Each override is decoded over a fresh decode of the base service, so any
+// field present in the override replaces the base field and absent fields
+// keep their base values.
+func (c *Config) mergeEnvironments(doc *yaml.Node) error {
+	var raw struct {
+		TunnelConfig struct {
+			Services map[string]yaml.Node `yaml:"services"`
+		} `yaml:"tunnel-go-config"`
+		Environments map[string]struct {
+			Services map[string]yaml.Node `yaml:"services"`
+		} `yaml:"environments"`
+	}
+	if err := doc.Decode(&raw); err != nil {
+		return err
+	}
+
+	for name, rawEnv := range raw.Environments {
+		env := c.Environments[name]
+		env.Services = make(map[string]ServiceConfig)
+		for serviceName, override := range rawEnv.Services {
+			var service ServiceConfig
+			if base, ok := raw.TunnelConfig.Services[serviceName]; ok {
+				if err := base.Decode(&service); err != nil {
+					return fmt.Errorf("service %s: %w", serviceName, err)
+				}
+			}
+			if err := override.Decode(&service); err != nil {
+				return fmt.Errorf("environment %s, service %s: %w", name, serviceName, err)
+			}
+			env.Services[serviceName] = service
+		}
+		c.Environments[name] = env
+	}
+	return nil
+}
+
+// PortOffset returns the offset added to the local ports of the services in env
+func (c *Config) PortOffset(env string) int {
+	return c.Environments[env].PortOffset
+}
+
+// ForEnvironment returns the configuration with the overrides of env applied.
+// Environments without an environments entry get the base configuration.
+func (c *Config) ForEnvironment(env string) *Config {
+	resolved := *c
+	override, ok := c.Environments[env]
+	if !ok {
+		return &resolved
+	}
+
+	if override.Region != "" {
+		resolved.DefaultRegion = override.Region
+	}
+	if override.Profile != "" {
+		resolved.AWS.Profile = override.Profile
+	}
+	if len(override.JumphostFilter) > 0 {
+		resolved.TunnelConfig.JumphostFilter = override.JumphostFilter
+	}
+	if override.JumphostStrategy != "" {
+		resolved.TunnelConfig.JumphostStrategy = override.JumphostStrategy
+	}
+	if override.Jumphost != "" {
+		resolved.TunnelConfig.Jumphost = override.Jumphost
+	}
+
+	resolved.Variables = make(map[string]string, len(c.Variables)+len(override.Variables))
+	for name, value := range c.Variables {
+		resolved.Variables[name] = value
+	}
+	for name, value := range override.Variables {
+		resolved.Variables[name] = value
+	}
+
+	resolved.TunnelConfig.Services = make(map[string]ServiceConfig, len(c.TunnelConfig.Services)+len(override.Services))
+	for name, service := range c.TunnelConfig.Services {
+		resolved.TunnelConfig.Services[name] = service
+	}
+	for name, service := range override.Services {
+		resolved.TunnelConfig.Services[name] = service
+	}
+	return &resolved
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -31,6 +32,11 @@ func TestLoadConfig(t *testing.T) {
 	configContent := `default_region: eu-central-1
 aws:
   profile: default
+  roles:
+    prod:
+      role_arn: arn:aws:iam::123456789012:role/tunnel
+      external_id: tunnel-go
+      mfa_serial: arn:aws:iam::123456789012:mfa/user
 tunnel-go-config:
   placeholder: environment
   jumphost-filter: ${PLACEHOLDER}-ecs-autoscaled
@@ -70,6 +76,14 @@ tunnel-go-config:
 		t.Errorf("Expected AWS profile 'default', got %s", cfg.AWS.Profile)
 	}
 
+	if role := cfg.GetRole("prod"); role == nil || role.RoleARN != "arn:aws:iam::123456789012:role/tunnel" || role.ExternalID != "tunnel-go" {
+		t.Errorf("Expected prod role, got %+v", role)
+	}
+
+	if role := cfg.GetRole("dev"); role != nil {
+		t.Errorf("Expected no role for dev, got %+v", role)
+	}
+
 	if cfg.TunnelConfig.Placeholder != "environment" {
 		t.Errorf("Expected placeholder 'environment', got %s", cfg.TunnelConfig.Placeholder)
 	}
@@ -159,7 +173,7 @@ func TestGetValue(t *testing.T) {
 				tt.ssmClient = &mockSSMClient{}
 			}
 
-			got, err := tt.config.GetValue(tt.ssmClient, "test")
+			got, err := tt.config.GetValue(tt.ssmClient, (&Config{}).Vars("test", "", nil))
 			if (err != nil) != tt.wantErr {
 				t.Errorf("GetValue() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -241,7 +255,7 @@ func TestGetValueValidation(t *testing.T) {
 				tt.ssmClient = &mockSSMClient{}
 			}
 
-			got, err := tt.config.GetValue(tt.ssmClient, "test")
+			got, err := tt.config.GetValue(tt.ssmClient, (&Config{}).Vars("test", "", nil))
 			if (err != nil) != tt.wantErr {
 				t.Errorf("GetValue() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -259,13 +273,7 @@ func TestGetValueValidation(t *testing.T) {
 
 func TestGetServiceConfig(t *testing.T) {
 	cfg := &Config{
-		TunnelConfig: struct {
-			Placeholder       string                   `yaml:"placeholder"`
-			CachefileLocation string                   `yaml:"cachefile-location"`
-			LogfileLocation   string                   `yaml:"logfile-location"`
-			JumphostFilter    string                   `yaml:"jumphost-filter"`
-			Services          map[string]ServiceConfig `yaml:"services"`
-		}{
+		TunnelConfig: TunnelGoConfig{
 			Services: map[string]ServiceConfig{
 				"database": {
 					Host: ConfigValue{
@@ -312,15 +320,9 @@ func TestGetServiceConfig(t *testing.T) {
 
 func TestGetJumphostFilter(t *testing.T) {
 	cfg := &Config{
-		TunnelConfig: struct {
-			Placeholder       string                   `yaml:"placeholder"`
-			CachefileLocation string                   `yaml:"cachefile-location"`
-			LogfileLocation   string                   `yaml:"logfile-location"`
-			JumphostFilter    string                   `yaml:"jumphost-filter"`
-			Services          map[string]ServiceConfig `yaml:"services"`
-		}{
+		TunnelConfig: TunnelGoConfig{
 			Placeholder:     "environment",
-			JumphostFilter: "${PLACEHOLDER}-ecs-autoscaled",
+			JumphostFilter: NameFilter("${PLACEHOLDER}-ecs-autoscaled"),
 		},
 	}
 
@@ -343,10 +345,173 @@ func TestGetJumphostFilter(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := cfg.GetJumphostFilter(tt.env)
-			if got != tt.want {
-				t.Errorf("GetJumphostFilter() = %v, want %v", got, tt.want)
+			got, err := cfg.GetJumphostFilter(cfg.Vars(tt.env, "", nil))
+			if err != nil {
+				t.Fatalf("GetJumphostFilter() error = %v", err)
+			}
+			if want := NameFilter(tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("GetJumphostFilter() = %v, want %v", got, want)
 			}
 		})
 	}
 }
+
+func TestGetJumphostFilterList(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := `tunnel-go-config:
+  jumphost-filter:
+    - name: tag:Role
+      values: [bastion]
+    - name: tag:Team
+      values: [payments, platform-*]
+    - name: vpc-id
+      values: ["${VPC}"]
+vars:
+  VPC: vpc-0dev
+environments:
+  prod:
+    vars:
+      VPC: vpc-0prod
+  legacy:
+    jumphost-filter: ${ENV}-bastion
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	prod := cfg.ForEnvironment("prod")
+	got, err := prod.GetJumphostFilter(prod.Vars("prod", "", nil))
+	if err != nil {
+		t.Fatalf("GetJumphostFilter() error = %v", err)
+	}
+	want := JumphostFilter{
+		{Name: "tag:Role", Values: []string{"bastion"}},
+		{Name: "tag:Team", Values: []string{"payments", "platform-*"}},
+		{Name: "vpc-id", Values: []string{"vpc-0prod"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetJumphostFilter() = %v, want %v", got, want)
+	}
+
+	// The shorthand form of an environment replaces the whole list
+	legacy := cfg.ForEnvironment("legacy")
+	got, err = legacy.GetJumphostFilter(legacy.Vars("legacy", "", nil))
+	if err != nil {
+		t.Fatalf("GetJumphostFilter() error = %v", err)
+	}
+	if want := NameFilter("legacy-bastion"); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetJumphostFilter() = %v, want %v", got, want)
+	}
+}
+
+func TestEnvironmentOverrides(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+
+	configContent := `default_region: eu-central-1
+aws:
+  profile: default
+tunnel-go-config:
+  jumphost-filter: ${PLACEHOLDER}-autoscaled
+  services:
+    database:
+      host:
+        ssm_param: "/${PLACEHOLDER}/database/host"
+      remote-port:
+        value: "3306"
+      local-port-range:
+        start: 5000
+        end: 5009
+      service-details:
+        - /${PLACEHOLDER}/database/user
+    redis:
+      host:
+        value: redis.internal
+      remote-port:
+        value: "6379"
+      local-port-range:
+        start: 5010
+        end: 5019
+environments:
+  prod:
+    region: us-east-1
+    profile: prod
+    jumphost-filter: prod-bastion-*
+    services:
+      database:
+        host:
+          value: prod-db.internal
+        local-port-range:
+          end: 5005
+      search:
+        host:
+          value: search.internal
+        remote-port:
+          value: "443"
+        local-port-range:
+          start: 5020
+          end: 5029
+  dev:`
+
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	prod := cfg.ForEnvironment("prod")
+	if prod.DefaultRegion != "us-east-1" || prod.AWS.Profile != "prod" {
+		t.Errorf("Expected prod region us-east-1 and profile prod, got %s and %s", prod.DefaultRegion, prod.AWS.Profile)
+	}
+	if filter, _ := prod.GetJumphostFilter(prod.Vars("prod", "", nil)); !reflect.DeepEqual(filter, NameFilter("prod-bastion-*")) {
+		t.Errorf("Expected prod jumphost filter prod-bastion-*, got %v", filter)
+	}
+
+	db, err := prod.GetServiceConfig("database")
+	if err != nil {
+		t.Fatalf("GetServiceConfig failed: %v", err)
+	}
+	// The host override replaces the base ssm_param instead of adding to it
+	if db.Host.Value != "prod-db.internal" || db.Host.SSMParam != "" {
+		t.Errorf("Expected prod database host value only, got %+v", db.Host)
+	}
+	if db.RemotePort.Value != "3306" {
+		t.Errorf("Expected base remote port 3306, got %+v", db.RemotePort)
+	}
+	if db.LocalPortRange.Start != 5000 || db.LocalPortRange.End != 5005 {
+		t.Errorf("Expected port range 5000-5005, got %+v", db.LocalPortRange)
+	}
+	if len(db.ServiceDetails) != 1 || db.ServiceDetails[0] != "/${PLACEHOLDER}/database/user" {
+		t.Errorf("Expected base service details, got %v", db.ServiceDetails)
+	}
+
+	if redis, err := prod.GetServiceConfig("redis"); err != nil || redis.Host.Value != "redis.internal" {
+		t.Errorf("Expected base redis service in prod, got %+v, %v", redis, err)
+	}
+	if _, err := prod.GetServiceConfig("search"); err != nil {
+		t.Errorf("Expected prod-only search service, got %v", err)
+	}
+
+	// The base configuration is left untouched
+	base, _ := cfg.GetServiceConfig("database")
+	if base.Host.SSMParam != "/${PLACEHOLDER}/database/host" || base.LocalPortRange.End != 5009 {
+		t.Errorf("Base database service was modified: %+v", base)
+	}
+	if _, err := cfg.GetServiceConfig("search"); err == nil {
+		t.Error("Expected search service to only exist in prod")
+	}
+
+	for _, env := range []string{"dev", "staging"} {
+		resolved := cfg.ForEnvironment(env)
+		if resolved.DefaultRegion != "eu-central-1" || resolved.AWS.Profile != "default" || len(resolved.TunnelConfig.Services) != 2 {
+			t.Errorf("Expected base configuration for %s, got %+v", env, resolved)
+		}
+	}
+}
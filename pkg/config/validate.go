@@ -0,0 +1,547 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem found in the configuration. Line and Column
+// locate it in the config file, and are zero for configurations that were
+// not loaded from a file.
+type ValidationError struct {
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Path, e.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s: %s", e.Line, e.Column, e.Path, e.Message)
+}
+
+// ValidationErrors lists every problem found by Validate, in file order
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// validator collects validation errors, dropping duplicates reported both
+// for a base service and for the environments inheriting it
+type validator struct {
+	errs ValidationErrors
+	seen map[ValidationError]bool
+}
+
+// add records an error at node. Errors at the same place in the file with
+// the same message are only recorded once.
+func (v *validator) add(node *yaml.Node, path, format string, args ...interface{}) {
+	err := ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		err.Line, err.Column = node.Line, node.Column
+	}
+
+	key := err
+	if key.Line != 0 {
+		key.Path = ""
+	}
+	if v.seen[key] {
+		return
+	}
+	v.seen[key] = true
+	v.errs = append(v.errs, err)
+}
+
+// Validate checks the configuration for unknown fields, invalid or
+// overlapping port ranges and pinned local ports, values that set both value
+// and ssm_param, a bind address that is not loopback without being allowed
+// and unknown jumphost filters and strategies, for the base services and for
+// every environment. Ports an environment chose for itself must not overlap those
+// of other environments. It returns ValidationErrors listing every problem,
+// or nil.
+func (c *Config) Validate() error {
+	v := &validator{seen: make(map[ValidationError]bool)}
+
+	var root *yaml.Node
+	if c.doc != nil && len(c.doc.Content) > 0 {
+		root = c.doc.Content[0]
+		v.checkFields(root, reflect.TypeOf(Config{}), "")
+	}
+
+	if c.TunnelConfig.Concurrency < 0 {
+		v.add(lookupKey(root, "tunnel-go-config", "concurrency"), "tunnel-go-config.concurrency", "must not be negative")
+	}
+	if c.TunnelConfig.LazyIdleTimeout < 0 {
+		v.add(lookupKey(root, "tunnel-go-config", "lazy-idle-timeout"), "tunnel-go-config.lazy-idle-timeout", "must not be negative")
+	}
+	if addr := c.TunnelConfig.BindAddress; addr != "" {
+		node := lookupKey(root, "tunnel-go-config", "bind-address")
+		if ip := net.ParseIP(addr); ip == nil {
+			v.add(node, "tunnel-go-config.bind-address", "%q is not an IP address", addr)
+		} else if !ip.IsLoopback() && !c.TunnelConfig.AllowExternalBind {
+			v.add(node, "tunnel-go-config.bind-address", "%s is reachable from other hosts, set allow-external-bind to use it", addr)
+		}
+	}
+
+	v.checkJumphost(c.TunnelConfig.JumphostFilter, c.TunnelConfig.JumphostStrategy, c.TunnelConfig.Jumphost, root, "tunnel-go-config")
+
+	servicesNode := lookupNode(root, "tunnel-go-config", "services")
+	v.checkServices(c.TunnelConfig.Services, "tunnel-go-config.services", func(name string, keys ...string) *yaml.Node {
+		return lookupKey(servicesNode, append([]string{name}, keys...)...)
+	}, nil)
+
+	var envNames []string
+	for name := range c.Environments {
+		envNames = append(envNames, name)
+	}
+	sort.Strings(envNames)
+
+	for _, envName := range envNames {
+		env := c.Environments[envName]
+		v.checkJumphost(env.JumphostFilter, env.JumphostStrategy, env.Jumphost, root, "environments", envName)
+
+		envServicesNode := lookupNode(root, "environments", envName, "services")
+		overridden := c.Environments[envName].Services
+
+		// Check the services as the environment sees them, locating each
+		// field in the override if it is set there and in the base otherwise
+		v.checkServices(c.ForEnvironment(envName).TunnelConfig.Services, "environments."+envName+".services", func(name string, keys ...string) *yaml.Node {
+			if _, ok := overridden[name]; ok {
+				if n := lookupKey(envServicesNode, append([]string{name}, keys...)...); n != nil {
+					return n
+				}
+			}
+			return lookupKey(servicesNode, append([]string{name}, keys...)...)
+		}, overridden)
+	}
+	v.checkEnvironmentPorts(c, root, envNames)
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		a, b := v.errs[i], v.errs[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return v.errs
+}
+
+// checkServices validates a set of services. find locates the key of a
+// field of a service in the file. When only is non-nil, services outside it have
+// already been checked and are only used to detect overlapping port ranges.
+func (v *validator) checkServices(services map[string]ServiceConfig, path string, find func(name string, keys ...string) *yaml.Node, only map[string]ServiceConfig) {
+	var names []string
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	checked := func(name string) bool {
+		if only == nil {
+			return true
+		}
+		_, ok := only[name]
+		return ok
+	}
+
+	validRange := make(map[string]bool)
+	for _, name := range names {
+		svc := services[name]
+		svcPath := path + "." + name
+		at := func(keys ...string) *yaml.Node {
+			if n := find(name, keys...); n != nil {
+				return n
+			}
+			return find(name)
+		}
+
+		if svc.LocalPort != 0 {
+			validRange[name] = svc.LocalPort >= 1 && svc.LocalPort <= 65535
+			if !validRange[name] && checked(name) {
+				v.add(at("local-port"), svcPath+".local-port", "port %d is outside 1-65535", svc.LocalPort)
+			}
+		} else {
+			validRange[name] = v.checkPortRange(svc.LocalPortRange, svcPath+".local-port-range", at, checked(name))
+		}
+		if !checked(name) {
+			continue
+		}
+
+		v.checkValue(svc.Host, svcPath+".host", at("host"))
+		v.checkValue(svc.RemotePort, svcPath+".remote-port", at("remote-port"))
+		if value := svc.RemotePort.Value; value != "" && !strings.Contains(value, "${") {
+			if port, err := strconv.Atoi(value); err != nil || port < 1 || port > 65535 {
+				v.add(at("remote-port", "value"), svcPath+".remote-port.value", "port %q is not a number between 1 and 65535", value)
+			}
+		}
+		if svc.IdleTimeout < 0 {
+			v.add(at("idle-timeout"), svcPath+".idle-timeout", "must not be negative")
+		}
+		if svc.Keepalive < 0 {
+			v.add(at("keepalive"), svcPath+".keepalive", "must not be negative")
+		}
+		if hc := svc.HealthCheck; hc != nil {
+			v.checkHealthCheck(hc, svcPath+".health-check", func(key string) *yaml.Node { return at("health-check", key) })
+		}
+	}
+
+	// Report each overlap once, on the later of the two services unless
+	// only the earlier one is being checked
+	for i, name := range names {
+		if !validRange[name] {
+			continue
+		}
+		for _, other := range names[:i] {
+			if !validRange[other] || (!checked(name) && !checked(other)) {
+				continue
+			}
+			target := name
+			if !checked(name) {
+				target, other = other, name
+			}
+			r, o := services[target].LocalPorts(), services[other].LocalPorts()
+			if r.Start <= o.End && o.Start <= r.End {
+				key, what := "local-port-range", "port range"
+				if services[target].LocalPort != 0 {
+					key, what = "local-port", "local port"
+				}
+				v.add(find(target, key), path+"."+target+"."+key,
+					"%s %s overlaps %s (%s)", what, r, other, o)
+			}
+		}
+	}
+}
+
+// healthCheckTypes are the checks implemented by package health
+var healthCheckTypes = []string{"tcp", "tls", "http", "https", "redis", "mysql", "postgres"}
+
+// checkHealthCheck checks the health check of a service at path. at returns
+// the node of a key of the health check.
+func (v *validator) checkHealthCheck(hc *HealthCheck, path string, at func(key string) *yaml.Node) {
+	known := false
+	for _, t := range healthCheckTypes {
+		known = known || t == hc.Type
+	}
+	if !known {
+		v.add(at("type"), path+".type", "unknown check %q, want one of %s", hc.Type, strings.Join(healthCheckTypes, ", "))
+	}
+	if hc.Interval < 0 {
+		v.add(at("interval"), path+".interval", "must not be negative")
+	}
+	if hc.Timeout < 0 {
+		v.add(at("timeout"), path+".timeout", "must not be negative")
+	}
+	if hc.Failures < 0 {
+		v.add(at("failures"), path+".failures", "must not be negative")
+	}
+
+	isHTTP := hc.Type == "http" || hc.Type == "https"
+	if hc.Path != "" && !isHTTP {
+		v.add(at("path"), path+".path", "only applies to http and https checks")
+	} else if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		v.add(at("path"), path+".path", "%q does not start with /", hc.Path)
+	}
+	if hc.Status != 0 && !isHTTP {
+		v.add(at("status"), path+".status", "only applies to http and https checks")
+	} else if hc.Status != 0 && (hc.Status < 100 || hc.Status > 599) {
+		v.add(at("status"), path+".status", "%d is not an HTTP status", hc.Status)
+	}
+}
+
+// jumphostStrategies are the strategies implemented by aws.Client.GetJumphost
+var jumphostStrategies = []string{"random", "first-by-launch-time", "same-az", "least-used"}
+
+// jumphostFilterNames are the EC2 filters a jumphost filter may use besides
+// tag:<key>
+var jumphostFilterNames = []string{"tag-key", "vpc-id", "subnet-id", "availability-zone", "instance-type", "image-id", "iam-instance-profile.arn"}
+
+// checkJumphost validates the jumphost filter, strategy and instance ID set
+// in the section at keys
+func (v *validator) checkJumphost(filter JumphostFilter, strategy, instanceID string, root *yaml.Node, keys ...string) {
+	path := strings.Join(keys, ".")
+	filtersNode := lookupNode(root, append(keys, "jumphost-filter")...)
+	for i, f := range filter {
+		// Filters given in the shorthand form have no node of their own
+		var node *yaml.Node
+		if filtersNode != nil && filtersNode.Kind == yaml.SequenceNode && i < len(filtersNode.Content) {
+			node = filtersNode.Content[i]
+		}
+		filterPath := fmt.Sprintf("%s.jumphost-filter[%d]", path, i)
+
+		known := len(f.Name) > len("tag:") && strings.HasPrefix(f.Name, "tag:")
+		for _, name := range jumphostFilterNames {
+			known = known || name == f.Name
+		}
+		if !known {
+			v.add(lookupKey(node, "name"), filterPath+".name",
+				"unknown filter %q, want tag:<key> or one of %s", f.Name, strings.Join(jumphostFilterNames, ", "))
+		}
+		if len(f.Values) == 0 {
+			at := lookupKey(node, "values")
+			if at == nil {
+				at = node
+			}
+			v.add(at, filterPath+".values", "must list at least one value")
+		}
+	}
+	if strategy != "" {
+		known := false
+		for _, s := range jumphostStrategies {
+			known = known || s == strategy
+		}
+		if !known {
+			v.add(lookupKey(root, append(keys, "jumphost-strategy")...), path+".jumphost-strategy",
+				"unknown strategy %q, want one of %s", strategy, strings.Join(jumphostStrategies, ", "))
+		}
+	}
+	if instanceID != "" && !strings.HasPrefix(instanceID, "i-") {
+		v.add(lookupKey(root, append(keys, "jumphost")...), path+".jumphost", "%q is not an instance ID", instanceID)
+	}
+}
+
+// envPorts are the local ports of a service in an environment
+type envPorts struct {
+	env     string
+	service string
+	ports   PortRange
+	// own is set when the environment chose the ports itself, through its
+	// port offset or by overriding the service's ports. path and node
+	// locate that choice.
+	own  bool
+	path string
+	node *yaml.Node
+}
+
+// checkEnvironmentPorts applies the port offset of every environment and
+// reports ports moved outside 1-65535, and ports an environment chose for
+// itself that overlap the ports of a service in another environment.
+// Environments using the base ports unchanged may share them.
+func (v *validator) checkEnvironmentPorts(c *Config, root *yaml.Node, envNames []string) {
+	var all []envPorts
+	for _, envName := range envNames {
+		env := c.Environments[envName]
+		envPath := "environments." + envName
+
+		services := c.ForEnvironment(envName).TunnelConfig.Services
+		var names []string
+		for name := range services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			r := services[name].LocalPorts()
+			if !r.valid() {
+				// Already reported for the service
+				continue
+			}
+			p := envPorts{env: envName, service: name, ports: r.Offset(env.PortOffset)}
+
+			override, overridden := env.Services[name]
+			base, inBase := c.TunnelConfig.Services[name]
+			switch {
+			case overridden && inBase && override.LocalPorts() != base.LocalPorts():
+				key := "local-port-range"
+				if override.LocalPort != 0 {
+					key = "local-port"
+				}
+				p.own = true
+				p.path = envPath + ".services." + name + "." + key
+				p.node = lookupKey(root, "environments", envName, "services", name, key)
+			case env.PortOffset != 0:
+				p.own = true
+				p.path = envPath + ".port-offset"
+				p.node = lookupKey(root, "environments", envName, "port-offset")
+			}
+
+			if !p.ports.valid() {
+				v.add(lookupKey(root, "environments", envName, "port-offset"), envPath+".port-offset",
+					"moves %s to ports %s, outside 1-65535", name, p.ports)
+				continue
+			}
+			all = append(all, p)
+		}
+	}
+
+	// Report each collision once, on the later environment unless only the
+	// earlier one chose its ports
+	for i, p := range all {
+		for _, o := range all[:i] {
+			if p.env == o.env || (!p.own && !o.own) {
+				continue
+			}
+			if p.ports.Start > o.ports.End || o.ports.Start > p.ports.End {
+				continue
+			}
+			target, other := p, o
+			if !p.own {
+				target, other = o, p
+			}
+			v.add(target.node, target.path, "%s ports %s overlap %s %s (%s)",
+				target.service, target.ports, other.env, other.service, other.ports)
+		}
+	}
+}
+
+// valid reports whether the range is within 1-65535 and not reversed
+func (r PortRange) valid() bool {
+	return r.Start >= 1 && r.End <= 65535 && r.Start <= r.End
+}
+
+// checkPortRange validates a local port range and reports whether it is
+// valid. Problems are only reported when report is set.
+func (v *validator) checkPortRange(r PortRange, path string, at func(keys ...string) *yaml.Node, report bool) bool {
+	valid := true
+	for _, p := range []struct {
+		key  string
+		port int
+	}{{"start", r.Start}, {"end", r.End}} {
+		if p.port < 1 || p.port > 65535 {
+			if report {
+				v.add(at("local-port-range", p.key), path+"."+p.key, "port %d is outside 1-65535", p.port)
+			}
+			valid = false
+		}
+	}
+	if valid && r.Start > r.End {
+		if report {
+			v.add(at("local-port-range"), path, "start %d is greater than end %d", r.Start, r.End)
+		}
+		valid = false
+	}
+	return valid
+}
+
+// checkValue validates a config value
+func (v *validator) checkValue(cv ConfigValue, path string, node *yaml.Node) {
+	if cv.Value != "" && cv.SSMParam != "" {
+		v.add(node, path, "cannot specify both value and ssm_param")
+	}
+}
+
+// checkFields reports keys in node that do not match a yaml field of t
+func (v *validator) checkFields(node *yaml.Node, t reflect.Type, path string) {
+	if node == nil {
+		return
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok {
+				v.add(key, joinPath(path, key.Value), "unknown field %q", key.Value)
+				continue
+			}
+			v.checkFields(value, field.Type, joinPath(path, key.Value))
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.checkFields(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value))
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			v.checkFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// yamlFields maps the yaml keys of a struct to its fields
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// lookupNode returns the value at keys below a mapping node, or nil
+func lookupNode(node *yaml.Node, keys ...string) *yaml.Node {
+	for _, key := range keys {
+		if _, node = lookupEntry(node, key); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// lookupKey returns the key node of the last of keys below a mapping node,
+// or nil
+func lookupKey(node *yaml.Node, keys ...string) *yaml.Node {
+	if len(keys) == 0 {
+		return nil
+	}
+	parent := lookupNode(node, keys[:len(keys)-1]...)
+	k, _ := lookupEntry(parent, keys[len(keys)-1])
+	return k
+}
+
+// lookupEntry returns the key and value nodes of key in a mapping node
+func lookupEntry(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil {
+		return nil, nil
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,401 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, content string) *Config {
+	t.Helper()
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	return cfg
+}
+
+func TestValidateValidConfig(t *testing.T) {
+	cfg := loadTestConfig(t, `aws:
+  default_region: eu-central-1
+  profile: default
+vars:
+  app: billing
+tunnel-go-config:
+  placeholder: env
+  jumphost-filter: ${ENV}-jumphost
+  services:
+    database:
+      host:
+        ssm_param: /${ENV}/${app}/host
+      remote-port:
+        value: "${port}"
+      local-port-range:
+        start: 5000
+        end: 5009
+      service-details:
+        - /${ENV}/${app}/user
+environments:
+  prod:
+    region: us-east-1
+    services:
+      database:
+        host:
+          value: prod-db
+`)
+
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	if cfg.Region() != "eu-central-1" {
+		t.Errorf("Region() = %q, want eu-central-1 from aws.default_region", cfg.Region())
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := loadTestConfig(t, `tunnel-go-config:
+  concurrency: -1
+  services:
+    database:
+      host:
+        value: db
+        ssm_param: /db/host
+      remote_port:
+        value: "3306"
+      local-port-range:
+        start: 5010
+        end: 5000
+    redis:
+      host:
+        value: redis
+      remote-port:
+        value: "http"
+      local-port-range:
+        start: 5000
+        end: 70000
+    search:
+      host:
+        value: search
+      remote-port:
+        value: "443"
+      local-port-range:
+        start: 6000
+        end: 6009
+environments:
+  prod:
+    regoin: us-east-1
+    services:
+      cache:
+        host:
+          value: cache
+        remote-port:
+          value: "6379"
+        local-port-range:
+          start: 6005
+          end: 6010
+`)
+
+	err := cfg.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate() error = %v, want ValidationErrors", err)
+	}
+
+	want := []ValidationError{
+		{Line: 2, Column: 3, Path: "tunnel-go-config.concurrency", Message: "must not be negative"},
+		{Line: 5, Column: 7, Path: "tunnel-go-config.services.database.host", Message: "cannot specify both value and ssm_param"},
+		{Line: 8, Column: 7, Path: "tunnel-go-config.services.database.remote_port", Message: `unknown field "remote_port"`},
+		{Line: 10, Column: 7, Path: "tunnel-go-config.services.database.local-port-range", Message: "start 5010 is greater than end 5000"},
+		{Line: 17, Column: 9, Path: "tunnel-go-config.services.redis.remote-port.value", Message: `port "http" is not a number between 1 and 65535`},
+		{Line: 20, Column: 9, Path: "tunnel-go-config.services.redis.local-port-range.end", Message: "port 70000 is outside 1-65535"},
+		{Line: 31, Column: 5, Path: "environments.prod.regoin", Message: `unknown field "regoin"`},
+		{Line: 38, Column: 9, Path: "environments.prod.services.cache.local-port-range", Message: "port range 6005-6010 overlaps search (6000-6009)"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Validate() returned %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Errorf("error %d = %+v, want %+v", i, errs[i], want[i])
+		}
+	}
+}
+
+func TestValidateWithoutFile(t *testing.T) {
+	cfg := &Config{}
+	cfg.TunnelConfig.Services = map[string]ServiceConfig{
+		"database": {LocalPortRange: PortRange{Start: 5000, End: 5009}},
+		"redis":    {LocalPortRange: PortRange{Start: 5005, End: 5006}},
+	}
+
+	err := cfg.Validate()
+	if err == nil || err.Error() != "tunnel-go-config.services.redis.local-port-range: port range 5005-5006 overlaps database (5000-5009)" {
+		t.Errorf("Validate() error = %v, want overlap without position", err)
+	}
+}
+
+func TestValidateBindAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		allow   bool
+		wantErr string
+	}{
+		{name: "ipv4 loopback", address: "127.0.0.1"},
+		{name: "ipv6 loopback", address: "::1"},
+		{name: "all interfaces", address: "0.0.0.0", wantErr: "tunnel-go-config.bind-address: 0.0.0.0 is reachable from other hosts, set allow-external-bind to use it"},
+		{name: "all interfaces allowed", address: "0.0.0.0", allow: true},
+		{name: "hostname", address: "localhost", wantErr: `tunnel-go-config.bind-address: "localhost" is not an IP address`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.TunnelConfig.BindAddress = tt.address
+			cfg.TunnelConfig.AllowExternalBind = tt.allow
+
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Validate() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateLocalPort(t *testing.T) {
+	cfg := loadTestConfig(t, `tunnel-go-config:
+  services:
+    database:
+      host:
+        value: db
+      remote-port:
+        value: "5432"
+      local-port: 5432
+    search:
+      host:
+        value: search
+      remote-port:
+        value: "443"
+      local-port-range:
+        start: 5400
+        end: 5499
+environments:
+  prod:
+    services:
+      database:
+        local-port: 70000
+`)
+
+	err := cfg.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate() error = %v, want ValidationErrors", err)
+	}
+
+	want := []ValidationError{
+		{Line: 14, Column: 7, Path: "tunnel-go-config.services.search.local-port-range", Message: "port range 5400-5499 overlaps database (5432)"},
+		{Line: 21, Column: 9, Path: "environments.prod.services.database.local-port", Message: "port 70000 is outside 1-65535"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Validate() returned %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Errorf("error %d = %+v, want %+v", i, errs[i], want[i])
+		}
+	}
+}
+
+func TestValidateEnvironmentPorts(t *testing.T) {
+	cfg := loadTestConfig(t, `tunnel-go-config:
+  services:
+    database:
+      host:
+        value: db
+      remote-port:
+        value: "5432"
+      local-port-range:
+        start: 5000
+        end: 5009
+    search:
+      host:
+        value: search
+      remote-port:
+        value: "443"
+      local-port-range:
+        start: 5010
+        end: 5019
+environments:
+  dev:
+    region: eu-west-1
+  prod:
+    services:
+      search:
+        local-port-range:
+          start: 25005
+          end: 25014
+  staging:
+    port-offset: 20000
+  test:
+    port-offset: 60530
+`)
+
+	err := cfg.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate() error = %v, want ValidationErrors", err)
+	}
+
+	// dev shares the base ports with the environments that did not choose
+	// their own
+	want := []ValidationError{
+		{Line: 29, Column: 5, Path: "environments.staging.port-offset", Message: "database ports 25000-25009 overlap prod search (25005-25014)"},
+		{Line: 29, Column: 5, Path: "environments.staging.port-offset", Message: "search ports 25010-25019 overlap prod search (25005-25014)"},
+		{Line: 31, Column: 5, Path: "environments.test.port-offset", Message: "moves database to ports 65530-65539, outside 1-65535"},
+		{Line: 31, Column: 5, Path: "environments.test.port-offset", Message: "moves search to ports 65540-65549, outside 1-65535"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Validate() returned %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Errorf("error %d = %+v, want %+v", i, errs[i], want[i])
+		}
+	}
+}
+
+func TestValidateJumphost(t *testing.T) {
+	cfg := loadTestConfig(t, `tunnel-go-config:
+  jumphost-strategy: least-used
+environments:
+  dev:
+    jumphost-strategy: nearest
+  prod:
+    jumphost: bastion-1
+`)
+
+	err := cfg.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate() error = %v, want ValidationErrors", err)
+	}
+
+	want := []ValidationError{
+		{Line: 5, Column: 5, Path: "environments.dev.jumphost-strategy", Message: `unknown strategy "nearest", want one of random, first-by-launch-time, same-az, least-used`},
+		{Line: 7, Column: 5, Path: "environments.prod.jumphost", Message: `"bastion-1" is not an instance ID`},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Validate() returned %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Errorf("error %d = %+v, want %+v", i, errs[i], want[i])
+		}
+	}
+}
+
+func TestValidateJumphostFilter(t *testing.T) {
+	cfg := loadTestConfig(t, `tunnel-go-config:
+  jumphost-filter:
+    - name: tag:Role
+      values: [bastion]
+    - name: instance-state-name
+      values: [stopped]
+    - name: vpc-id
+environments:
+  dev:
+    jumphost-filter: dev-bastion-*
+  prod:
+    jumphost-filter:
+      - name: "tag:"
+        values: [x]
+      - name: subnet-id
+        values: [subnet-1]
+        value: subnet-2
+`)
+
+	err := cfg.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate() error = %v, want ValidationErrors", err)
+	}
+
+	names := "tag-key, vpc-id, subnet-id, availability-zone, instance-type, image-id, iam-instance-profile.arn"
+	want := []ValidationError{
+		{Line: 5, Column: 7, Path: "tunnel-go-config.jumphost-filter[1].name", Message: `unknown filter "instance-state-name", want tag:<key> or one of ` + names},
+		{Line: 7, Column: 7, Path: "tunnel-go-config.jumphost-filter[2].values", Message: "must list at least one value"},
+		{Line: 13, Column: 9, Path: "environments.prod.jumphost-filter[0].name", Message: `unknown filter "tag:", want tag:<key> or one of ` + names},
+		{Line: 17, Column: 9, Path: "environments.prod.jumphost-filter[1].value", Message: `unknown field "value"`},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Validate() returned %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Errorf("error %d = %+v, want %+v", i, errs[i], want[i])
+		}
+	}
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	cfg := loadTestConfig(t, `tunnel-go-config:
+  services:
+    api:
+      host:
+        value: api
+      remote-port:
+        value: "443"
+      local-port-range:
+        start: 8443
+        end: 8443
+      health-check:
+        type: https
+        path: healthz
+        status: 600
+    cache:
+      host:
+        value: cache
+      remote-port:
+        value: "6379"
+      local-port-range:
+        start: 6379
+        end: 6379
+      health-check:
+        type: ping
+        timeout: -1s
+        status: 200
+`)
+
+	err := cfg.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate() error = %v, want ValidationErrors", err)
+	}
+
+	want := []ValidationError{
+		{Line: 13, Column: 9, Path: "tunnel-go-config.services.api.health-check.path", Message: `"healthz" does not start with /`},
+		{Line: 14, Column: 9, Path: "tunnel-go-config.services.api.health-check.status", Message: "600 is not an HTTP status"},
+		{Line: 24, Column: 9, Path: "tunnel-go-config.services.cache.health-check.type", Message: `unknown check "ping", want one of tcp, tls, http, https, redis, mysql, postgres`},
+		{Line: 25, Column: 9, Path: "tunnel-go-config.services.cache.health-check.timeout", Message: "must not be negative"},
+		{Line: 26, Column: 9, Path: "tunnel-go-config.services.cache.health-check.status", Message: "only applies to http and https checks"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Validate() returned %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Errorf("error %d = %+v, want %+v", i, errs[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Built-in template variables
+const (
+	VarEnv       = "ENV"
+	VarRegion    = "REGION"
+	VarService   = "SERVICE"
+	VarAccountID = "ACCOUNT_ID"
+
+	// VarPlaceholder is the original name of ${ENV}, kept so existing
+	// configuration files keep working
+	VarPlaceholder = "PLACEHOLDER"
+
+	envVarPrefix = "env:"
+)
+
+// varPattern matches ${NAME} references
+var varPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// Vars resolves ${NAME} references in configuration values. Names resolve,
+// in order of precedence, to values set with Set, to values computed on first
+// use by functions registered with SetFunc, and ${env:NAME} to the NAME
+// environment variable. Values may themselves reference other variables.
+type Vars struct {
+	values map[string]string
+	funcs  map[string]func() (string, error)
+
+	mu       sync.Mutex
+	resolved map[string]string
+}
+
+// NewVars returns an empty set of variables
+func NewVars() *Vars {
+	return &Vars{
+		values:   make(map[string]string),
+		funcs:    make(map[string]func() (string, error)),
+		resolved: make(map[string]string),
+	}
+}
+
+// Vars returns the template variables for env in region: the built-in
+// ${ENV}, ${PLACEHOLDER} and ${REGION}, the name configured as placeholder,
+// the vars section of the config and finally overrides, typically from -var
+// flags. Call it on the configuration returned by ForEnvironment so the
+// environment's vars apply.
+func (c *Config) Vars(env, region string, overrides map[string]string) *Vars {
+	v := NewVars()
+	v.Set(VarEnv, env)
+	v.Set(VarPlaceholder, env)
+	if c.TunnelConfig.Placeholder != "" {
+		v.Set(c.TunnelConfig.Placeholder, env)
+	}
+	if region != "" {
+		v.Set(VarRegion, region)
+	}
+	for name, value := range c.Variables {
+		v.Set(name, value)
+	}
+	for name, value := range overrides {
+		v.Set(name, value)
+	}
+	return v
+}
+
+// Set sets a variable
+func (v *Vars) Set(name, value string) {
+	v.values[name] = value
+}
+
+// SetFunc registers a function computing a variable the first time it is
+// used, for values that are expensive to look up
+func (v *Vars) SetFunc(name string, fn func() (string, error)) {
+	v.funcs[name] = fn
+}
+
+// With returns a copy of the variables with name set to value. Values
+// computed by functions so far are shared with the copy.
+func (v *Vars) With(name, value string) *Vars {
+	c := &Vars{
+		values:   make(map[string]string, len(v.values)+1),
+		funcs:    v.funcs,
+		resolved: make(map[string]string),
+	}
+	for k, val := range v.values {
+		c.values[k] = val
+	}
+	c.values[name] = value
+
+	v.mu.Lock()
+	for k, val := range v.resolved {
+		c.resolved[k] = val
+	}
+	v.mu.Unlock()
+	return c
+}
+
+// Expand replaces every ${NAME} reference in s. It fails listing every
+// reference that could not be resolved rather than leaving any in place.
+func (v *Vars) Expand(s string) (string, error) {
+	var unresolved []string
+	var errs []string
+	out := v.expand(s, nil, &unresolved, &errs)
+	if len(errs) > 0 {
+		return "", fmt.Errorf("failed to expand %q: %s", s, strings.Join(errs, "; "))
+	}
+	if len(unresolved) > 0 {
+		sort.Strings(unresolved)
+		return "", fmt.Errorf("unresolved variables in %q: %s", s, strings.Join(unresolved, ", "))
+	}
+	return out, nil
+}
+
+// expand replaces references in s, recording unresolved names and errors.
+// stack holds the variables being expanded, to detect cycles.
+func (v *Vars) expand(s string, stack []string, unresolved, errs *[]string) string {
+	return varPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+
+		for _, n := range stack {
+			if n == name {
+				*errs = append(*errs, fmt.Sprintf("variable %s references itself", ref))
+				return ref
+			}
+		}
+
+		value, ok, err := v.lookup(name)
+		if err != nil {
+			*errs = append(*errs, fmt.Sprintf("failed to resolve %s: %v", ref, err))
+			return ref
+		}
+		if !ok {
+			for _, u := range *unresolved {
+				if u == ref {
+					return ref
+				}
+			}
+			*unresolved = append(*unresolved, ref)
+			return ref
+		}
+		return v.expand(value, append(stack, name), unresolved, errs)
+	})
+}
+
+// lookup returns the unexpanded value of a variable
+func (v *Vars) lookup(name string) (string, bool, error) {
+	if strings.HasPrefix(name, envVarPrefix) {
+		value, ok := os.LookupEnv(strings.TrimPrefix(name, envVarPrefix))
+		return value, ok, nil
+	}
+	if value, ok := v.values[name]; ok {
+		return value, true, nil
+	}
+
+	fn, ok := v.funcs[name]
+	if !ok {
+		return "", false, nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if value, ok := v.resolved[name]; ok {
+		return value, true, nil
+	}
+	value, err := fn()
+	if err != nil {
+		return "", false, err
+	}
+	v.resolved[name] = value
+	return value, true, nil
+}
+
+// ParseVarFlags parses KEY=VALUE pairs as given to -var
+func ParseVarFlags(flags []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, f := range flags {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid variable %q, expected KEY=VALUE", f)
+		}
+		vars[name] = value
+	}
+	return vars, nil
+}
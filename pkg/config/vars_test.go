@@ -0,0 +1,99 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVarsExpand(t *testing.T) {
+	t.Setenv("TUNNEL_GO_TEST_TEAM", "payments")
+
+	cfg := &Config{Variables: map[string]string{
+		"app":    "billing",
+		"prefix": "/${ENV}/${app}",
+		"REGION": "overridden-by-flag",
+	}}
+	cfg.TunnelConfig.Placeholder = "environment"
+
+	accountCalls := 0
+	vars := cfg.Vars("prod", "eu-west-1", map[string]string{"REGION": "us-east-1"})
+	vars.SetFunc(VarAccountID, func() (string, error) {
+		accountCalls++
+		return "123456789012", nil
+	})
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{name: "Built-in", input: "/${ENV}/${REGION}/db", want: "/prod/us-east-1/db"},
+		{name: "Legacy placeholder", input: "${PLACEHOLDER}-${environment}", want: "prod-prod"},
+		{name: "Nested user variable", input: "${prefix}/host", want: "/prod/billing/host"},
+		{name: "Environment variable", input: "/${env:TUNNEL_GO_TEST_TEAM}/db", want: "/payments/db"},
+		{name: "Lazy variable", input: "arn:aws:ssm:${REGION}:${ACCOUNT_ID}:x", want: "arn:aws:ssm:us-east-1:123456789012:x"},
+		{name: "No variables", input: "plain", want: "plain"},
+		{name: "Unresolved", input: "/${FOO}/${SERVICE}/${FOO}/${env:TUNNEL_GO_TEST_UNSET}", wantErr: "${FOO}, ${SERVICE}, ${env:TUNNEL_GO_TEST_UNSET}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := vars.Expand(tt.input)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expand() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expand() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// ACCOUNT_ID is looked up once and shared with copies
+	if got, err := vars.With(VarService, "database").Expand("${SERVICE}@${ACCOUNT_ID}"); err != nil || got != "database@123456789012" {
+		t.Errorf("With().Expand() = %q, %v", got, err)
+	}
+	if accountCalls != 1 {
+		t.Errorf("ACCOUNT_ID looked up %d times, want 1", accountCalls)
+	}
+	if _, err := vars.Expand("${SERVICE}"); err == nil {
+		t.Error("With() modified the original variables")
+	}
+}
+
+func TestVarsExpandErrors(t *testing.T) {
+	vars := NewVars()
+	vars.Set("a", "${b}")
+	vars.Set("b", "${a}")
+	vars.SetFunc(VarAccountID, func() (string, error) { return "", errors.New("no credentials") })
+
+	if _, err := vars.Expand("${a}"); err == nil || !strings.Contains(err.Error(), "references itself") {
+		t.Errorf("Expand() error = %v, want cycle error", err)
+	}
+	if _, err := vars.Expand("${ACCOUNT_ID}"); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("Expand() error = %v, want lookup error", err)
+	}
+}
+
+func TestParseVarFlags(t *testing.T) {
+	vars, err := ParseVarFlags([]string{"app=billing", "query=a=b", "empty="})
+	if err != nil {
+		t.Fatalf("ParseVarFlags() error = %v", err)
+	}
+	if vars["app"] != "billing" || vars["query"] != "a=b" || vars["empty"] != "" {
+		t.Errorf("ParseVarFlags() = %v", vars)
+	}
+
+	for _, bad := range []string{"novalue", "=value"} {
+		if _, err := ParseVarFlags([]string{bad}); err == nil {
+			t.Errorf("ParseVarFlags(%q) expected error", bad)
+		}
+	}
+}
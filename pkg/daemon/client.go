@@ -0,0 +1,78 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	dialTimeout = 2 * time.Second
+
+	// responseTimeout covers add requests, which start SSM sessions
+	responseTimeout = 2 * time.Minute
+)
+
+// ErrNotRunning is returned when no daemon is listening on the socket
+var ErrNotRunning = errors.New("daemon not running")
+
+// Client sends requests to a running daemon
+type Client struct {
+	socketPath string
+}
+
+// NewClient creates a client for the daemon listening on socketPath
+func NewClient(socketPath string) *Client {
+	return &Client{socketPath: socketPath}
+}
+
+// Do sends a request and waits for the response. A response reporting a
+// failure is returned together with an error carrying its message.
+func (c *Client) Do(req Request) (*Response, error) {
+	conn, err := net.DialTimeout("unix", c.socketPath, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotRunning, err)
+	}
+	defer conn.Close()
+
+	timeout := responseTimeout
+	if req.Timeout > timeout {
+		timeout = req.Timeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if !resp.OK {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// Ping checks that the daemon is running
+func (c *Client) Ping() (*Response, error) {
+	return c.Do(Request{Command: CommandPing})
+}
+
+// Add creates tunnels for services on the daemon. A non-zero timeout makes
+// the daemon stop creating them once it expires.
+func (c *Client) Add(env string, services []string, timeout time.Duration) (*Response, error) {
+	return c.Do(Request{Command: CommandAdd, Env: env, Services: services, Timeout: timeout})
+}
+
+// Remove closes the daemon's tunnels for services
+func (c *Client) Remove(services []string) (*Response, error) {
+	return c.Do(Request{Command: CommandRemove, Services: services})
+}
+
+// List returns the daemon's active tunnels
+func (c *Client) List() (*Response, error) {
+	return c.Do(Request{Command: CommandList})
+}
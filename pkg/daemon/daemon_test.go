@@ -0,0 +1,227 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tunnel-go/pkg/tunnel"
+)
+
+type fakeManager struct {
+	env       string
+	createErr error
+	// block makes CreateTunnelsContext wait for its context to be done
+	block bool
+
+	mu      sync.Mutex
+	tunnels map[string]tunnel.TunnelStatus
+}
+
+func (f *fakeManager) Env() string { return f.env }
+
+func (f *fakeManager) CreateTunnelsContext(ctx context.Context, services []string) error {
+	if f.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if f.createErr != nil {
+		return f.createErr
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, s := range services {
+		f.tunnels[s] = tunnel.TunnelStatus{Service: s, LocalPort: 5000 + i}
+	}
+	return nil
+}
+
+func (f *fakeManager) CloseTunnels(ctx context.Context, services []string) []tunnel.CleanupResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var results []tunnel.CleanupResult
+	for _, s := range services {
+		result := tunnel.CleanupResult{Service: s}
+		if _, ok := f.tunnels[s]; !ok {
+			result.Err = errors.New("no active tunnel")
+		}
+		delete(f.tunnels, s)
+		results = append(results, result)
+	}
+	return results
+}
+
+func (f *fakeManager) Tunnels() []tunnel.TunnelStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var statuses []tunnel.TunnelStatus
+	for _, st := range f.tunnels {
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+func startServer(t *testing.T, manager Manager) *Client {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "test.sock")
+	server, err := Listen(socket, manager, nil)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return NewClient(socket)
+}
+
+func TestServerAddListRemove(t *testing.T) {
+	manager := &fakeManager{env: "dev", tunnels: map[string]tunnel.TunnelStatus{}}
+	client := startServer(t, manager)
+
+	resp, err := client.Ping()
+	if err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	if resp.PID != os.Getpid() || resp.Env != "dev" {
+		t.Errorf("Ping() = pid %d env %s, want pid %d env dev", resp.PID, resp.Env, os.Getpid())
+	}
+
+	if _, err := client.Add("dev", []string{"database"}, 0); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	resp, err = client.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(resp.Tunnels) != 1 || resp.Tunnels[0].Service != "database" {
+		t.Errorf("List() tunnels = %+v, want database", resp.Tunnels)
+	}
+
+	resp, err = client.Remove([]string{"database", "redis"})
+	if err == nil {
+		t.Error("Remove() expected error for redis without a tunnel")
+	}
+	if resp == nil || len(resp.Results) != 2 {
+		t.Fatalf("Remove() results = %+v, want two results", resp)
+	}
+	if resp.Results[0].Error != "" || resp.Results[1].Error == "" {
+		t.Errorf("Remove() results = %+v, want database closed and redis failed", resp.Results)
+	}
+}
+
+func TestServerRejectsOtherEnvironment(t *testing.T) {
+	manager := &fakeManager{env: "dev", tunnels: map[string]tunnel.TunnelStatus{}}
+	client := startServer(t, manager)
+
+	resp, err := client.Add("prod", []string{"database"}, 0)
+	if err == nil || !strings.Contains(err.Error(), "environment dev") {
+		t.Errorf("Add() error = %v, want environment mismatch", err)
+	}
+	if resp == nil || resp.Reason != tunnel.ReasonConfig {
+		t.Errorf("Add() = %+v, want reason %q", resp, tunnel.ReasonConfig)
+	}
+}
+
+func TestServerAddFailureReason(t *testing.T) {
+	manager := &fakeManager{env: "dev", createErr: fmt.Errorf("failed to find available port for database: %w", tunnel.ErrNoPort)}
+	client := startServer(t, manager)
+
+	resp, err := client.Add("dev", []string{"database"}, 0)
+	if err == nil || resp == nil {
+		t.Fatalf("Add() = %+v, %v, want an error", resp, err)
+	}
+	if resp.Reason != tunnel.ReasonPorts {
+		t.Errorf("Add() reason = %q, want %q", resp.Reason, tunnel.ReasonPorts)
+	}
+}
+
+func TestServerAddTimeout(t *testing.T) {
+	manager := &fakeManager{env: "dev", block: true}
+	client := startServer(t, manager)
+
+	resp, err := client.Add("dev", []string{"database"}, 50*time.Millisecond)
+	if err == nil || resp == nil {
+		t.Fatalf("Add() = %+v, %v, want an error", resp, err)
+	}
+	if resp.Reason != ReasonTimeout {
+		t.Errorf("Add() reason = %q, want %q", resp.Reason, ReasonTimeout)
+	}
+}
+
+func TestServerUnknownCommand(t *testing.T) {
+	client := startServer(t, &fakeManager{env: "dev"})
+
+	if _, err := client.Do(Request{Command: "explode"}); err == nil {
+		t.Error("Do() expected error for unknown command")
+	}
+}
+
+func TestClientNotRunning(t *testing.T) {
+	client := NewClient(filepath.Join(t.TempDir(), "missing.sock"))
+	if _, err := client.Ping(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Ping() error = %v, want ErrNotRunning", err)
+	}
+}
+
+func TestAcquirePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.pid")
+
+	pidFile, err := AcquirePIDFile(path)
+	if err != nil {
+		t.Fatalf("AcquirePIDFile() error = %v", err)
+	}
+	if pid, err := ReadPID(path); err != nil || pid != os.Getpid() {
+		t.Errorf("ReadPID() = %d, %v, want %d", pid, err, os.Getpid())
+	}
+
+	// The current process is running, so a second daemon is refused
+	if _, err := AcquirePIDFile(path); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("second AcquirePIDFile() error = %v, want ErrAlreadyRunning", err)
+	}
+
+	if err := pidFile.Release(); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("pidfile still exists after Release()")
+	}
+}
+
+func TestAcquirePIDFileReplacesStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.pid")
+	if err := os.WriteFile(path, []byte("999999999\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pidFile, err := AcquirePIDFile(path)
+	if err != nil {
+		t.Fatalf("AcquirePIDFile() error = %v", err)
+	}
+	defer pidFile.Release()
+
+	if pid, _ := ReadPID(path); pid != os.Getpid() {
+		t.Errorf("ReadPID() = %d, want %d", pid, os.Getpid())
+	}
+}
+
+func TestPathsForDiffersPerConfig(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	a, err := PathsFor("/etc/tunnel-go/a.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := PathsFor("/etc/tunnel-go/b.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Socket == b.Socket || a.PIDFile == b.PIDFile {
+		t.Errorf("PathsFor() returned the same paths for different configs: %+v", a)
+	}
+}
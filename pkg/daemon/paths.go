@@ -0,0 +1,52 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Paths locates the files belonging to the daemon for one config file
+type Paths struct {
+	Dir     string
+	Socket  string
+	PIDFile string
+	LogFile string
+}
+
+// RuntimeDir returns the directory holding daemon sockets and pidfiles
+func RuntimeDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "tunnel-go"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".tunnel-go", "run"), nil
+}
+
+// PathsFor returns the daemon paths for a config file. Each config file gets
+// its own daemon, identified by a hash of its absolute path.
+func PathsFor(configPath string) (Paths, error) {
+	abs, err := filepath.Abs(configPath)
+	if err != nil {
+		return Paths{}, fmt.Errorf("failed to resolve config path: %w", err)
+	}
+
+	dir, err := RuntimeDir()
+	if err != nil {
+		return Paths{}, err
+	}
+
+	sum := sha256.Sum256([]byte(abs))
+	key := hex.EncodeToString(sum[:6])
+	return Paths{
+		Dir:     dir,
+		Socket:  filepath.Join(dir, key+".sock"),
+		PIDFile: filepath.Join(dir, key+".pid"),
+		LogFile: filepath.Join(dir, key+".log"),
+	}, nil
+}
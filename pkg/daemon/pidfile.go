@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"tunnel-go/pkg/process"
+)
+
+// ErrAlreadyRunning is returned when another daemon holds the pidfile
+var ErrAlreadyRunning = errors.New("daemon already running")
+
+// PIDFile is an exclusively held pidfile
+type PIDFile struct {
+	path string
+}
+
+// AcquirePIDFile creates the pidfile with the current process ID. A pidfile
+// left behind by a process that is no longer running is replaced.
+func AcquirePIDFile(path string) (*PIDFile, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("failed to write pidfile %s: %w", path, err)
+			}
+			return &PIDFile{path: path}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create pidfile %s: %w", path, err)
+		}
+
+		pid, err := ReadPID(path)
+		if err == nil && process.Running(pid) {
+			return nil, fmt.Errorf("%w with pid %d", ErrAlreadyRunning, pid)
+		}
+
+		// Stale pidfile from a daemon that did not shut down cleanly
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove stale pidfile %s: %w", path, err)
+		}
+	}
+	return nil, fmt.Errorf("failed to acquire pidfile %s", path)
+}
+
+// Release removes the pidfile
+func (p *PIDFile) Release() error {
+	if err := os.Remove(p.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove pidfile %s: %w", p.path, err)
+	}
+	return nil
+}
+
+// ReadPID reads the process ID stored in a pidfile
+func ReadPID(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pidfile %s: %w", path, err)
+	}
+	return pid, nil
+}
@@ -0,0 +1,50 @@
+package daemon
+
+import (
+	"time"
+
+	"tunnel-go/pkg/tunnel"
+)
+
+// Commands understood by the control socket
+const (
+	CommandPing   = "ping"
+	CommandAdd    = "add"
+	CommandRemove = "remove"
+	CommandList   = "list"
+)
+
+// ReasonTimeout is the Reason of an add request whose tunnels were not all
+// created within its Timeout
+const ReasonTimeout = "timeout"
+
+// Request is a single JSON request sent over the control socket
+type Request struct {
+	Command string `json:"command"`
+	// Env must match the daemon's environment for add requests
+	Env      string   `json:"env,omitempty"`
+	Services []string `json:"services,omitempty"`
+	// Timeout bounds the creation of the tunnels of an add request. Tunnels
+	// created before it expires are kept.
+	Timeout time.Duration `json:"timeout_ns,omitempty"`
+}
+
+// Response is the JSON answer to a Request
+type Response struct {
+	OK      bool                  `json:"ok"`
+	Error   string                `json:"error,omitempty"`
+	PID     int                   `json:"pid,omitempty"`
+	Env     string                `json:"env,omitempty"`
+	Tunnels []tunnel.TunnelStatus `json:"tunnels,omitempty"`
+	Results []Result              `json:"results,omitempty"`
+	// Reason is the kind of failure of an add request, as returned by
+	// tunnel.FailureReason, or ReasonTimeout
+	Reason string `json:"reason,omitempty"`
+}
+
+// Result is the outcome of an operation on a single service
+type Result struct {
+	Service string `json:"service"`
+	Error   string `json:"error,omitempty"`
+	Forced  bool   `json:"forced,omitempty"`
+}
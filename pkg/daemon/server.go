@@ -0,0 +1,170 @@
+// Package daemon runs a tunnel manager in the background and exposes it
+// through a Unix domain socket speaking a line based JSON protocol.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"tunnel-go/pkg/tunnel"
+)
+
+const (
+	// requestReadTimeout bounds how long a client may take to send its request
+	requestReadTimeout = 10 * time.Second
+
+	// removeTimeout bounds closing tunnels for a remove request
+	removeTimeout = 15 * time.Second
+)
+
+// Manager is the part of tunnel.Manager controlled through the socket
+type Manager interface {
+	Env() string
+	CreateTunnelsContext(ctx context.Context, services []string) error
+	CloseTunnels(ctx context.Context, services []string) []tunnel.CleanupResult
+	Tunnels() []tunnel.TunnelStatus
+}
+
+// Server answers control requests for a running manager
+type Server struct {
+	manager  Manager
+	listener net.Listener
+	log      *slog.Logger
+}
+
+// Listen creates the control socket. The caller must hold the daemon's
+// pidfile, so any existing socket file is left over from a previous daemon.
+// Requests are logged to logger, or to the default logger when it is nil.
+func Listen(socketPath string, manager Manager, logger *slog.Logger) (*Server, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %w", socketPath, err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %w", err)
+	}
+
+	return &Server{
+		manager:  manager,
+		listener: listener,
+		log:      logger,
+	}, nil
+}
+
+// Serve handles connections until the server is closed
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept control connection: %w", err)
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting requests and removes the socket
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// handle answers a single request
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(requestReadTimeout))
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		s.reply(conn, Response{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s.log.Debug("Control request", "command", req.Command, "services", req.Services)
+	s.reply(conn, s.dispatch(req))
+}
+
+// reply writes a response, logging failures since the client may have gone away
+func (s *Server) reply(conn net.Conn, resp Response) {
+	resp.PID = os.Getpid()
+	resp.Env = s.manager.Env()
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		s.log.Debug("Failed to send control response", "error", err)
+	}
+}
+
+// dispatch runs a request against the manager
+func (s *Server) dispatch(req Request) Response {
+	switch req.Command {
+	case CommandPing:
+		return Response{OK: true}
+
+	case CommandList:
+		return Response{OK: true, Tunnels: s.manager.Tunnels()}
+
+	case CommandAdd:
+		if len(req.Services) == 0 {
+			return Response{Error: "no services specified"}
+		}
+		if req.Env != "" && req.Env != s.manager.Env() {
+			return Response{Error: fmt.Sprintf("daemon is running for environment %s, not %s", s.manager.Env(), req.Env), Reason: tunnel.ReasonConfig}
+		}
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if req.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		}
+		defer cancel()
+		if err := s.manager.CreateTunnelsContext(ctx, req.Services); err != nil {
+			reason := tunnel.FailureReason(err)
+			if ctx.Err() != nil {
+				reason = ReasonTimeout
+			}
+			return Response{Error: err.Error(), Reason: reason, Tunnels: s.manager.Tunnels()}
+		}
+		return Response{OK: true, Tunnels: s.manager.Tunnels()}
+
+	case CommandRemove:
+		if len(req.Services) == 0 {
+			return Response{Error: "no services specified"}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+		defer cancel()
+
+		resp := Response{OK: true}
+		for _, r := range s.manager.CloseTunnels(ctx, req.Services) {
+			result := Result{Service: r.Service, Forced: r.Forced}
+			if r.Err != nil {
+				result.Error = r.Err.Error()
+				resp.OK = false
+			}
+			resp.Results = append(resp.Results, result)
+		}
+		if !resp.OK {
+			resp.Error = "one or more tunnels failed to close"
+		}
+		return resp
+
+	default:
+		return Response{Error: fmt.Sprintf("unknown command: %s", req.Command)}
+	}
+}
@@ -0,0 +1,36 @@
+// Package filelock serializes access to files shared by tunnel-go processes,
+// such as the port registry and the lookup cache, through a lock file.
+package filelock
+
+import (
+	"fmt"
+	"os"
+)
+
+// Lock is an exclusive lock held on a lock file
+type Lock struct {
+	file *os.File
+}
+
+// Acquire opens the lock file at path, creating it, and blocks until this
+// process holds an exclusive lock on it. The directory must exist.
+func Acquire(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := lock(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return &Lock{file: f}, nil
+}
+
+// Release releases the lock
+func (l *Lock) Release() error {
+	err := unlock(l.file)
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
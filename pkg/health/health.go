@@ -0,0 +1,231 @@
+// Package health checks that the service behind a tunnel is reachable.
+//
+// tunnel-go accepts connections on the local port itself, so connecting to
+// it proves nothing about the remote service. Each check therefore speaks
+// enough of the service's protocol to get an answer from it: a TLS
+// handshake, an HTTP response, a Redis PONG or the handshake that MySQL and
+// PostgreSQL servers start with. The plain TCP check only makes sure the
+// connection is not closed straight away, which is what happens when the
+// remote port cannot be reached.
+package health
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Types of checks
+const (
+	TypeTCP      = "tcp"
+	TypeTLS      = "tls"
+	TypeHTTP     = "http"
+	TypeHTTPS    = "https"
+	TypeRedis    = "redis"
+	TypeMySQL    = "mysql"
+	TypePostgres = "postgres"
+)
+
+// tcpSettle is how long the TCP check waits for the connection to be closed
+const tcpSettle = 500 * time.Millisecond
+
+// postgresSSLRequest is the request code asking a PostgreSQL server whether
+// it supports TLS, which it answers before any authentication
+const postgresSSLRequest = 80877103
+
+// DialFunc opens a connection to the service being checked
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// Check describes how to tell that a service is reachable
+type Check struct {
+	// Type is one of the Type constants
+	Type string
+	// ServerName is the name TLS certificates are verified against and the
+	// host HTTP requests are sent for
+	ServerName string
+	// InsecureSkipVerify accepts any TLS certificate
+	InsecureSkipVerify bool
+	// Path is the path HTTP requests are sent for, / when it is empty
+	Path string
+	// Status is the HTTP status the service must answer with, 200 when it
+	// is zero
+	Status int
+}
+
+// Run performs the check on a connection opened with dial and returns why
+// the service is not reachable. ctx bounds the whole check.
+func (c Check) Run(ctx context.Context, dial DialFunc) error {
+	if c.Type == TypeHTTP || c.Type == TypeHTTPS {
+		return c.checkHTTP(ctx, dial)
+	}
+
+	conn, err := dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	switch c.Type {
+	case TypeTCP:
+		return checkTCP(ctx, conn)
+	case TypeTLS:
+		return tls.Client(conn, c.tlsConfig()).HandshakeContext(ctx)
+	case TypeRedis:
+		return checkRedis(conn)
+	case TypeMySQL:
+		return checkMySQL(conn)
+	case TypePostgres:
+		return checkPostgres(conn)
+	default:
+		return fmt.Errorf("unknown health check %q", c.Type)
+	}
+}
+
+// tlsConfig returns the TLS settings of the check
+func (c Check) tlsConfig() *tls.Config {
+	return &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+}
+
+// checkTCP fails if the connection is closed before tcpSettle has passed
+// without the service sending anything
+func checkTCP(ctx context.Context, conn net.Conn) error {
+	deadline := time.Now().Add(tcpSettle)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	_, err := conn.Read(make([]byte, 1))
+	switch {
+	case err == nil, errors.Is(err, os.ErrDeadlineExceeded):
+		return nil
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("connection closed by the remote side")
+	default:
+		return err
+	}
+}
+
+// checkHTTP sends a GET request and compares the response status
+func (c Check) checkHTTP(ctx context.Context, dial DialFunc) error {
+	transport := &http.Transport{
+		DialContext:       func(ctx context.Context, _, _ string) (net.Conn, error) { return dial(ctx) },
+		TLSClientConfig:   c.tlsConfig(),
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		// A redirect is an answer too, and following it may leave the tunnel
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	host := c.ServerName
+	if host == "" {
+		host = "localhost"
+	}
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Type+"://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	want := c.Status
+	if want == 0 {
+		want = http.StatusOK
+	}
+	if resp.StatusCode != want {
+		return fmt.Errorf("GET %s returned %s, want %d", path, resp.Status, want)
+	}
+	return nil
+}
+
+// checkRedis sends PING. A server that requires authentication refuses it,
+// which still shows it is reachable.
+func checkRedis(conn net.Conn) error {
+	if _, err := io.WriteString(conn, "*1\r\n$4\r\nPING\r\n"); err != nil {
+		return handshakeError("redis", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return handshakeError("redis", err)
+	}
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "+PONG", strings.HasPrefix(line, "-NOAUTH"):
+		return nil
+	case strings.HasPrefix(line, "-"):
+		return fmt.Errorf("redis replied %s", line[1:])
+	default:
+		return fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
+
+// checkMySQL reads the initial handshake packet the server sends on connect
+func checkMySQL(conn net.Conn) error {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return handshakeError("mysql", err)
+	}
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return handshakeError("mysql", err)
+	}
+
+	switch {
+	case len(payload) > 0 && payload[0] == 10:
+		return nil
+	case len(payload) > 3 && payload[0] == 0xff:
+		// Error packet: 0xff, a two byte error code and the message
+		return fmt.Errorf("mysql refused the connection: %s", payload[3:])
+	default:
+		return fmt.Errorf("unexpected mysql handshake")
+	}
+}
+
+// checkPostgres asks the server whether it supports TLS
+func checkPostgres(conn net.Conn) error {
+	var req [8]byte
+	binary.BigEndian.PutUint32(req[0:4], 8)
+	binary.BigEndian.PutUint32(req[4:8], postgresSSLRequest)
+	if _, err := conn.Write(req[:]); err != nil {
+		return handshakeError("postgres", err)
+	}
+
+	var resp [1]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return handshakeError("postgres", err)
+	}
+	if resp[0] != 'S' && resp[0] != 'N' {
+		return fmt.Errorf("unexpected postgres reply %q", resp[0])
+	}
+	return nil
+}
+
+// handshakeError describes a failure to talk to a service
+func handshakeError(service string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) {
+		return fmt.Errorf("connection closed before the %s handshake", service)
+	}
+	return fmt.Errorf("no %s handshake: %w", service, err)
+}
@@ -0,0 +1,139 @@
+package health
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve accepts connections on a loopback port and handles each with handle
+func serve(t *testing.T, handle func(net.Conn)) DialFunc {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return dialAddress(ln.Addr().String())
+}
+
+// dialAddress returns a DialFunc connecting to address
+func dialAddress(address string) DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", address)
+	}
+}
+
+// reply reads a request of n bytes and writes response
+func reply(n int, response string) func(net.Conn) {
+	return func(conn net.Conn) {
+		io.ReadFull(conn, make([]byte, n))
+		io.WriteString(conn, response)
+	}
+}
+
+// mysqlPacket prefixes payload with a MySQL packet header
+func mysqlPacket(payload string) string {
+	return string([]byte{byte(len(payload)), 0, 0, 0}) + payload
+}
+
+func run(t *testing.T, check Check, dial DialFunc) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return check.Run(ctx, dial)
+}
+
+func TestChecks(t *testing.T) {
+	idle := func(conn net.Conn) { time.Sleep(time.Second) }
+	closed := func(conn net.Conn) {}
+	mysqlGreeting := mysqlPacket("\x0a8.0.36\x00")
+	mysqlDenied := mysqlPacket("\xff\x6a\x04Host is not allowed")
+
+	tests := []struct {
+		name    string
+		check   string
+		handle  func(net.Conn)
+		wantErr string
+	}{
+		{name: "TCP", check: TypeTCP, handle: idle},
+		{name: "TCPClosed", check: TypeTCP, handle: closed, wantErr: "connection closed by the remote side"},
+		{name: "RedisPong", check: TypeRedis, handle: reply(14, "+PONG\r\n")},
+		{name: "RedisNoAuth", check: TypeRedis, handle: reply(14, "-NOAUTH Authentication required.\r\n")},
+		{name: "RedisError", check: TypeRedis, handle: reply(14, "-LOADING Redis is loading the dataset in memory\r\n"), wantErr: "redis replied LOADING"},
+		{name: "RedisClosed", check: TypeRedis, handle: closed, wantErr: "connection closed before the redis handshake"},
+		{name: "MySQL", check: TypeMySQL, handle: func(conn net.Conn) { io.WriteString(conn, mysqlGreeting) }},
+		{name: "MySQLDenied", check: TypeMySQL, handle: func(conn net.Conn) { io.WriteString(conn, mysqlDenied) }, wantErr: "mysql refused the connection: Host is not allowed"},
+		{name: "Postgres", check: TypePostgres, handle: reply(8, "N")},
+		{name: "PostgresClosed", check: TypePostgres, handle: closed, wantErr: "connection closed before the postgres handshake"},
+		{name: "TLSNotSpoken", check: TypeTLS, handle: reply(1, "not tls"), wantErr: "tls"},
+		{name: "Unknown", check: "smtp", handle: idle, wantErr: `unknown health check "smtp"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := run(t, Check{Type: tt.check, InsecureSkipVerify: true}, serve(t, tt.handle))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Run() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Run() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	var host string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		if r.URL.Path != "/healthz" {
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+	dial := dialAddress(server.Listener.Addr().String())
+
+	check := Check{Type: TypeHTTPS, ServerName: "api.internal", InsecureSkipVerify: true, Path: "/healthz"}
+	if err := run(t, check, dial); err != nil {
+		t.Errorf("Run() error = %v", err)
+	}
+	if host != "api.internal" {
+		t.Errorf("request host = %s, want api.internal", host)
+	}
+
+	// Redirects are not followed
+	check.Path = "/"
+	err := run(t, check, dial)
+	if err == nil || err.Error() != "GET / returned 302 Found, want 200" {
+		t.Errorf("Run() error = %v, want the redirect status", err)
+	}
+	check.Status = http.StatusFound
+	if err := run(t, check, dial); err != nil {
+		t.Errorf("Run() with status 302 error = %v", err)
+	}
+
+	// The certificate is verified unless told otherwise
+	check.InsecureSkipVerify = false
+	if err := run(t, check, dial); err == nil {
+		t.Error("Run() with an untrusted certificate error = nil")
+	}
+}
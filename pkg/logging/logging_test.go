@@ -0,0 +1,144 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    slog.Level
+		wantErr bool
+	}{
+		{name: "debug", want: slog.LevelDebug},
+		{name: "info", want: slog.LevelInfo},
+		{name: "WARN", want: slog.LevelWarn},
+		{name: "error", want: slog.LevelError},
+		{name: "verbose", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLevel(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLevel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "tunnel-go.log")
+	var stderr bytes.Buffer
+	logger, closer, err := New(&stderr, Options{Level: slog.LevelInfo, Format: FormatJSON, File: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer closer.Close()
+
+	logger.Debug("hidden")
+	logger.With("service", "database").Info("Created tunnel", "local_port", 5000)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("log file was not written: %v", err)
+	}
+	if !bytes.Equal(data, stderr.Bytes()) {
+		t.Errorf("log file = %q, want the same as stderr %q", data, stderr.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want 1: %q", len(lines), data)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	if record["msg"] != "Created tunnel" || record["service"] != "database" || record["local_port"] != float64(5000) {
+		t.Errorf("log record = %v, want the message with its attributes", record)
+	}
+}
+
+func TestNewUnknownFormat(t *testing.T) {
+	if _, _, err := New(&bytes.Buffer{}, Options{Format: "xml"}); err == nil {
+		t.Error("New() error = nil, want unknown format")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel-go.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile() error = %v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	// Every write takes the file past 10 bytes, so each one starts a new file
+	// and only the two most recent backups are kept
+	want := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), data, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, want at most 2 backups", filepath.Base(path))
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("log file permissions = %o, want 600", perm)
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel-go.log")
+	if err := os.WriteFile(path, []byte("earlier run\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenRotatingFile(path, 15, 1)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile() error = %v", err)
+	}
+	defer f.Close()
+
+	// The existing content counts towards the limit
+	if _, err := f.Write([]byte("this run\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	backup, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatalf("log was not rotated: %v", err)
+	}
+	if string(backup) != "earlier run\n" {
+		t.Errorf("backup = %q, want the earlier run", backup)
+	}
+}
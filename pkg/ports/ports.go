@@ -0,0 +1,222 @@
+// Package ports reserves local ports for tunnels across tunnel-go processes.
+//
+// A reservation binds the port and hands the listener to the tunnel, so the
+// port is held from the moment it is selected. A registry file shared by
+// every tunnel-go process, guarded by a lock file, records which process holds
+// which port. Parallel invocations therefore pick ports one at a time and
+// skip ports held by each other, whatever address they were bound on.
+//
+// The registry also remembers the last port each service got in each
+// environment and offers it first next time, so a service keeps its port
+// across runs as long as it stays free.
+package ports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"tunnel-go/pkg/filelock"
+	"tunnel-go/pkg/process"
+)
+
+// Reservation is a port held by a tunnel-go process
+type Reservation struct {
+	PID     int    `json:"pid"`
+	Address string `json:"address"`
+	Service string `json:"service"`
+	Env     string `json:"env"`
+}
+
+// Registry coordinates port reservations through files in a directory
+type Registry struct {
+	path        string
+	lockPath    string
+	historyPath string
+}
+
+// state is the content of the registry files
+type state struct {
+	reservations map[int]Reservation
+	// last maps env/service to the port the service got last
+	last map[string]int
+}
+
+// DefaultHistoryPath returns where the last port of each service is
+// remembered unless configured otherwise
+func DefaultHistoryPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".tunnel-go", "last-ports.json"), nil
+}
+
+// Open returns the registry stored in dir, typically the daemon runtime
+// directory. The last port of each service is remembered in historyPath,
+// which should outlive the runtime directory, or not at all if it is empty.
+// The directories are created when a port is first reserved.
+func Open(dir, historyPath string) *Registry {
+	return &Registry{
+		path:        filepath.Join(dir, "ports.json"),
+		lockPath:    filepath.Join(dir, "ports.lock"),
+		historyPath: historyPath,
+	}
+}
+
+// Reserve binds a port in start-end on address that is neither held by
+// another tunnel-go process nor in use, and records it for service. The last
+// port the service got in env is tried first, then the range in order. The
+// returned listener holds the port until it is closed.
+//
+// When the range is a single port, the error says why that port could not
+// be reserved.
+func (r *Registry) Reserve(address string, start, end int, service, env string) (net.Listener, int, error) {
+	key := env + "/" + service
+	var ln net.Listener
+	var port int
+	err := r.update(func(st *state) error {
+		candidates := make([]int, 0, end-start+2)
+		if last, ok := st.last[key]; ok && last >= start && last <= end {
+			candidates = append(candidates, last)
+		}
+		for p := start; p <= end; p++ {
+			candidates = append(candidates, p)
+		}
+
+		var lastErr error
+		for _, p := range candidates {
+			if res, held := st.reservations[p]; held {
+				lastErr = fmt.Errorf("port %d is held by tunnel-go process %d for %s in %s", p, res.PID, res.Service, res.Env)
+				continue
+			}
+			l, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(p)))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			st.reservations[p] = Reservation{PID: os.Getpid(), Address: address, Service: service, Env: env}
+			st.last[key] = p
+			ln, port = l, p
+			return nil
+		}
+		if start == end && lastErr != nil {
+			return lastErr
+		}
+		return fmt.Errorf("no available ports in range %d-%d", start, end)
+	})
+	if err != nil {
+		// The port may have been bound before saving the registry failed
+		if ln != nil {
+			ln.Close()
+		}
+		return nil, 0, err
+	}
+	return ln, port, nil
+}
+
+// Release drops the reservation of port held by this process
+func (r *Registry) Release(port int) error {
+	return r.update(func(st *state) error {
+		if res, ok := st.reservations[port]; ok && res.PID == os.Getpid() {
+			delete(st.reservations, port)
+		}
+		return nil
+	})
+}
+
+// Reservations returns the ports currently held, by port
+func (r *Registry) Reservations() (map[int]Reservation, error) {
+	var result map[int]Reservation
+	err := r.update(func(st *state) error {
+		result = st.reservations
+		return nil
+	})
+	return result, err
+}
+
+// update runs fn on the registry while holding the lock file, then saves it.
+// Reservations of processes that are no longer running are dropped first, so
+// ports held by a tunnel-go that crashed become available again.
+func (r *Registry) update(fn func(*state) error) error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0700); err != nil {
+		return fmt.Errorf("failed to create port registry directory: %w", err)
+	}
+	lock, err := filelock.Acquire(r.lockPath)
+	if err != nil {
+		return fmt.Errorf("failed to lock port registry: %w", err)
+	}
+	defer lock.Release()
+
+	st := &state{
+		reservations: make(map[int]Reservation),
+		last:         make(map[string]int),
+	}
+	if err := load(r.path, &st.reservations); err != nil {
+		return err
+	}
+	if r.historyPath != "" {
+		if err := load(r.historyPath, &st.last); err != nil {
+			return err
+		}
+	}
+	for port, res := range st.reservations {
+		if !process.Running(res.PID) {
+			delete(st.reservations, port)
+		}
+	}
+
+	if err := fn(st); err != nil {
+		return err
+	}
+	if err := save(r.path, st.reservations); err != nil {
+		return err
+	}
+	if r.historyPath != "" {
+		return save(r.historyPath, st.last)
+	}
+	return nil
+}
+
+// load reads a registry file into v. A missing or corrupt file leaves v
+// empty: ports that are actually in use still fail to bind, and forgotten
+// last ports are only a preference.
+func load(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read port registry: %w", err)
+	}
+	json.Unmarshal(data, v)
+	return nil
+}
+
+// save writes a registry file atomically
+func save(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to write port registry: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ports-*")
+	if err != nil {
+		return fmt.Errorf("failed to write port registry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write port registry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write port registry: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,303 @@
+package ports
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// freeRange returns the start of n consecutive loopback ports that are
+// currently unused
+func freeRange(t *testing.T, n int) int {
+	t.Helper()
+	for attempt := 0; attempt < 20; attempt++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+		if start+n > 65535 {
+			continue
+		}
+
+		var held []net.Listener
+		for p := start; p < start+n; p++ {
+			l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(p)))
+			if err != nil {
+				break
+			}
+			held = append(held, l)
+		}
+		for _, l := range held {
+			l.Close()
+		}
+		if len(held) == n {
+			return start
+		}
+	}
+	t.Fatalf("no %d consecutive free ports", n)
+	return 0
+}
+
+// writeRegistry stores reservations as another process would
+func writeRegistry(t *testing.T, dir string, reservations map[int]Reservation) {
+	t.Helper()
+	data, err := json.Marshal(reservations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ports.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadPID returns the ID of a process that has exited
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestReserveHoldsPort(t *testing.T) {
+	dir := t.TempDir()
+	start := freeRange(t, 2)
+	r := Open(dir, "")
+
+	ln, port, err := r.Reserve("127.0.0.1", start, start+1, "database", "prod")
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	defer ln.Close()
+	if port != start {
+		t.Errorf("Reserve() port = %d, want %d", port, start)
+	}
+
+	// The port stays bound, so nothing else can take it
+	if l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		l.Close()
+		t.Error("reserved port could be bound again")
+	}
+
+	got, err := r.Reservations()
+	if err != nil {
+		t.Fatalf("Reservations() error = %v", err)
+	}
+	want := Reservation{PID: os.Getpid(), Address: "127.0.0.1", Service: "database", Env: "prod"}
+	if got[port] != want {
+		t.Errorf("reservation = %+v, want %+v", got[port], want)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "ports.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("registry permissions = %o, want 600", perm)
+	}
+}
+
+func TestReserveClosesPortWhenSaveFails(t *testing.T) {
+	dir := t.TempDir()
+	start := freeRange(t, 1)
+	// The history directory is a dangling symlink, so the history reads as
+	// empty but cannot be written
+	link := filepath.Join(dir, "history")
+	if err := os.Symlink(filepath.Join(dir, "missing"), link); err != nil {
+		t.Fatal(err)
+	}
+	r := Open(dir, filepath.Join(link, "last-ports.json"))
+
+	if _, _, err := r.Reserve("127.0.0.1", start, start, "database", "prod"); err == nil {
+		t.Fatal("Reserve() expected error when the history cannot be saved")
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(start)))
+	if err != nil {
+		t.Fatalf("port still bound after Reserve() failed: %v", err)
+	}
+	l.Close()
+}
+
+func TestReserveSkipsPortsOfOtherProcesses(t *testing.T) {
+	dir := t.TempDir()
+	start := freeRange(t, 3)
+
+	// A running process holds the first port on another address, and a
+	// process that has exited held the second
+	writeRegistry(t, dir, map[int]Reservation{
+		start:     {PID: os.Getppid(), Address: "::1", Service: "cache", Env: "dev"},
+		start + 1: {PID: deadPID(t), Address: "127.0.0.1", Service: "search", Env: "dev"},
+	})
+
+	r := Open(dir, "")
+	ln, port, err := r.Reserve("127.0.0.1", start, start+2, "database", "prod")
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	defer ln.Close()
+	if port != start+1 {
+		t.Errorf("Reserve() port = %d, want %d, released by the exited process", port, start+1)
+	}
+
+	got, err := r.Reservations()
+	if err != nil {
+		t.Fatalf("Reservations() error = %v", err)
+	}
+	if got[start].Service != "cache" {
+		t.Errorf("reservation of the running process = %+v, want it kept", got[start])
+	}
+	if got[start+1].Service != "database" {
+		t.Errorf("reservation = %+v, want database", got[start+1])
+	}
+}
+
+func TestRelease(t *testing.T) {
+	dir := t.TempDir()
+	start := freeRange(t, 1)
+	r := Open(dir, "")
+
+	ln, port, err := r.Reserve("127.0.0.1", start, start, "database", "prod")
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	ln.Close()
+	if err := r.Release(port); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+
+	got, err := r.Reservations()
+	if err != nil {
+		t.Fatalf("Reservations() error = %v", err)
+	}
+	if _, ok := got[port]; ok {
+		t.Errorf("port %d still reserved after Release", port)
+	}
+
+	ln, _, err = r.Reserve("127.0.0.1", start, start, "database", "prod")
+	if err != nil {
+		t.Fatalf("Reserve() after Release error = %v", err)
+	}
+	ln.Close()
+}
+
+func TestReserveConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	const n = 5
+	start := freeRange(t, n)
+
+	// Each goroutine opens the registry itself, as separate processes would
+	ports := make([]int, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ln, port, err := Open(dir, "").Reserve("127.0.0.1", start, start+n-1, "svc"+strconv.Itoa(i), "prod")
+			if err == nil {
+				t.Cleanup(func() { ln.Close() })
+			}
+			ports[i], errs[i] = port, err
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool)
+	for i := range ports {
+		if errs[i] != nil {
+			t.Fatalf("Reserve() error = %v", errs[i])
+		}
+		if seen[ports[i]] {
+			t.Errorf("port %d reserved twice", ports[i])
+		}
+		seen[ports[i]] = true
+	}
+
+	got, err := Open(dir, "").Reservations()
+	if err != nil {
+		t.Fatalf("Reservations() error = %v", err)
+	}
+	if len(got) != n {
+		t.Errorf("registry holds %d reservations, want %d", len(got), n)
+	}
+}
+
+func TestReserveNoPortAvailable(t *testing.T) {
+	start := freeRange(t, 1)
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(start)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if _, _, err := Open(t.TempDir(), "").Reserve("127.0.0.1", start, start, "database", "prod"); err == nil {
+		t.Error("Reserve() error = nil, want no available ports")
+	}
+}
+
+func TestReservePrefersLastPort(t *testing.T) {
+	dir := t.TempDir()
+	history := filepath.Join(t.TempDir(), "last-ports.json")
+	start := freeRange(t, 3)
+
+	// Another program holds the first port during the first run
+	other, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(start)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Open(dir, history)
+	ln, first, err := r.Reserve("127.0.0.1", start, start+2, "database", "prod")
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	other.Close()
+	ln.Close()
+	r.Release(first)
+	if first != start+1 {
+		t.Fatalf("Reserve() port = %d, want %d", first, start+1)
+	}
+
+	// The next run gets the same port although the first one is free again,
+	// while another environment starts from the beginning of the range
+	r = Open(dir, history)
+	ln, again, err := r.Reserve("127.0.0.1", start, start+2, "database", "prod")
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	defer ln.Close()
+	if again != first {
+		t.Errorf("Reserve() port = %d, want the last port %d", again, first)
+	}
+
+	ln, dev, err := r.Reserve("127.0.0.1", start, start+2, "database", "dev")
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	defer ln.Close()
+	if dev != start {
+		t.Errorf("Reserve() port for dev = %d, want %d", dev, start)
+	}
+}
+
+func TestReserveSinglePortReportsHolder(t *testing.T) {
+	dir := t.TempDir()
+	start := freeRange(t, 1)
+	writeRegistry(t, dir, map[int]Reservation{
+		start: {PID: os.Getppid(), Address: "127.0.0.1", Service: "cache", Env: "dev"},
+	})
+
+	_, _, err := Open(dir, "").Reserve("127.0.0.1", start, start, "database", "prod")
+	want := fmt.Sprintf("port %d is held by tunnel-go process %d for cache in dev", start, os.Getppid())
+	if err == nil || err.Error() != want {
+		t.Errorf("Reserve() error = %v, want %s", err, want)
+	}
+}
@@ -0,0 +1,23 @@
+// Package process inspects other processes on the machine, such as the
+// owners of pidfiles and port reservations.
+package process
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Running reports whether a process with the given ID exists
+func Running(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 checks for existence without affecting the process
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
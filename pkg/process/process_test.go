@@ -0,0 +1,24 @@
+package process
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestRunning(t *testing.T) {
+	if !Running(os.Getpid()) {
+		t.Error("Running(own pid) = false, want true")
+	}
+	if Running(0) || Running(-1) {
+		t.Error("Running() = true for an invalid pid")
+	}
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	if Running(cmd.Process.Pid) {
+		t.Errorf("Running(%d) = true for a process that exited", cmd.Process.Pid)
+	}
+}
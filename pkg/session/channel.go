@@ -0,0 +1,544 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// ClientVersion is reported to the agent during the handshake
+	ClientVersion = "1.2.0.0"
+
+	// streamDataPayloadSize is the largest payload sent in a single message
+	streamDataPayloadSize = 1024
+
+	// resendInterval is how often unacknowledged messages are checked
+	resendInterval = 500 * time.Millisecond
+
+	// resendTimeout is how long a message may stay unacknowledged before it
+	// is sent again
+	resendTimeout = 3 * time.Second
+
+	// maxPendingMessages bounds how far ahead of the next expected message
+	// out of order output is held. Messages further ahead are dropped
+	// without an acknowledgement, so the agent sends them again.
+	maxPendingMessages = 1024
+
+	// Handshake action types and statuses
+	actionTypeSessionType = "SessionType"
+	actionStatusSuccess   = 1
+	actionStatusFailed    = 2
+	actionStatusUnsupport = 3
+
+	sessionTypePort = "Port"
+)
+
+// ErrChannelClosed is returned when the data channel has been closed
+var ErrChannelClosed = errors.New("data channel closed")
+
+// openDataChannelInput is the first (text) message sent on the websocket
+type openDataChannelInput struct {
+	MessageSchemaVersion string `json:"MessageSchemaVersion"`
+	RequestID            string `json:"RequestId"`
+	TokenValue           string `json:"TokenValue"`
+	ClientID             string `json:"ClientId"`
+	ClientVersion        string `json:"ClientVersion"`
+}
+
+// acknowledgeContent is the payload of an acknowledge message
+type acknowledgeContent struct {
+	AcknowledgedMessageType           string `json:"AcknowledgedMessageType"`
+	AcknowledgedMessageID             string `json:"AcknowledgedMessageId"`
+	AcknowledgedMessageSequenceNumber int64  `json:"AcknowledgedMessageSequenceNumber"`
+	IsSequentialMessage               bool   `json:"IsSequentialMessage"`
+}
+
+// handshakeRequest is sent by the agent once the channel is open
+type handshakeRequest struct {
+	AgentVersion           string                  `json:"AgentVersion"`
+	RequestedClientActions []requestedClientAction `json:"RequestedClientActions"`
+}
+
+type requestedClientAction struct {
+	ActionType       string          `json:"ActionType"`
+	ActionParameters json.RawMessage `json:"ActionParameters"`
+}
+
+type sessionTypeRequest struct {
+	SessionType string          `json:"SessionType"`
+	Properties  json.RawMessage `json:"Properties"`
+}
+
+// handshakeResponse is the client's answer to a handshakeRequest
+type handshakeResponse struct {
+	ClientVersion          string                  `json:"ClientVersion"`
+	ProcessedClientActions []processedClientAction `json:"ProcessedClientActions"`
+	Errors                 []string                `json:"Errors"`
+}
+
+type processedClientAction struct {
+	ActionType   string `json:"ActionType"`
+	ActionStatus int    `json:"ActionStatus"`
+	Error        string `json:"Error,omitempty"`
+}
+
+// channelClosedContent is the payload of a channel_closed message
+type channelClosedContent struct {
+	MessageID string `json:"MessageId"`
+	SessionID string `json:"SessionId"`
+	Output    string `json:"Output"`
+}
+
+// outgoingMessage is a sent message waiting for its acknowledgement
+type outgoingMessage struct {
+	data     []byte
+	lastSent time.Time
+}
+
+// dataChannel implements the sequenced, acknowledged message stream that
+// carries session data over the websocket returned by StartSession
+type dataChannel struct {
+	conn *websocket.Conn
+	log  *slog.Logger
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	paused    bool
+	nextSeq   int64
+	unacked   map[int64]*outgoingMessage
+	expectSeq int64
+	pending   map[int64]*ClientMessage
+
+	agentVersion  string
+	handshakeOnce sync.Once
+	handshake     chan struct{}
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// dialDataChannel connects to the stream URL and opens the data channel
+func dialDataChannel(ctx context.Context, streamURL, token string, logger *slog.Logger) (*dataChannel, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, streamURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to stream %s: %w", streamURL, err)
+	}
+
+	pr, pw := io.Pipe()
+	c := &dataChannel{
+		conn:      conn,
+		log:       logger,
+		unacked:   make(map[int64]*outgoingMessage),
+		pending:   make(map[int64]*ClientMessage),
+		handshake: make(chan struct{}),
+		pr:        pr,
+		pw:        pw,
+		done:      make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	open := openDataChannelInput{
+		MessageSchemaVersion: "1.0",
+		RequestID:            NewUUID().String(),
+		TokenValue:           token,
+		ClientID:             NewUUID().String(),
+		ClientVersion:        ClientVersion,
+	}
+	data, err := json.Marshal(open)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to encode open data channel request: %w", err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open data channel: %w", err)
+	}
+
+	go c.readLoop()
+	go c.resendLoop()
+
+	return c, nil
+}
+
+// waitHandshake blocks until the agent has completed the session handshake
+func (c *dataChannel) waitHandshake(ctx context.Context) error {
+	select {
+	case <-c.handshake:
+		return nil
+	case <-c.done:
+		return fmt.Errorf("data channel closed during handshake: %w", c.Err())
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for session handshake: %w", ctx.Err())
+	}
+}
+
+// AgentVersion returns the SSM agent version reported during the handshake
+func (c *dataChannel) AgentVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.agentVersion
+}
+
+// Read reads session output sent by the agent
+func (c *dataChannel) Read(p []byte) (int, error) {
+	return c.pr.Read(p)
+}
+
+// Write sends session input to the agent, split into message sized chunks
+func (c *dataChannel) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > streamDataPayloadSize {
+			n = streamDataPayloadSize
+		}
+		if err := c.sendInput(PayloadTypeOutput, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// sendInput sends an input_stream_data message and tracks it until
+// acknowledged, waiting while the agent has paused publication
+func (c *dataChannel) sendInput(payloadType PayloadType, payload []byte) error {
+	c.mu.Lock()
+	for c.paused && !c.isClosed() {
+		c.cond.Wait()
+	}
+	return c.sendLocked(payloadType, payload)
+}
+
+// sendLocked sends an input_stream_data message regardless of publication
+// being paused. It is called with c.mu held and releases it.
+func (c *dataChannel) sendLocked(payloadType PayloadType, payload []byte) error {
+	if c.isClosed() {
+		c.mu.Unlock()
+		return ErrChannelClosed
+	}
+
+	msg := &ClientMessage{
+		MessageType:    MessageTypeInputStreamData,
+		SchemaVersion:  1,
+		CreatedDate:    time.Now(),
+		SequenceNumber: c.nextSeq,
+		MessageID:      NewUUID(),
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.unacked[c.nextSeq] = &outgoingMessage{data: data, lastSent: time.Now()}
+	c.nextSeq++
+	c.mu.Unlock()
+
+	return c.writeMessage(data)
+}
+
+// acknowledge confirms receipt of a message from the agent
+func (c *dataChannel) acknowledge(msg *ClientMessage) error {
+	content, err := json.Marshal(acknowledgeContent{
+		AcknowledgedMessageType:           msg.MessageType,
+		AcknowledgedMessageID:             msg.MessageID.String(),
+		AcknowledgedMessageSequenceNumber: msg.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+	if err != nil {
+		return err
+	}
+
+	ack := &ClientMessage{
+		MessageType:   MessageTypeAcknowledge,
+		SchemaVersion: 1,
+		CreatedDate:   time.Now(),
+		Flags:         3,
+		MessageID:     NewUUID(),
+		Payload:       content,
+	}
+	data, err := ack.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.writeMessage(data)
+}
+
+// writeMessage writes a binary frame to the websocket
+func (c *dataChannel) writeMessage(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return fmt.Errorf("failed to write to data channel: %w", err)
+	}
+	return nil
+}
+
+// readLoop dispatches messages received from the agent until the websocket closes
+func (c *dataChannel) readLoop() {
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if c.isClosed() {
+				return
+			}
+			c.closeWithError(fmt.Errorf("failed to read from data channel: %w", err))
+			return
+		}
+
+		var msg ClientMessage
+		if err := msg.UnmarshalBinary(data); err != nil {
+			c.log.Debug("Dropping invalid message from data channel", "error", err)
+			continue
+		}
+
+		if err := c.handleMessage(&msg); err != nil {
+			c.closeWithError(err)
+			return
+		}
+	}
+}
+
+// handleMessage processes a single message from the agent
+func (c *dataChannel) handleMessage(msg *ClientMessage) error {
+	switch msg.MessageType {
+	case MessageTypeOutputStreamData:
+		return c.handleOutput(msg)
+
+	case MessageTypeAcknowledge:
+		var ack acknowledgeContent
+		if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+			return fmt.Errorf("invalid acknowledge message: %w", err)
+		}
+		c.mu.Lock()
+		delete(c.unacked, ack.AcknowledgedMessageSequenceNumber)
+		c.mu.Unlock()
+
+	case MessageTypeChannelClosed:
+		var closed channelClosedContent
+		if err := json.Unmarshal(msg.Payload, &closed); err == nil && closed.Output != "" {
+			return fmt.Errorf("%w: %s", ErrChannelClosed, closed.Output)
+		}
+		return ErrChannelClosed
+
+	case MessageTypeStartPublication, MessageTypePausePublication:
+		c.mu.Lock()
+		c.paused = msg.MessageType == MessageTypePausePublication
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+	default:
+		c.log.Debug("Ignoring unknown message type from data channel", "type", msg.MessageType)
+	}
+	return nil
+}
+
+// handleOutput acknowledges output_stream_data messages and delivers them in
+// sequence order
+func (c *dataChannel) handleOutput(msg *ClientMessage) error {
+	c.mu.Lock()
+	expectSeq := c.expectSeq
+	c.mu.Unlock()
+	if msg.SequenceNumber >= expectSeq+maxPendingMessages {
+		c.log.Debug("Dropping output message too far ahead", "sequence", msg.SequenceNumber, "expected", expectSeq)
+		return nil
+	}
+	if err := c.acknowledge(msg); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if msg.SequenceNumber < c.expectSeq {
+		// Duplicate of a message already delivered
+		c.mu.Unlock()
+		return nil
+	}
+	c.pending[msg.SequenceNumber] = msg
+
+	var ready []*ClientMessage
+	for {
+		next, ok := c.pending[c.expectSeq]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.expectSeq)
+		ready = append(ready, next)
+		c.expectSeq++
+	}
+	c.mu.Unlock()
+
+	for _, m := range ready {
+		if err := c.processOutput(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processOutput acts on an in-order output message
+func (c *dataChannel) processOutput(msg *ClientMessage) error {
+	switch msg.PayloadType {
+	case PayloadTypeOutput:
+		if _, err := c.pw.Write(msg.Payload); err != nil {
+			return err
+		}
+	case PayloadTypeHandshakeRequest:
+		return c.handleHandshakeRequest(msg.Payload)
+	case PayloadTypeHandshakeComplete:
+		c.handshakeOnce.Do(func() { close(c.handshake) })
+	case PayloadTypeError:
+		c.log.Error("Session error from agent", "output", string(msg.Payload))
+	default:
+		c.log.Debug("Ignoring output payload type", "type", msg.PayloadType)
+	}
+	return nil
+}
+
+// handleHandshakeRequest answers the agent's handshake, accepting only port sessions
+func (c *dataChannel) handleHandshakeRequest(payload []byte) error {
+	var req handshakeRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("invalid handshake request: %w", err)
+	}
+
+	c.mu.Lock()
+	c.agentVersion = req.AgentVersion
+	c.mu.Unlock()
+
+	c.log.Debug("Session handshake", "agent_version", req.AgentVersion)
+
+	resp := handshakeResponse{ClientVersion: ClientVersion, Errors: []string{}}
+	for _, action := range req.RequestedClientActions {
+		processed := processedClientAction{ActionType: action.ActionType}
+		switch action.ActionType {
+		case actionTypeSessionType:
+			var params sessionTypeRequest
+			if err := json.Unmarshal(action.ActionParameters, &params); err != nil {
+				processed.ActionStatus = actionStatusFailed
+				processed.Error = fmt.Sprintf("invalid session type parameters: %v", err)
+			} else if params.SessionType != sessionTypePort {
+				processed.ActionStatus = actionStatusFailed
+				processed.Error = fmt.Sprintf("unsupported session type %s", params.SessionType)
+			} else {
+				processed.ActionStatus = actionStatusSuccess
+			}
+		default:
+			processed.ActionStatus = actionStatusUnsupport
+			processed.Error = fmt.Sprintf("unsupported action %s", action.ActionType)
+		}
+		if processed.Error != "" {
+			resp.Errors = append(resp.Errors, processed.Error)
+		}
+		resp.ProcessedClientActions = append(resp.ProcessedClientActions, processed)
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to encode handshake response: %w", err)
+	}
+	// The response must not wait for publication to resume: only this
+	// goroutine, the read loop, can see the agent resume it
+	c.mu.Lock()
+	return c.sendLocked(PayloadTypeHandshakeResponse, data)
+}
+
+// resendLoop retransmits messages the agent has not acknowledged in time
+func (c *dataChannel) resendLoop() {
+	ticker := time.NewTicker(resendInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var resend [][]byte
+		c.mu.Lock()
+		for _, out := range c.unacked {
+			if now.Sub(out.lastSent) >= resendTimeout {
+				out.lastSent = now
+				resend = append(resend, out.data)
+			}
+		}
+		c.mu.Unlock()
+
+		for _, data := range resend {
+			if err := c.writeMessage(data); err != nil {
+				c.closeWithError(err)
+				return
+			}
+		}
+	}
+}
+
+// isClosed reports whether the channel has been closed
+func (c *dataChannel) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeWithError closes the channel, recording the reason
+func (c *dataChannel) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		// Close done under mu before waking senders waiting for a pause to
+		// end, so none of them can miss it and wait again
+		c.mu.Lock()
+		c.err = err
+		close(c.done)
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		if err == nil {
+			err = io.EOF
+		}
+		c.pw.CloseWithError(err)
+
+		// WriteControl may be used concurrently with other writes
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		c.conn.Close()
+	})
+}
+
+// Close closes the data channel
+func (c *dataChannel) Close() error {
+	c.closeWithError(nil)
+	return nil
+}
+
+// Done is closed when the data channel has been closed
+func (c *dataChannel) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the data channel closed, if any
+func (c *dataChannel) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
@@ -0,0 +1,182 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message types exchanged over the Session Manager data channel
+const (
+	MessageTypeInputStreamData  = "input_stream_data"
+	MessageTypeOutputStreamData = "output_stream_data"
+	MessageTypeAcknowledge      = "acknowledge"
+	MessageTypeChannelClosed    = "channel_closed"
+	MessageTypeStartPublication = "start_publication"
+	MessageTypePausePublication = "pause_publication"
+)
+
+// PayloadType identifies the content of a stream data message
+type PayloadType uint32
+
+// Payload types used by the agent and the client
+const (
+	PayloadTypeOutput            PayloadType = 1
+	PayloadTypeError             PayloadType = 2
+	PayloadTypeSize              PayloadType = 3
+	PayloadTypeParameter         PayloadType = 4
+	PayloadTypeHandshakeRequest  PayloadType = 5
+	PayloadTypeHandshakeResponse PayloadType = 6
+	PayloadTypeHandshakeComplete PayloadType = 7
+	PayloadTypeFlag              PayloadType = 10
+)
+
+// Flag values sent with PayloadTypeFlag in port forwarding sessions
+const (
+	FlagDisconnectToPort   uint32 = 1
+	FlagTerminateSession   uint32 = 2
+	FlagConnectToPortError uint32 = 3
+)
+
+// Field offsets of the binary message header. The header is followed by a
+// 4 byte payload length and the payload itself.
+const (
+	headerLengthOffset   = 0
+	messageTypeOffset    = 4
+	schemaVersionOffset  = 36
+	createdDateOffset    = 40
+	sequenceNumberOffset = 48
+	flagsOffset          = 56
+	messageIDOffset      = 64
+	payloadDigestOffset  = 80
+	payloadTypeOffset    = 112
+	payloadLengthOffset  = 116
+
+	messageTypeLength = 32
+	headerLength      = payloadLengthOffset
+	payloadOffset     = payloadLengthOffset + 4
+)
+
+// UUID is a 16 byte message identifier
+type UUID [16]byte
+
+// NewUUID returns a random (version 4) UUID
+func NewUUID() UUID {
+	var u UUID
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate UUID: %v", err))
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return u
+}
+
+// String returns the canonical textual form of the UUID
+func (u UUID) String() string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
+
+// ClientMessage is a single frame of the Session Manager data channel
+type ClientMessage struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    time.Time
+	SequenceNumber int64
+	Flags          uint64
+	MessageID      UUID
+	PayloadType    PayloadType
+	Payload        []byte
+}
+
+// MarshalBinary encodes the message in the wire format used by the agent
+func (m *ClientMessage) MarshalBinary() ([]byte, error) {
+	if len(m.MessageType) > messageTypeLength {
+		return nil, fmt.Errorf("message type %q is too long", m.MessageType)
+	}
+
+	buf := make([]byte, payloadOffset+len(m.Payload))
+	binary.BigEndian.PutUint32(buf[headerLengthOffset:], headerLength)
+
+	// The message type is padded with spaces to its fixed width
+	copy(buf[messageTypeOffset:messageTypeOffset+messageTypeLength], bytes.Repeat([]byte(" "), messageTypeLength))
+	copy(buf[messageTypeOffset:], m.MessageType)
+
+	binary.BigEndian.PutUint32(buf[schemaVersionOffset:], m.SchemaVersion)
+	binary.BigEndian.PutUint64(buf[createdDateOffset:], uint64(m.CreatedDate.UnixMilli()))
+	binary.BigEndian.PutUint64(buf[sequenceNumberOffset:], uint64(m.SequenceNumber))
+	binary.BigEndian.PutUint64(buf[flagsOffset:], m.Flags)
+	putMessageID(buf[messageIDOffset:], m.MessageID)
+
+	digest := sha256.Sum256(m.Payload)
+	copy(buf[payloadDigestOffset:], digest[:])
+
+	binary.BigEndian.PutUint32(buf[payloadTypeOffset:], uint32(m.PayloadType))
+	binary.BigEndian.PutUint32(buf[payloadLengthOffset:], uint32(len(m.Payload)))
+	copy(buf[payloadOffset:], m.Payload)
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a message received from the agent
+func (m *ClientMessage) UnmarshalBinary(data []byte) error {
+	if len(data) < payloadOffset {
+		return fmt.Errorf("message too short: %d bytes", len(data))
+	}
+
+	hdrLen := int(binary.BigEndian.Uint32(data[headerLengthOffset:]))
+	if hdrLen < payloadTypeOffset+4 || hdrLen+4 > len(data) {
+		return fmt.Errorf("invalid header length %d", hdrLen)
+	}
+
+	m.MessageType = strings.TrimRight(string(bytes.TrimRight(data[messageTypeOffset:messageTypeOffset+messageTypeLength], "\x00")), " ")
+	m.SchemaVersion = binary.BigEndian.Uint32(data[schemaVersionOffset:])
+	m.CreatedDate = time.UnixMilli(int64(binary.BigEndian.Uint64(data[createdDateOffset:])))
+	m.SequenceNumber = int64(binary.BigEndian.Uint64(data[sequenceNumberOffset:]))
+	m.Flags = binary.BigEndian.Uint64(data[flagsOffset:])
+	m.MessageID = getMessageID(data[messageIDOffset:])
+	m.PayloadType = PayloadType(binary.BigEndian.Uint32(data[payloadTypeOffset:]))
+
+	payloadLen := int(binary.BigEndian.Uint32(data[hdrLen:]))
+	start := hdrLen + 4
+	if payloadLen < 0 || start+payloadLen > len(data) {
+		return fmt.Errorf("invalid payload length %d", payloadLen)
+	}
+	m.Payload = append([]byte(nil), data[start:start+payloadLen]...)
+
+	digest := sha256.Sum256(m.Payload)
+	if !bytes.Equal(digest[:], data[payloadDigestOffset:payloadDigestOffset+sha256.Size]) {
+		return fmt.Errorf("payload digest mismatch for %s message %d", m.MessageType, m.SequenceNumber)
+	}
+
+	return nil
+}
+
+// putMessageID writes the message ID the way the agent expects it: the least
+// significant half of the UUID first, followed by the most significant half.
+func putMessageID(b []byte, id UUID) {
+	copy(b[0:8], id[8:16])
+	copy(b[8:16], id[0:8])
+}
+
+// getMessageID reverses putMessageID
+func getMessageID(b []byte) UUID {
+	var id UUID
+	copy(id[8:16], b[0:8])
+	copy(id[0:8], b[8:16])
+	return id
+}
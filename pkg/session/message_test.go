@@ -0,0 +1,92 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientMessageRoundTrip(t *testing.T) {
+	msg := &ClientMessage{
+		MessageType:    MessageTypeOutputStreamData,
+		SchemaVersion:  1,
+		CreatedDate:    time.UnixMilli(1700000000123),
+		SequenceNumber: 42,
+		Flags:          3,
+		MessageID:      NewUUID(),
+		PayloadType:    PayloadTypeOutput,
+		Payload:        []byte("hello"),
+	}
+
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error = %v", err)
+	}
+	if len(data) != payloadOffset+len(msg.Payload) {
+		t.Errorf("MarshalBinary() length = %d, want %d", len(data), payloadOffset+len(msg.Payload))
+	}
+
+	var got ClientMessage
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+
+	if got.MessageType != msg.MessageType {
+		t.Errorf("MessageType = %q, want %q", got.MessageType, msg.MessageType)
+	}
+	if got.SequenceNumber != msg.SequenceNumber {
+		t.Errorf("SequenceNumber = %d, want %d", got.SequenceNumber, msg.SequenceNumber)
+	}
+	if got.Flags != msg.Flags {
+		t.Errorf("Flags = %d, want %d", got.Flags, msg.Flags)
+	}
+	if got.MessageID != msg.MessageID {
+		t.Errorf("MessageID = %s, want %s", got.MessageID, msg.MessageID)
+	}
+	if !got.CreatedDate.Equal(msg.CreatedDate) {
+		t.Errorf("CreatedDate = %v, want %v", got.CreatedDate, msg.CreatedDate)
+	}
+	if got.PayloadType != msg.PayloadType {
+		t.Errorf("PayloadType = %d, want %d", got.PayloadType, msg.PayloadType)
+	}
+	if string(got.Payload) != "hello" {
+		t.Errorf("Payload = %q, want %q", got.Payload, "hello")
+	}
+}
+
+func TestClientMessageIDByteOrder(t *testing.T) {
+	var id UUID
+	for i := range id {
+		id[i] = byte(i)
+	}
+
+	data, err := (&ClientMessage{MessageType: MessageTypeAcknowledge, MessageID: id}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error = %v", err)
+	}
+
+	// The least significant half of the UUID is written first
+	if data[messageIDOffset] != 8 || data[messageIDOffset+8] != 0 {
+		t.Errorf("message ID bytes = %v, want least significant half first", data[messageIDOffset:messageIDOffset+16])
+	}
+}
+
+func TestClientMessageDigestMismatch(t *testing.T) {
+	data, err := (&ClientMessage{MessageType: MessageTypeOutputStreamData, Payload: []byte("data")}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error = %v", err)
+	}
+	data[len(data)-1] ^= 0xff
+
+	var msg ClientMessage
+	if err := msg.UnmarshalBinary(data); err == nil {
+		t.Error("UnmarshalBinary() expected digest error, got nil")
+	}
+}
+
+func TestUUIDString(t *testing.T) {
+	id := UUID{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	want := "12345678-9abc-def0-0123-456789abcdef"
+	if got := id.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+}
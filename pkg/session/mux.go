@@ -0,0 +1,303 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// The agent multiplexes port forwarding connections using the smux (version 1)
+// framing protocol on top of the data channel. Only the client side subset
+// needed to open, use and close streams is implemented here.
+const (
+	muxVersion = 1
+
+	muxCmdSYN byte = 0
+	muxCmdFIN byte = 1
+	muxCmdPSH byte = 2
+	muxCmdNOP byte = 3
+
+	muxHeaderSize        = 8
+	muxMaxFrameSize      = 32768
+	muxKeepAliveInterval = 10 * time.Second
+)
+
+// ErrStreamClosed is returned when using a closed stream
+var ErrStreamClosed = errors.New("stream closed")
+
+// muxFrame is a single smux frame
+type muxFrame struct {
+	cmd  byte
+	sid  uint32
+	data []byte
+}
+
+// writeMuxFrame encodes a frame to w
+func writeMuxFrame(w io.Writer, cmd byte, sid uint32, data []byte) error {
+	if len(data) > muxMaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds maximum size", len(data))
+	}
+	buf := make([]byte, muxHeaderSize+len(data))
+	buf[0] = muxVersion
+	buf[1] = cmd
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:], sid)
+	copy(buf[muxHeaderSize:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readMuxFrame decodes the next frame from r
+func readMuxFrame(r io.Reader) (muxFrame, error) {
+	var hdr [muxHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return muxFrame{}, err
+	}
+	if hdr[0] != muxVersion {
+		return muxFrame{}, fmt.Errorf("unsupported mux version %d", hdr[0])
+	}
+
+	f := muxFrame{
+		cmd: hdr[1],
+		sid: binary.LittleEndian.Uint32(hdr[4:]),
+	}
+	if length := binary.LittleEndian.Uint16(hdr[2:]); length > 0 {
+		f.data = make([]byte, length)
+		if _, err := io.ReadFull(r, f.data); err != nil {
+			return muxFrame{}, err
+		}
+	}
+	return f, nil
+}
+
+// muxSession multiplexes streams over a single data channel
+type muxSession struct {
+	conn io.ReadWriteCloser
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+// newMuxSession starts a client mux session on conn
+func newMuxSession(conn io.ReadWriteCloser) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		streams: make(map[uint32]*muxStream),
+		nextID:  1,
+		done:    make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.keepAlive()
+	return s
+}
+
+// openStream opens a new stream to the remote port
+func (s *muxSession) openStream() (*muxStream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, ErrChannelClosed
+	}
+	s.nextID += 2
+	st := &muxStream{id: s.nextID, sess: s}
+	st.cond = sync.NewCond(&st.mu)
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxCmdSYN, st.id, nil); err != nil {
+		s.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// writeFrame serialises frame writes onto the underlying channel
+func (s *muxSession) writeFrame(cmd byte, sid uint32, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.isClosed() {
+		return ErrChannelClosed
+	}
+	return writeMuxFrame(s.conn, cmd, sid, data)
+}
+
+// recvLoop routes incoming frames to their streams
+func (s *muxSession) recvLoop() {
+	for {
+		f, err := readMuxFrame(s.conn)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+
+		s.mu.Lock()
+		st := s.streams[f.sid]
+		s.mu.Unlock()
+		if st == nil {
+			continue
+		}
+
+		switch f.cmd {
+		case muxCmdPSH:
+			st.push(f.data)
+		case muxCmdFIN:
+			st.finish()
+		}
+	}
+}
+
+// keepAlive periodically sends NOP frames so the agent keeps the session open
+func (s *muxSession) keepAlive() {
+	ticker := time.NewTicker(muxKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.writeFrame(muxCmdNOP, 0, nil); err != nil {
+				s.closeWithError(err)
+				return
+			}
+		}
+	}
+}
+
+// removeStream forgets a stream once it has been closed
+func (s *muxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// isClosed reports whether the session has been closed
+func (s *muxSession) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeWithError closes the session and all of its streams
+func (s *muxSession) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		close(s.done)
+		streams := s.streams
+		s.streams = make(map[uint32]*muxStream)
+		s.mu.Unlock()
+
+		for _, st := range streams {
+			st.finish()
+		}
+		s.conn.Close()
+	})
+}
+
+// Close closes the session
+func (s *muxSession) Close() error {
+	s.closeWithError(nil)
+	return nil
+}
+
+// muxStream is one forwarded connection within a mux session
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	finished bool
+
+	closeOnce sync.Once
+	closed    bool
+}
+
+// push appends received data to the stream buffer
+func (st *muxStream) push(data []byte) {
+	st.mu.Lock()
+	st.buf.Write(data)
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// finish marks the remote end of the stream as closed
+func (st *muxStream) finish() {
+	st.mu.Lock()
+	st.finished = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// Read reads data received on the stream
+func (st *muxStream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for st.buf.Len() == 0 && !st.finished && !st.closed {
+		st.cond.Wait()
+	}
+	if st.buf.Len() > 0 {
+		return st.buf.Read(p)
+	}
+	if st.closed {
+		return 0, ErrStreamClosed
+	}
+	return 0, io.EOF
+}
+
+// Write sends data on the stream
+func (st *muxStream) Write(p []byte) (int, error) {
+	st.mu.Lock()
+	closed := st.closed
+	st.mu.Unlock()
+	if closed {
+		return 0, ErrStreamClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > muxMaxFrameSize {
+			n = muxMaxFrameSize
+		}
+		if err := st.sess.writeFrame(muxCmdPSH, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes the stream and tells the agent to close the remote connection
+func (st *muxStream) Close() error {
+	var err error
+	st.closeOnce.Do(func() {
+		st.mu.Lock()
+		st.closed = true
+		st.cond.Broadcast()
+		st.mu.Unlock()
+
+		st.sess.removeStream(st.id)
+		err = st.sess.writeFrame(muxCmdFIN, st.id, nil)
+		if errors.Is(err, ErrChannelClosed) {
+			err = nil
+		}
+	})
+	return err
+}
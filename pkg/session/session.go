@@ -0,0 +1,220 @@
+// Package session implements the client side of the AWS Systems Manager
+// Session Manager data channel for port forwarding sessions, so tunnels can be
+// created without the AWS CLI or the session-manager-plugin.
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"tunnel-go/pkg/version"
+)
+
+const (
+	// PortForwardingDocument is the SSM document used for remote host port forwarding
+	PortForwardingDocument = "AWS-StartPortForwardingSessionToRemoteHost"
+
+	// muxMinAgentVersion is the newest agent version that does not support
+	// multiplexed port forwarding. PortForwardingDocument needs agent
+	// 3.1.1374.0 or later, so every agent it runs on multiplexes.
+	muxMinAgentVersion = "3.0.196.0"
+
+	terminateTimeout = 10 * time.Second
+)
+
+// API is the subset of the SSM client used to manage sessions
+type API interface {
+	StartSession(ctx context.Context, params *ssm.StartSessionInput, optFns ...func(*ssm.Options)) (*ssm.StartSessionOutput, error)
+	TerminateSession(ctx context.Context, params *ssm.TerminateSessionInput, optFns ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error)
+}
+
+// Options describes the port forwarding session to start
+type Options struct {
+	// Target is the ID of the instance the session is started on
+	Target string
+	// Host is the remote host the agent connects to
+	Host string
+	// Port is the remote port the agent connects to
+	Port string
+	// Logger receives protocol level messages at debug level and errors
+	// reported by the agent. The default logger is used when it is nil.
+	Logger *slog.Logger
+}
+
+// Session is an established port forwarding session
+type Session struct {
+	id string
+
+	api     API
+	channel *dataChannel
+	mux     *muxSession
+	log     *slog.Logger
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Start starts a port forwarding session and completes the agent handshake
+func Start(ctx context.Context, api API, opts Options) (*Session, error) {
+	if opts.Target == "" {
+		return nil, fmt.Errorf("session target is required")
+	}
+
+	input := &ssm.StartSessionInput{
+		Target:       aws.String(opts.Target),
+		DocumentName: aws.String(PortForwardingDocument),
+		Parameters: map[string][]string{
+			"host":       {opts.Host},
+			"portNumber": {opts.Port},
+		},
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Debug("Starting session", "target", opts.Target, "host", opts.Host, "port", opts.Port)
+
+	output, err := api.StartSession(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start session: %w", err)
+	}
+	if output.SessionId == nil || output.StreamUrl == nil || output.TokenValue == nil {
+		return nil, fmt.Errorf("incomplete StartSession response")
+	}
+
+	logger = logger.With("session", *output.SessionId)
+	s := &Session{
+		id:  *output.SessionId,
+		api: api,
+		log: logger,
+	}
+
+	channel, err := dialDataChannel(ctx, *output.StreamUrl, *output.TokenValue, logger)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.channel = channel
+
+	if err := channel.waitHandshake(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	agentVersion := channel.AgentVersion()
+	if version.Compare(agentVersion, muxMinAgentVersion) <= 0 {
+		s.Close()
+		return nil, fmt.Errorf("SSM agent %s on %s cannot multiplex port forwarding", agentVersion, opts.Target)
+	}
+	s.mux = newMuxSession(channel)
+
+	logger.Debug("Session established", "agent_version", agentVersion)
+
+	return s, nil
+}
+
+// ID returns the Session Manager session ID
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Open opens a new stream to the remote host
+func (s *Session) Open(ctx context.Context) (io.ReadWriteCloser, error) {
+	return s.mux.openStream()
+}
+
+// Forward proxies a local connection through the session until either side
+// closes the connection
+func (s *Session) Forward(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+
+	stream, err := s.Open(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.Close()
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(stream, conn)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, stream)
+		errc <- err
+	}()
+
+	// Either direction finishing ends the forwarded connection
+	err = <-errc
+	if err != nil && !isClosedError(err) {
+		return err
+	}
+	return nil
+}
+
+// Done is closed when the session has ended
+func (s *Session) Done() <-chan struct{} {
+	return s.channel.Done()
+}
+
+// Err returns the reason the session ended, if known
+func (s *Session) Err() error {
+	return s.channel.Err()
+}
+
+// Close terminates the session and closes the data channel
+func (s *Session) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), terminateTimeout)
+	defer cancel()
+	return s.Terminate(ctx)
+}
+
+// Terminate asks Session Manager to end the session, then closes the data
+// channel. The channel is closed even if ctx expires before the API call
+// completes.
+func (s *Session) Terminate(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.terminate(ctx)
+		s.Abort()
+	})
+	return s.closeErr
+}
+
+// Abort closes the data channel without notifying Session Manager. The
+// session is cleaned up by the service once it notices the channel is gone.
+func (s *Session) Abort() {
+	if s.mux != nil {
+		s.mux.Close()
+	}
+	if s.channel != nil {
+		s.channel.Close()
+	}
+}
+
+// terminate calls the TerminateSession API
+func (s *Session) terminate(ctx context.Context) error {
+	if _, err := s.api.TerminateSession(ctx, &ssm.TerminateSessionInput{SessionId: aws.String(s.id)}); err != nil {
+		return fmt.Errorf("failed to terminate session %s: %w", s.id, err)
+	}
+	s.log.Debug("Terminated session")
+	return nil
+}
+
+// isClosedError reports whether err only signals a closed connection
+func isClosedError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, ErrStreamClosed) ||
+		errors.Is(err, ErrChannelClosed)
+}
@@ -0,0 +1,451 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/gorilla/websocket"
+)
+
+// fakeAgent is a websocket server speaking the Session Manager data channel
+// protocol. It echoes all port forwarding data back to the client.
+type fakeAgent struct {
+	t            *testing.T
+	server       *httptest.Server
+	agentVersion string
+	token        string
+	// pauseFirst pauses publication before the handshake and resumes it
+	// once the handshake response arrives
+	pauseFirst bool
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	seq     int64
+	seen    map[int64]bool
+	actions []processedClientAction
+}
+
+func newFakeAgent(t *testing.T, agentVersion string) *fakeAgent {
+	a := &fakeAgent{
+		t:            t,
+		agentVersion: agentVersion,
+		token:        "test-token",
+		seen:         make(map[int64]bool),
+	}
+	a.server = httptest.NewServer(http.HandlerFunc(a.handle))
+	t.Cleanup(a.server.Close)
+	return a
+}
+
+func (a *fakeAgent) url() string {
+	return "ws" + strings.TrimPrefix(a.server.URL, "http")
+}
+
+func (a *fakeAgent) handle(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		a.t.Errorf("upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	a.mu.Lock()
+	a.conn = conn
+	a.mu.Unlock()
+
+	msgType, data, err := conn.ReadMessage()
+	if err != nil || msgType != websocket.TextMessage {
+		a.t.Errorf("expected open data channel text message, got type %d err %v", msgType, err)
+		return
+	}
+	var open openDataChannelInput
+	if err := json.Unmarshal(data, &open); err != nil || open.TokenValue != a.token {
+		a.t.Errorf("invalid open data channel request: %s", data)
+		return
+	}
+
+	request, _ := json.Marshal(handshakeRequest{
+		AgentVersion: a.agentVersion,
+		RequestedClientActions: []requestedClientAction{{
+			ActionType:       actionTypeSessionType,
+			ActionParameters: json.RawMessage(`{"SessionType":"Port","Properties":{}}`),
+		}},
+	})
+	if a.pauseFirst {
+		a.sendControl(MessageTypePausePublication)
+	}
+	a.sendOutput(PayloadTypeHandshakeRequest, request)
+
+	muxR, muxW := io.Pipe()
+	go a.serveMux(muxR)
+	defer muxW.Close()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg ClientMessage
+		if err := msg.UnmarshalBinary(data); err != nil {
+			a.t.Errorf("agent received invalid message: %v", err)
+			return
+		}
+		if msg.MessageType != MessageTypeInputStreamData {
+			continue
+		}
+
+		a.acknowledge(&msg)
+		a.mu.Lock()
+		dup := a.seen[msg.SequenceNumber]
+		a.seen[msg.SequenceNumber] = true
+		a.mu.Unlock()
+		if dup {
+			continue
+		}
+
+		switch msg.PayloadType {
+		case PayloadTypeHandshakeResponse:
+			var resp handshakeResponse
+			json.Unmarshal(msg.Payload, &resp)
+			a.mu.Lock()
+			a.actions = resp.ProcessedClientActions
+			a.mu.Unlock()
+			if a.pauseFirst {
+				a.sendControl(MessageTypeStartPublication)
+			}
+			a.sendOutput(PayloadTypeHandshakeComplete, []byte(`{"CustomerMessage":""}`))
+		case PayloadTypeOutput:
+			muxW.Write(msg.Payload)
+		}
+	}
+}
+
+// serveMux echoes every mux stream back to the client
+func (a *fakeAgent) serveMux(r io.Reader) {
+	w := writerFunc(func(p []byte) (int, error) {
+		a.sendOutput(PayloadTypeOutput, p)
+		return len(p), nil
+	})
+	for {
+		f, err := readMuxFrame(r)
+		if err != nil {
+			return
+		}
+		switch f.cmd {
+		case muxCmdPSH:
+			writeMuxFrame(w, muxCmdPSH, f.sid, f.data)
+		case muxCmdFIN:
+			writeMuxFrame(w, muxCmdFIN, f.sid, nil)
+		}
+	}
+}
+
+func (a *fakeAgent) sendOutput(payloadType PayloadType, payload []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	msg := &ClientMessage{
+		MessageType:    MessageTypeOutputStreamData,
+		SchemaVersion:  1,
+		CreatedDate:    time.Now(),
+		SequenceNumber: a.seq,
+		MessageID:      NewUUID(),
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+	a.seq++
+	data, _ := msg.MarshalBinary()
+	a.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (a *fakeAgent) acknowledge(msg *ClientMessage) {
+	content, _ := json.Marshal(acknowledgeContent{
+		AcknowledgedMessageType:           msg.MessageType,
+		AcknowledgedMessageID:             msg.MessageID.String(),
+		AcknowledgedMessageSequenceNumber: msg.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+	ack := &ClientMessage{MessageType: MessageTypeAcknowledge, SchemaVersion: 1, CreatedDate: time.Now(), MessageID: NewUUID(), Payload: content}
+	data, _ := ack.MarshalBinary()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (a *fakeAgent) sendControl(messageType string) {
+	msg := &ClientMessage{MessageType: messageType, SchemaVersion: 1, CreatedDate: time.Now(), MessageID: NewUUID()}
+	data, _ := msg.MarshalBinary()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (a *fakeAgent) closeChannel(output string) {
+	content, _ := json.Marshal(channelClosedContent{SessionID: "session-1", Output: output})
+	msg := &ClientMessage{MessageType: MessageTypeChannelClosed, SchemaVersion: 1, CreatedDate: time.Now(), MessageID: NewUUID(), Payload: content}
+	data, _ := msg.MarshalBinary()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// fakeAPI returns the fake agent's stream URL from StartSession
+type fakeAPI struct {
+	agent      *fakeAgent
+	startErr   error
+	mu         sync.Mutex
+	input      *ssm.StartSessionInput
+	terminated []string
+}
+
+func (f *fakeAPI) StartSession(ctx context.Context, params *ssm.StartSessionInput, optFns ...func(*ssm.Options)) (*ssm.StartSessionOutput, error) {
+	if f.startErr != nil {
+		return nil, f.startErr
+	}
+	f.mu.Lock()
+	f.input = params
+	f.mu.Unlock()
+	return &ssm.StartSessionOutput{
+		SessionId:  aws.String("session-1"),
+		StreamUrl:  aws.String(f.agent.url()),
+		TokenValue: aws.String(f.agent.token),
+	}, nil
+}
+
+func (f *fakeAPI) TerminateSession(ctx context.Context, params *ssm.TerminateSessionInput, optFns ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.terminated = append(f.terminated, *params.SessionId)
+	return &ssm.TerminateSessionOutput{SessionId: params.SessionId}, nil
+}
+
+func startTestSession(t *testing.T, agentVersion string) (*Session, *fakeAgent, *fakeAPI) {
+	t.Helper()
+	agent := newFakeAgent(t, agentVersion)
+	api := &fakeAPI{agent: agent}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := Start(ctx, api, Options{Target: "i-123", Host: "db.internal", Port: "3306"})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() { sess.Close() })
+	return sess, agent, api
+}
+
+// roundTrip forwards a connection through the session and checks the echo
+func roundTrip(t *testing.T, sess *Session, payload string) {
+	t.Helper()
+	local, remote := net.Pipe()
+	defer local.Close()
+
+	go sess.Forward(context.Background(), remote)
+
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := local.Write([]byte(payload)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(local, buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(buf) != payload {
+		t.Errorf("echo = %q, want %q", buf, payload)
+	}
+}
+
+func TestStartSendsPortForwardingParameters(t *testing.T) {
+	sess, agent, api := startTestSession(t, "3.1.1374.0")
+
+	if sess.ID() != "session-1" {
+		t.Errorf("ID() = %s, want session-1", sess.ID())
+	}
+	if *api.input.DocumentName != PortForwardingDocument {
+		t.Errorf("DocumentName = %s, want %s", *api.input.DocumentName, PortForwardingDocument)
+	}
+	if got := api.input.Parameters["host"]; len(got) != 1 || got[0] != "db.internal" {
+		t.Errorf("host parameter = %v, want [db.internal]", got)
+	}
+	if got := api.input.Parameters["portNumber"]; len(got) != 1 || got[0] != "3306" {
+		t.Errorf("portNumber parameter = %v, want [3306]", got)
+	}
+
+	agent.mu.Lock()
+	actions := agent.actions
+	agent.mu.Unlock()
+	if len(actions) != 1 || actions[0].ActionStatus != actionStatusSuccess {
+		t.Errorf("handshake actions = %+v, want one successful action", actions)
+	}
+}
+
+func TestForwardMultiplexed(t *testing.T) {
+	sess, _, _ := startTestSession(t, "3.1.1374.0")
+	if sess.mux == nil {
+		t.Fatal("expected multiplexed session")
+	}
+
+	var wg sync.WaitGroup
+	for _, payload := range []string{"first connection", "second connection", strings.Repeat("x", 5000)} {
+		wg.Add(1)
+		go func(payload string) {
+			defer wg.Done()
+			roundTrip(t, sess, payload)
+		}(payload)
+	}
+	wg.Wait()
+}
+
+func TestHandshakeWhilePaused(t *testing.T) {
+	agent := newFakeAgent(t, "3.1.1374.0")
+	agent.pauseFirst = true
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := Start(ctx, &fakeAPI{agent: agent}, Options{Target: "i-123", Host: "db.internal", Port: "3306"})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer sess.Close()
+
+	roundTrip(t, sess, "hello")
+}
+
+func TestCloseWhilePaused(t *testing.T) {
+	sess, agent, _ := startTestSession(t, "3.1.1374.0")
+	c := sess.channel
+
+	agent.sendControl(MessageTypePausePublication)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		paused := c.paused
+		c.mu.Unlock()
+		if paused {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("channel not paused")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sent := make(chan error, 1)
+	go func() { sent <- c.sendInput(PayloadTypeOutput, []byte("hello")) }()
+	time.Sleep(20 * time.Millisecond)
+	sess.Close()
+
+	select {
+	case err := <-sent:
+		if !errors.Is(err, ErrChannelClosed) {
+			t.Errorf("sendInput() error = %v, want %v", err, ErrChannelClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendInput() still waiting after the channel closed")
+	}
+}
+
+func TestOutputTooFarAheadDropped(t *testing.T) {
+	c := &dataChannel{log: slog.Default(), pending: make(map[int64]*ClientMessage)}
+
+	msg := &ClientMessage{MessageType: MessageTypeOutputStreamData, SequenceNumber: maxPendingMessages}
+	if err := c.handleOutput(msg); err != nil {
+		t.Fatalf("handleOutput() error = %v", err)
+	}
+	if len(c.pending) != 0 {
+		t.Errorf("pending = %d messages, want the message dropped", len(c.pending))
+	}
+}
+
+func TestStartRejectsAgentWithoutMux(t *testing.T) {
+	agent := newFakeAgent(t, "3.0.196.0")
+	api := &fakeAPI{agent: agent}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := Start(ctx, api, Options{Target: "i-123", Host: "db.internal", Port: "3306"})
+	if err == nil || !strings.Contains(err.Error(), "3.0.196.0") {
+		t.Errorf("Start() error = %v, want the agent version rejected", err)
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.terminated) != 1 {
+		t.Errorf("terminated = %v, want the session terminated", api.terminated)
+	}
+}
+
+func TestChannelClosedByAgent(t *testing.T) {
+	sess, agent, _ := startTestSession(t, "3.1.1374.0")
+
+	agent.closeChannel("session terminated by idle timeout")
+
+	select {
+	case <-sess.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed after channel_closed")
+	}
+	if err := sess.Err(); !errors.Is(err, ErrChannelClosed) || !strings.Contains(err.Error(), "idle timeout") {
+		t.Errorf("Err() = %v, want channel closed with agent output", err)
+	}
+}
+
+func TestCloseTerminatesSession(t *testing.T) {
+	sess, _, api := startTestSession(t, "3.1.1374.0")
+
+	if err := sess.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	sess.Close()
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.terminated) != 1 || api.terminated[0] != "session-1" {
+		t.Errorf("terminated = %v, want [session-1]", api.terminated)
+	}
+}
+
+func TestStartError(t *testing.T) {
+	api := &fakeAPI{startErr: errors.New("access denied")}
+	_, err := Start(context.Background(), api, Options{Target: "i-123", Host: "db", Port: "3306"})
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("Start() error = %v, want access denied", err)
+	}
+}
+
+func TestAbortDoesNotTerminate(t *testing.T) {
+	sess, _, api := startTestSession(t, "3.1.1374.0")
+
+	sess.Abort()
+
+	select {
+	case <-sess.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed after Abort")
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.terminated) != 0 {
+		t.Errorf("terminated = %v, want no TerminateSession call", api.terminated)
+	}
+}
@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"errors"
+
+	awsclient "tunnel-go/pkg/aws"
+)
+
+// Kinds of failure to create a tunnel. Errors of CreateTunnel and
+// CreateTunnels match them with errors.Is.
+var (
+	// ErrConfig is a service that is not configured or whose values cannot
+	// be resolved
+	ErrConfig = errors.New("invalid service configuration")
+	// ErrNoJumphost is no usable jumphost being found
+	ErrNoJumphost = errors.New("no usable jumphost")
+	// ErrNoPort is no local port of a service being available
+	ErrNoPort = errors.New("no local port available")
+	// ErrSession is a session that could not be started, or a service that
+	// is not reachable through it
+	ErrSession = errors.New("session failed")
+)
+
+// Reasons returned by FailureReason
+const (
+	ReasonConfig   = "config"
+	ReasonAuth     = "auth"
+	ReasonJumphost = "jumphost"
+	ReasonPorts    = "ports"
+	ReasonSession  = "session"
+)
+
+// FailureReason returns the main reason a tunnel could not be created, or ""
+// if err is of no known kind. AWS rejecting the credentials comes first, as
+// it usually causes the other failures, followed by the kinds above in order.
+func FailureReason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case awsclient.IsAuthError(err):
+		return ReasonAuth
+	case errors.Is(err, ErrConfig):
+		return ReasonConfig
+	case errors.Is(err, ErrNoJumphost):
+		return ReasonJumphost
+	case errors.Is(err, ErrNoPort):
+		return ReasonPorts
+	case errors.Is(err, ErrSession):
+		return ReasonSession
+	default:
+		return ""
+	}
+}
+
+// kindError marks an error as a failure of a kind without changing its
+// message
+type kindError struct {
+	kind error
+	err  error
+}
+
+// failure returns err marked as a failure of kind, or nil if err is nil
+func failure(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"tunnel-go/pkg/health"
+)
+
+const (
+	// defaultHealthInterval is how often a service's health check runs when
+	// the configuration does not say
+	defaultHealthInterval = 30 * time.Second
+
+	// defaultHealthTimeout bounds each run of a health check when the
+	// configuration does not say
+	defaultHealthTimeout = 5 * time.Second
+
+	// defaultHealthFailures is how many health checks in a row must fail
+	// before the session is reconnected when the configuration does not say
+	defaultHealthFailures = 3
+
+	// healthRetryDelay is the pause between attempts of the health check
+	// that runs while a tunnel is created
+	healthRetryDelay = time.Second
+)
+
+// healthInterval returns how often the tunnel's health check runs
+func (t *activeTunnel) healthInterval() time.Duration {
+	if d := t.healthCheck.Interval; d > 0 {
+		return d
+	}
+	return defaultHealthInterval
+}
+
+// healthFailures returns how many health checks in a row must fail before
+// the tunnel's session is reconnected
+func (t *activeTunnel) healthFailures() int {
+	if n := t.healthCheck.Failures; n > 0 {
+		return n
+	}
+	return defaultHealthFailures
+}
+
+// setHealth records the outcome of a health check
+func (t *activeTunnel) setHealth(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.healthCheckedAt = time.Now()
+	t.healthErr = err
+}
+
+// checkHealth runs the tunnel's health check once through sess and records
+// the outcome for status. The check's connection is forwarded like one
+// accepted on the local port, without counting as a connection of the
+// tunnel, so it neither shows up in its metrics nor keeps it from idling.
+func (m *Manager) checkHealth(ctx context.Context, t *activeTunnel, sess Session) error {
+	hc := t.healthCheck
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	t.mu.Lock()
+	serverName := hc.ServerName
+	if serverName == "" {
+		serverName = t.host
+	}
+	t.mu.Unlock()
+
+	check := health.Check{
+		Type:               hc.Type,
+		ServerName:         serverName,
+		InsecureSkipVerify: hc.InsecureSkipVerify,
+		Path:               hc.Path,
+		Status:             hc.Status,
+	}
+	err := check.Run(ctx, func(ctx context.Context) (net.Conn, error) {
+		local, remote := net.Pipe()
+		go sess.Forward(ctx, remote)
+		return local, nil
+	})
+	t.setHealth(err)
+	return err
+}
+
+// awaitHealthy runs the health check of a tunnel being created until it
+// passes, giving up after as many attempts as failures are tolerated or
+// once ctx is done
+func (m *Manager) awaitHealthy(ctx context.Context, t *activeTunnel, sess Session) error {
+	attempts := t.healthFailures()
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = m.checkHealth(ctx, t, sess); err == nil {
+			t.log.Debug("Health check passed", "check", t.healthCheck.Type)
+			return nil
+		}
+		t.log.Debug("Health check failed", "check", t.healthCheck.Type, "attempt", attempt, "error", err)
+		if attempt < attempts {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(healthRetryDelay):
+			}
+		}
+	}
+	return err
+}
+
+// monitorHealth runs the tunnel's health check periodically and ends the
+// session once the check has failed too many times in a row, so the
+// supervisor reconnects it. Checks are skipped while the tunnel has no
+// session or has connections open, which already exercise it.
+func (m *Manager) monitorHealth(t *activeTunnel) {
+	ticker := time.NewTicker(t.healthInterval())
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		sess := t.currentSession()
+		if sess == nil || t.activeConnections.Load() > 0 {
+			continue
+		}
+		err := m.checkHealth(context.Background(), t, sess)
+		if err == nil {
+			if failures > 0 {
+				t.log.Info("Health check passed again", "check", t.healthCheck.Type)
+			}
+			failures = 0
+			continue
+		}
+
+		failures++
+		t.log.Warn("Health check failed", "check", t.healthCheck.Type, "failures", failures, "error", err)
+		if failures < t.healthFailures() || t.currentSession() != sess {
+			continue
+		}
+		failures = 0
+		t.log.Warn(fmt.Sprintf("Service unreachable through tunnel: %s, reconnecting", t.localAddress()), "session", sess.ID())
+		ctx, cancel := context.WithTimeout(context.Background(), sessionStartTimeout)
+		if err := sess.Terminate(ctx); err != nil {
+			t.log.Warn("Failed to terminate unhealthy session", "session", sess.ID(), "error", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,168 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"tunnel-go/pkg/config"
+)
+
+// MissingParameter is an SSM parameter referenced by a service that does not exist
+type MissingParameter struct {
+	Service string
+	// Field is host, remote-port or service-details
+	Field string
+	Name  string
+}
+
+// MissingParametersError lists every missing SSM parameter found while
+// resolving a set of services
+type MissingParametersError struct {
+	Parameters []MissingParameter
+}
+
+func (e *MissingParametersError) Error() string {
+	refs := make([]string, len(e.Parameters))
+	for i, p := range e.Parameters {
+		refs[i] = fmt.Sprintf("%s (%s %s)", p.Name, p.Service, p.Field)
+	}
+	return "SSM parameters not found: " + strings.Join(refs, ", ")
+}
+
+// serviceValues are the resolved values of a service
+type serviceValues struct {
+	host       string
+	remotePort string
+	// details maps the last element of each service-details parameter name
+	// to its value
+	details map[string]string
+}
+
+// parameterRef is a value of a service read from an SSM parameter. Host and
+// remote port references are stored in dst; service details have no dst.
+type parameterRef struct {
+	service string
+	field   string
+	name    string
+	dst     *string
+}
+
+// resolveServices resolves the host and remote port of each service and, if
+// withDetails is set, its service details. Every SSM parameter referenced by
+// the services is collected first and fetched in a single batched lookup.
+//
+// The returned map holds the services that resolved. The error joins the
+// problems with the others, reporting all missing parameters together in a
+// *MissingParametersError. Missing service details are reported but do not
+// keep a service from resolving.
+func (m *Manager) resolveServices(configs map[string]config.ServiceConfig, withDetails bool) (map[string]*serviceValues, error) {
+	var names []string
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resolved := make(map[string]*serviceValues, len(configs))
+	var refs []parameterRef
+	var errs []error
+	for _, name := range names {
+		v, serviceRefs, err := m.collectParameters(name, configs[name], withDetails)
+		if err != nil {
+			errs = append(errs, failure(ErrConfig, err))
+			continue
+		}
+		resolved[name] = v
+		refs = append(refs, serviceRefs...)
+	}
+	if len(refs) == 0 {
+		return resolved, errors.Join(errs...)
+	}
+
+	seen := make(map[string]bool, len(refs))
+	var paramNames []string
+	for _, ref := range refs {
+		if !seen[ref.name] {
+			seen[ref.name] = true
+			paramNames = append(paramNames, ref.name)
+		}
+	}
+	m.log.Debug("Getting parameters", "count", len(paramNames))
+
+	values, _, err := m.parameters.GetParameters(paramNames)
+	if err != nil {
+		for _, ref := range refs {
+			delete(resolved, ref.service)
+		}
+		errs = append(errs, fmt.Errorf("failed to get parameters: %w", err))
+		return resolved, errors.Join(errs...)
+	}
+
+	missing := &MissingParametersError{}
+	for _, ref := range refs {
+		value, ok := values[ref.name]
+		if !ok {
+			missing.Parameters = append(missing.Parameters, MissingParameter{Service: ref.service, Field: ref.field, Name: ref.name})
+			if ref.dst != nil {
+				delete(resolved, ref.service)
+			}
+			continue
+		}
+		if ref.dst != nil {
+			*ref.dst = value
+			continue
+		}
+		if v, ok := resolved[ref.service]; ok {
+			v.details[detailName(ref.name)] = value
+		}
+	}
+	if len(missing.Parameters) > 0 {
+		errs = append(errs, failure(ErrConfig, missing))
+	}
+	return resolved, errors.Join(errs...)
+}
+
+// collectParameters expands the values of a service, filling in the literal
+// ones and returning references to those read from SSM
+func (m *Manager) collectParameters(serviceName string, serviceConfig config.ServiceConfig, withDetails bool) (*serviceValues, []parameterRef, error) {
+	vars := m.vars.With(config.VarService, serviceName)
+	v := &serviceValues{details: make(map[string]string)}
+
+	var refs []parameterRef
+	for _, f := range []struct {
+		field string
+		value config.ConfigValue
+		dst   *string
+	}{
+		{"host", serviceConfig.Host, &v.host},
+		{"remote-port", serviceConfig.RemotePort, &v.remotePort},
+	} {
+		value, param, err := f.value.Expand(vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get %s for %s: %w", f.field, serviceName, err)
+		}
+		if param == "" {
+			*f.dst = value
+			continue
+		}
+		refs = append(refs, parameterRef{service: serviceName, field: f.field, name: param, dst: f.dst})
+	}
+
+	if withDetails {
+		for _, path := range serviceConfig.ServiceDetails {
+			param, err := vars.Expand(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid service details path for %s: %w", serviceName, err)
+			}
+			refs = append(refs, parameterRef{service: serviceName, field: "service-details", name: param})
+		}
+	}
+	return v, refs, nil
+}
+
+// detailName extracts the parameter name without its path
+func detailName(name string) string {
+	parts := strings.Split(name, "/")
+	return parts[len(parts)-1]
+}
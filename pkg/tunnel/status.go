@@ -0,0 +1,221 @@
+package tunnel
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// TunnelStatus describes an active tunnel
+type TunnelStatus struct {
+	Service      string    `json:"service"`
+	Env          string    `json:"env"`
+	JumphostID   string    `json:"jumphost_id,omitempty"`
+	JumphostName string    `json:"jumphost_name,omitempty"`
+	LocalPort    int       `json:"local_port"`
+	BindAddress  string    `json:"bind_address"`
+	RemoteHost   string    `json:"remote_host"`
+	RemotePort   string    `json:"remote_port"`
+	SessionID    string    `json:"session_id,omitempty"`
+	Connected    bool      `json:"connected"`
+	StartedAt    time.Time `json:"started_at"`
+	// BytesIn counts bytes received from the remote host, BytesOut bytes sent to it
+	BytesIn    int64 `json:"bytes_in"`
+	BytesOut   int64 `json:"bytes_out"`
+	Reconnects int   `json:"reconnects"`
+	// Connections counts the local connections accepted, ActiveConnections
+	// those still open and ConnectionErrors those dropped or failed
+	Connections       int64 `json:"connections"`
+	ActiveConnections int64 `json:"active_connections"`
+	ConnectionErrors  int64 `json:"connection_errors"`
+	// ConnectionTime sums the durations of closed connections, and
+	// LongestConnection is the longest of them
+	ConnectionTime    time.Duration `json:"connection_time_ns"`
+	LongestConnection time.Duration `json:"longest_connection_ns"`
+	// Lazy tunnels start their session on the first connection. Idle is set
+	// while one has no session and waits for a connection.
+	Lazy bool `json:"lazy,omitempty"`
+	Idle bool `json:"idle,omitempty"`
+	// LastActive is when the tunnel last had a connection open. IdleTimeout
+	// is how long it may go without one before it is closed, and Keepalive
+	// how often keepalive traffic goes through the session; both are zero
+	// unless configured.
+	LastActive  time.Time     `json:"last_active"`
+	IdleTimeout time.Duration `json:"idle_timeout_ns,omitempty"`
+	Keepalive   time.Duration `json:"keepalive_ns,omitempty"`
+	// HealthCheck is the type of the service's health check, if it has one.
+	// HealthCheckedAt is when it last ran and HealthError why it failed.
+	HealthCheck     string    `json:"health_check,omitempty"`
+	HealthCheckedAt time.Time `json:"health_checked_at,omitempty"`
+	HealthError     string    `json:"health_error,omitempty"`
+}
+
+// LocalAddress returns the host and port to connect to the tunnel on
+func (s TunnelStatus) LocalAddress() string {
+	host := s.BindAddress
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(s.LocalPort))
+}
+
+// RemoteAddress returns the host and port the tunnel forwards to, or - for a
+// lazy tunnel whose service has not been resolved yet
+func (s TunnelStatus) RemoteAddress() string {
+	if s.RemoteHost == "" {
+		return "-"
+	}
+	return s.RemoteHost + ":" + s.RemotePort
+}
+
+// AverageConnection returns the average duration of closed connections
+func (s TunnelStatus) AverageConnection() time.Duration {
+	closed := s.Connections - s.ActiveConnections
+	if closed <= 0 {
+		return 0
+	}
+	return s.ConnectionTime / time.Duration(closed)
+}
+
+// IdleFor returns how long the tunnel has had no connection, or zero while
+// one is open
+func (s TunnelStatus) IdleFor() time.Duration {
+	if s.ActiveConnections > 0 {
+		return 0
+	}
+	return time.Since(s.LastActive)
+}
+
+// Uptime returns how long the tunnel has been open
+func (s TunnelStatus) Uptime() time.Duration {
+	return time.Since(s.StartedAt)
+}
+
+// Tunnels returns the status of every active tunnel, sorted by service name
+func (m *Manager) Tunnels() []TunnelStatus {
+	var statuses []TunnelStatus
+	m.tunnels.Range(func(key, value interface{}) bool {
+		st := value.(*activeTunnel).status()
+		st.Env = m.env
+		statuses = append(statuses, st)
+		return true
+	})
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Service < statuses[j].Service })
+	return statuses
+}
+
+// status returns a snapshot of the tunnel's state
+func (t *activeTunnel) status() TunnelStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := TunnelStatus{
+		Service:      t.serviceName,
+		JumphostID:   t.jumphostID,
+		JumphostName: t.jumphostName,
+		LocalPort:    t.localPort,
+		BindAddress:  t.bindAddress(),
+		RemoteHost:   t.host,
+		RemotePort:   t.remotePort,
+		Connected:    t.session != nil,
+		Lazy:         t.lazy,
+		Idle:         t.asleep,
+		StartedAt:    t.startedAt,
+		BytesIn:      t.bytesIn.Load(),
+		BytesOut:     t.bytesOut.Load(),
+		Reconnects:   t.reconnects,
+
+		Connections:       t.connections.Load(),
+		ActiveConnections: t.activeConnections.Load(),
+		ConnectionErrors:  t.connectionErrors.Load(),
+		ConnectionTime:    t.connectionTime,
+		LongestConnection: t.longestConnection,
+
+		LastActive:  t.lastActive,
+		IdleTimeout: t.idleTimeout,
+		Keepalive:   t.keepalive,
+	}
+	if t.session != nil {
+		st.SessionID = t.session.ID()
+	}
+	if t.healthCheck != nil {
+		st.HealthCheck = t.healthCheck.Type
+		st.HealthCheckedAt = t.healthCheckedAt
+	}
+	if t.healthErr != nil {
+		st.HealthError = t.healthErr.Error()
+	}
+	return st
+}
+
+// bindAddress returns the address the tunnel's listener is bound on
+func (t *activeTunnel) bindAddress() string {
+	if t.listener == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(t.listener.Addr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// localAddress returns the host and port to connect to the tunnel on
+func (t *activeTunnel) localAddress() string {
+	return TunnelStatus{BindAddress: t.bindAddress(), LocalPort: t.localPort}.LocalAddress()
+}
+
+// setJumphost records the jumphost the tunnel's session runs on
+func (t *activeTunnel) setJumphost(instance *types.Instance) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.jumphostID = *instance.InstanceId
+	t.jumphostName = getInstanceName(instance)
+}
+
+// connectionOpened records a local connection being accepted
+func (t *activeTunnel) connectionOpened() {
+	t.connections.Add(1)
+	t.activeConnections.Add(1)
+}
+
+// connectionClosed records a local connection opened at start ending, with
+// the error that ended it if any
+func (t *activeTunnel) connectionClosed(start time.Time, err error) {
+	elapsed := time.Since(start)
+	t.activeConnections.Add(-1)
+	if err != nil {
+		t.connectionErrors.Add(1)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastActive = time.Now()
+	t.connectionTime += elapsed
+	if elapsed > t.longestConnection {
+		t.longestConnection = elapsed
+	}
+}
+
+// countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	read    *atomic.Int64
+	written *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,512 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tunnel-go/pkg/config"
+)
+
+const (
+	// reconnectInitialDelay is the base delay before the first reconnect attempt
+	reconnectInitialDelay = time.Second
+
+	// reconnectMaxDelay caps the delay between reconnect attempts
+	reconnectMaxDelay = time.Minute
+
+	// connectionWaitTimeout is how long a new local connection waits for a
+	// session while the tunnel is reconnecting
+	connectionWaitTimeout = 30 * time.Second
+
+	// keepaliveTimeout bounds opening a keepalive connection through the
+	// session
+	keepaliveTimeout = 10 * time.Second
+)
+
+// activeTunnel is a local listener forwarding connections through an SSM
+// session. The session is replaced by the supervisor when it drops, while the
+// listener (and therefore the local port) stays open.
+type activeTunnel struct {
+	serviceName string
+	host        string
+	remotePort  string
+	localPort   int
+	listener    net.Listener
+	// log attaches the service name to everything logged for the tunnel
+	log *slog.Logger
+
+	// lazy is set for tunnels that start their session on the first
+	// connection, from service, and end it again when idle. wakeMu
+	// serializes starting the session.
+	lazy    bool
+	service config.ServiceConfig
+	wakeMu  sync.Mutex
+
+	// idleTimeout closes the tunnel once it has had no connection for that
+	// long, and keepalive is how often keepalive traffic is sent through its
+	// session and TCP keepalives on its local connections. Zero disables
+	// either.
+	idleTimeout time.Duration
+	keepalive   time.Duration
+	// healthCheck checks the service through the tunnel, if configured
+	healthCheck *config.HealthCheck
+
+	mu           sync.Mutex
+	session      Session
+	ready        chan struct{}
+	reconnects   int
+	jumphostID   string
+	jumphostName string
+	// asleep is set while a lazy tunnel has no session and waits for a
+	// connection to start one. lastActive is when the tunnel last had a
+	// connection, or was created or woken.
+	asleep     bool
+	lastActive time.Time
+
+	startedAt time.Time
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+
+	connections       atomic.Int64
+	activeConnections atomic.Int64
+	connectionErrors  atomic.Int64
+	// connectionTime and longestConnection are guarded by mu
+	connectionTime    time.Duration
+	longestConnection time.Duration
+	// healthCheckedAt is when the health check last ran and healthErr why
+	// it failed, both guarded by mu
+	healthCheckedAt time.Time
+	healthErr       error
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// newActiveTunnel creates a tunnel that is waiting for its first session
+func newActiveTunnel(serviceName, host, remotePort string, localPort int, listener net.Listener) *activeTunnel {
+	now := time.Now()
+	return &activeTunnel{
+		serviceName: serviceName,
+		host:        host,
+		remotePort:  remotePort,
+		localPort:   localPort,
+		listener:    listener,
+		log:         slog.Default().With("service", serviceName),
+		startedAt:   now,
+		lastActive:  now,
+		ready:       make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+}
+
+// setSession installs a connected session and wakes waiting connections
+func (t *activeTunnel) setSession(sess Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.session = sess
+	close(t.ready)
+}
+
+// replaceSession installs a reconnected session unless the tunnel has been
+// closed in the meantime, in which case the caller must close the session
+func (t *activeTunnel) replaceSession(sess Session) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped() {
+		return false
+	}
+	t.session = sess
+	t.reconnects++
+	close(t.ready)
+	return true
+}
+
+// wakeSession installs the session started for a lazy tunnel
+func (t *activeTunnel) wakeSession(sess Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.session = sess
+	t.asleep = false
+	t.lastActive = time.Now()
+	close(t.ready)
+}
+
+// isAsleep reports whether a lazy tunnel waits for a connection to start
+// its session
+func (t *activeTunnel) isAsleep() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.asleep
+}
+
+// sleep removes the session of a lazy tunnel that has had no connection for
+// timeout and returns it for the caller to end, or returns nil if the tunnel
+// is in use or has no session
+func (t *activeTunnel) sleep(timeout time.Duration) Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.session == nil || t.activeConnections.Load() > 0 || time.Since(t.lastActive) < timeout {
+		return nil
+	}
+	sess := t.session
+	t.session = nil
+	t.asleep = true
+	t.ready = make(chan struct{})
+	return sess
+}
+
+// untilIdle returns how long until a lazy tunnel has been without
+// connections for timeout, assuming none is opened in the meantime
+func (t *activeTunnel) untilIdle(timeout time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.session == nil || t.activeConnections.Load() > 0 {
+		return timeout
+	}
+	return timeout - time.Since(t.lastActive)
+}
+
+// idleFor returns how long the tunnel has had no connection, or zero while
+// one is open
+func (t *activeTunnel) idleFor() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.activeConnections.Load() > 0 {
+		return 0
+	}
+	return time.Since(t.lastActive)
+}
+
+// clearSession removes a dropped session so new connections wait for a reconnect
+func (t *activeTunnel) clearSession() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.session = nil
+	t.ready = make(chan struct{})
+}
+
+// currentSession returns the connected session, or nil while reconnecting
+func (t *activeTunnel) currentSession() Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.session
+}
+
+// waitSession returns the connected session, waiting up to timeout for a reconnect
+func (t *activeTunnel) waitSession(timeout time.Duration) (Session, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		t.mu.Lock()
+		sess, ready := t.session, t.ready
+		t.mu.Unlock()
+		if sess != nil {
+			return sess, nil
+		}
+
+		select {
+		case <-ready:
+		case <-t.stop:
+			return nil, fmt.Errorf("tunnel closed")
+		case <-timer.C:
+			return nil, fmt.Errorf("no session available after %s", timeout)
+		}
+	}
+}
+
+// stopped reports whether the tunnel has been closed
+func (t *activeTunnel) stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops accepting connections and terminates the session
+func (t *activeTunnel) close(ctx context.Context) error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	t.listener.Close()
+
+	sess := t.currentSession()
+	if sess == nil {
+		return nil
+	}
+	return sess.Terminate(ctx)
+}
+
+// abort drops the session without waiting for Session Manager
+func (t *activeTunnel) abort() {
+	t.stopOnce.Do(func() { close(t.stop) })
+	t.listener.Close()
+
+	if sess := t.currentSession(); sess != nil {
+		sess.Abort()
+	}
+}
+
+// backoff produces exponentially growing delays with jitter
+type backoff struct {
+	attempt int
+}
+
+// next returns the delay before the next attempt, randomised within the
+// upper half of the current exponential step so parallel tunnels spread out
+func (b *backoff) next() time.Duration {
+	d := reconnectInitialDelay << b.attempt
+	if d <= 0 || d > reconnectMaxDelay {
+		d = reconnectMaxDelay
+	} else {
+		b.attempt++
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// serve accepts local connections and forwards each through the tunnel's
+// current session, waiting for a reconnect if the session has dropped
+func (m *Manager) serve(t *activeTunnel) {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			t.log.Debug("Stopped accepting connections", "error", err)
+			return
+		}
+		if t.keepalive > 0 {
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetKeepAlive(true)
+				tcp.SetKeepAlivePeriod(t.keepalive)
+			}
+		}
+		go m.proxy(t, conn)
+	}
+}
+
+// proxy forwards one local connection through the tunnel and records it in
+// the tunnel's connection metrics
+func (m *Manager) proxy(t *activeTunnel, conn net.Conn) {
+	start := time.Now()
+	t.connectionOpened()
+
+	if t.lazy {
+		if err := m.wake(t); err != nil {
+			conn.Close()
+			t.log.Error("Failed to start session of lazy tunnel", "error", err)
+			t.connectionClosed(start, err)
+			return
+		}
+	}
+	sess, err := t.waitSession(connectionWaitTimeout)
+	if err != nil {
+		conn.Close()
+		t.log.Warn("Dropping connection", "error", err)
+		t.connectionClosed(start, err)
+		return
+	}
+	counted := &countingConn{Conn: conn, read: &t.bytesOut, written: &t.bytesIn}
+	err = sess.Forward(context.Background(), counted)
+	if err != nil {
+		t.log.Warn("Connection failed", "error", err)
+	}
+	t.connectionClosed(start, err)
+	t.log.Debug("Connection closed", "client", conn.RemoteAddr().String(), "duration", time.Since(start).Round(time.Millisecond))
+}
+
+// wake starts the session of a lazy tunnel that is asleep, resolving the
+// service on the first call and picking a jumphost if there is none yet
+func (m *Manager) wake(t *activeTunnel) error {
+	t.wakeMu.Lock()
+	defer t.wakeMu.Unlock()
+	if !t.isAsleep() {
+		return nil
+	}
+
+	t.mu.Lock()
+	resolved := t.host != ""
+	t.mu.Unlock()
+	if !resolved {
+		values, err := m.resolveServices(map[string]config.ServiceConfig{t.serviceName: t.service}, false)
+		v, ok := values[t.serviceName]
+		if !ok {
+			return err
+		}
+		t.mu.Lock()
+		t.host, t.remotePort = v.host, v.remotePort
+		t.mu.Unlock()
+		t.log.Debug("Resolved remote address", "host", v.host, "remote_port", v.remotePort)
+	}
+	m.addHosts(t.host)
+
+	if err := m.ensureJumphost(); err != nil {
+		return err
+	}
+	sess, err := m.startSession(context.Background(), t)
+	if err != nil {
+		return failure(ErrSession, fmt.Errorf("failed to start session for %s: %w", t.serviceName, err))
+	}
+	t.wakeSession(sess)
+	go m.supervise(t)
+	go m.sleepWhenIdle(t)
+
+	t.log.Info(fmt.Sprintf("Started session of lazy tunnel: %s -> %s:%s", t.localAddress(), t.host, t.remotePort),
+		"session", sess.ID())
+	return nil
+}
+
+// sleepWhenIdle ends the session of a lazy tunnel once it has had no
+// connection for the lazy idle timeout, leaving the local port open for the
+// next connection to start a new one
+func (m *Manager) sleepWhenIdle(t *activeTunnel) {
+	timeout := m.lazyIdleTimeout()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(t.untilIdle(timeout)):
+		}
+
+		sess := t.sleep(timeout)
+		if sess == nil {
+			continue
+		}
+		t.log.Info("Closing idle session of lazy tunnel", "session", sess.ID(), "idle", timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), sessionStartTimeout)
+		if err := sess.Terminate(ctx); err != nil {
+			t.log.Warn("Failed to terminate idle session", "session", sess.ID(), "error", err)
+		}
+		cancel()
+		return
+	}
+}
+
+// logIdleSettings reports the idle timeout and keepalive interval configured
+// for the tunnel
+func (t *activeTunnel) logIdleSettings() {
+	if t.idleTimeout > 0 {
+		t.log.Info(fmt.Sprintf("Tunnel closes after %s without connections", t.idleTimeout), "idle_timeout", t.idleTimeout)
+	}
+	if t.keepalive > 0 {
+		t.log.Info(fmt.Sprintf("Sending keepalives every %s", t.keepalive), "keepalive", t.keepalive)
+	}
+}
+
+// sendKeepalives opens a connection through the tunnel's session every
+// keepalive interval, so the agent connects to the remote port and Session
+// Manager sees the session in use even while the connections through the
+// tunnel are quiet. Like a health check, the connection does not count as
+// one of the tunnel's, so it neither shows up in its metrics nor keeps it
+// from idling.
+func (m *Manager) sendKeepalives(t *activeTunnel) {
+	ticker := time.NewTicker(t.keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		sess := t.currentSession()
+		if sess == nil {
+			continue
+		}
+		// The connection is closed from the start, so the session opens
+		// a stream to the remote port and closes it again right away
+		local, remote := net.Pipe()
+		local.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), keepaliveTimeout)
+		if err := sess.Forward(ctx, remote); err != nil {
+			t.log.Debug("Failed to send keepalive", "session", sess.ID(), "error", err)
+		}
+		cancel()
+	}
+}
+
+// closeWhenIdle closes the tunnel, releasing its local port, once it has had
+// no connection for its idle timeout
+func (m *Manager) closeWhenIdle(t *activeTunnel) {
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(t.idleTimeout - t.idleFor()):
+		}
+		if t.idleFor() < t.idleTimeout {
+			continue
+		}
+		if value, ok := m.tunnels.Load(t.serviceName); !ok || value != t {
+			return
+		}
+
+		t.log.Info(fmt.Sprintf("Closing tunnel unused for %s: %s", t.idleTimeout, t.localAddress()), "idle_timeout", t.idleTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		m.CloseTunnels(ctx, []string{t.serviceName})
+		cancel()
+		return
+	}
+}
+
+// supervise watches the tunnel's session and reconnects it with exponential
+// backoff whenever it ends, until the tunnel is closed or, for a lazy
+// tunnel, its session is ended for being idle
+func (m *Manager) supervise(t *activeTunnel) {
+	for {
+		sess := t.currentSession()
+		if sess == nil {
+			return
+		}
+		select {
+		case <-t.stop:
+			return
+		case <-sess.Done():
+		}
+
+		if t.stopped() || t.currentSession() != sess {
+			return
+		}
+		t.log.Warn("Session ended, reconnecting", "session", sess.ID(), "error", sess.Err())
+		t.clearSession()
+		sess.Close()
+
+		var b backoff
+		for attempt := 1; ; attempt++ {
+			delay := b.next()
+			t.log.Debug("Scheduling reconnect", "attempt", attempt, "delay", delay.Round(time.Millisecond))
+			select {
+			case <-t.stop:
+				return
+			case <-time.After(delay):
+			}
+
+			newSess, err := m.reconnectSession(t)
+			if err != nil {
+				t.log.Warn("Reconnect failed", "attempt", attempt, "error", err)
+				continue
+			}
+			if !t.replaceSession(newSess) {
+				// The tunnel was closed while reconnecting
+				newSess.Close()
+				return
+			}
+			t.log.Info(fmt.Sprintf("Reconnected tunnel: %s -> %s:%s", t.localAddress(), t.host, t.remotePort),
+				"session", newSess.ID(), "attempt", attempt)
+			break
+		}
+	}
+}
+
+// reconnectSession starts a new session for the tunnel, first replacing the
+// jumphost if it is no longer running
+func (m *Manager) reconnectSession(t *activeTunnel) (Session, error) {
+	if err := m.ensureJumphost(); err != nil {
+		return nil, err
+	}
+	return m.startSession(context.Background(), t)
+}
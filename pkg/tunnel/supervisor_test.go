@@ -0,0 +1,33 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	var b backoff
+	want := reconnectInitialDelay
+	for i := 0; i < 10; i++ {
+		got := b.next()
+		if got < want/2 || got > want {
+			t.Errorf("attempt %d: next() = %s, want between %s and %s", i, got, want/2, want)
+		}
+		want *= 2
+		if want > reconnectMaxDelay {
+			want = reconnectMaxDelay
+		}
+	}
+}
+
+func TestWaitSessionTimeout(t *testing.T) {
+	tun := newActiveTunnel("db", "host", "3306", 5000, nil)
+
+	start := time.Now()
+	if _, err := tun.waitSession(50 * time.Millisecond); err == nil {
+		t.Fatal("waitSession() expected error without a session")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("waitSession() returned after %s, want at least 50ms", elapsed)
+	}
+}
@@ -1,221 +1,625 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
-	"os"
-	"os/exec"
-	"strings"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
 
 	awsclient "tunnel-go/pkg/aws"
 	"tunnel-go/pkg/config"
+	"tunnel-go/pkg/session"
 )
 
+const (
+	// sessionStartTimeout bounds starting a session and completing its handshake
+	sessionStartTimeout = 30 * time.Second
+
+	// defaultConcurrency is how many tunnels are created at once when the
+	// configuration does not say
+	defaultConcurrency = 4
+
+	// defaultBindAddress is the address tunnels listen on when the
+	// configuration does not say
+	defaultBindAddress = "127.0.0.1"
+
+	// defaultLazyIdleTimeout is how long the session of a lazy tunnel stays
+	// open without connections when the configuration does not say
+	defaultLazyIdleTimeout = 15 * time.Minute
+)
+
+// InstanceFinder discovers jumphost instances
+type InstanceFinder interface {
+	GetJumphost(query awsclient.JumphostQuery) (*types.Instance, error)
+	// JumphostProblem returns why an instance can no longer be used as a
+	// jumphost, or "" if it still can
+	JumphostProblem(instanceID string) (string, error)
+}
+
+// ParameterStore looks up SSM parameters
+type ParameterStore interface {
+	GetParameter(name string) (string, error)
+	GetParametersByPath(paths []string) ([]ssmtypes.Parameter, error)
+	// GetParameters returns the values of the named parameters and, apart,
+	// the names that do not exist
+	GetParameters(names []string) (map[string]string, []string, error)
+}
+
+// Session is a running port forwarding session
+type Session interface {
+	ID() string
+	Forward(ctx context.Context, conn net.Conn) error
+	Done() <-chan struct{}
+	Err() error
+	Terminate(ctx context.Context) error
+	Abort()
+	Close() error
+}
+
+// SessionStarter starts port forwarding sessions
+type SessionStarter interface {
+	StartSession(ctx context.Context, opts session.Options) (Session, error)
+}
+
+// PortReserver reserves local ports so that tunnel-go processes running at
+// the same time never pick the same port
+type PortReserver interface {
+	// Reserve listens on the first free port in start-end on address and
+	// holds it for service until Release is called
+	Reserve(address string, start, end int, service, env string) (net.Listener, int, error)
+	Release(port int) error
+}
+
+// Dependencies are the external services a Manager relies on. Ports is
+// optional; without it ports are only coordinated within the process.
+type Dependencies struct {
+	Instances  InstanceFinder
+	Parameters ParameterStore
+	Sessions   SessionStarter
+	Ports      PortReserver
+}
+
+// ssmSessionStarter starts sessions with the native Session Manager client
+type ssmSessionStarter struct {
+	api session.API
+}
+
+// StartSession starts a session and completes its handshake
+func (s ssmSessionStarter) StartSession(ctx context.Context, opts session.Options) (Session, error) {
+	sess, err := session.Start(ctx, s.api, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
 // Manager handles tunnel creation and management
 type Manager struct {
-	client   *awsclient.Client
-	config   *config.Config
-	env      string
-	tunnels  sync.Map
-	verbose  bool
+	instances  InstanceFinder
+	parameters ParameterStore
+	sessions   SessionStarter
+	ports      PortReserver
+	config     *config.Config
+	env        string
+	vars       *config.Vars
+	tunnels    sync.Map
+	log        *slog.Logger
+
+	// mu guards jumphost, which supervisors may replace while reconnecting,
+	// and hosts, the remote hosts of the tunnels, which the same-az strategy
+	// picks a jumphost for
+	mu       sync.Mutex
 	jumphost *types.Instance
+	hosts    []string
 }
 
-// NewManager creates a new tunnel manager
-func NewManager(client *awsclient.Client, cfg *config.Config, env string, verbose bool) *Manager {
+// NewManager creates a new tunnel manager backed by AWS. vars holds the
+// template variables expanded in the configuration; when nil only the
+// variables derived from cfg and env are available. Messages are logged to
+// logger, or to the default logger when it is nil.
+func NewManager(client *awsclient.Client, cfg *config.Config, env string, vars *config.Vars, logger *slog.Logger) *Manager {
+	return NewManagerWithDependencies(AWSDependencies(client), cfg, env, vars, logger)
+}
+
+// AWSDependencies returns the services of a Manager backed by client
+func AWSDependencies(client *awsclient.Client) Dependencies {
+	return Dependencies{
+		Instances:  client,
+		Parameters: client,
+		Sessions:   ssmSessionStarter{api: client.SSM},
+	}
+}
+
+// NewManagerWithDependencies creates a tunnel manager using the given
+// services, for example the fakes from the tunneltest package
+func NewManagerWithDependencies(deps Dependencies, cfg *config.Config, env string, vars *config.Vars, logger *slog.Logger) *Manager {
+	if vars == nil {
+		vars = cfg.Vars(env, "", nil)
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
 	return &Manager{
-		client:  client,
-		config:  cfg,
-		env:     env,
-		verbose: verbose,
+		instances:  deps.Instances,
+		parameters: deps.Parameters,
+		sessions:   deps.Sessions,
+		ports:      deps.Ports,
+		config:     cfg,
+		env:        env,
+		vars:       vars,
+		log:        logger,
 	}
 }
 
 // CreateTunnel creates an SSM port forwarding tunnel for a service
 func (m *Manager) CreateTunnel(serviceName string, serviceConfig config.ServiceConfig) error {
-	if m.verbose {
-		log.Printf("Creating tunnel for service: %s", serviceName)
+	if _, exists := m.tunnels.Load(serviceName); exists {
+		return fmt.Errorf("tunnel for %s already exists", serviceName)
 	}
-
-	// Get host and port
-	host, err := serviceConfig.Host.GetValue(m.client, m.env)
-	if err != nil {
-		return fmt.Errorf("failed to get host for %s: %w", serviceName, err)
-	}
-	if m.verbose {
-		log.Printf("Retrieved host for %s: %s", serviceName, host)
+	if m.lazy(serviceConfig) {
+		return m.createLazyTunnel(serviceName, serviceConfig)
 	}
 
-	remotePort, err := serviceConfig.RemotePort.GetValue(m.client, m.env)
+	resolved, err := m.resolveServices(map[string]config.ServiceConfig{serviceName: serviceConfig}, false)
 	if err != nil {
-		return fmt.Errorf("failed to get remote port for %s: %w", serviceName, err)
+		return err
 	}
-	if m.verbose {
-		log.Printf("Retrieved remote port for %s: %s", serviceName, remotePort)
+	return m.createTunnel(context.Background(), serviceName, serviceConfig, resolved[serviceName])
+}
+
+// createTunnel creates a tunnel for a service whose values have been
+// resolved. Cancelling ctx aborts starting its session.
+func (m *Manager) createTunnel(ctx context.Context, serviceName string, serviceConfig config.ServiceConfig, values *serviceValues) error {
+	logger := m.log.With("service", serviceName)
+	logger.Debug("Creating tunnel")
+
+	if _, exists := m.tunnels.Load(serviceName); exists {
+		return fmt.Errorf("tunnel for %s already exists", serviceName)
 	}
 
+	host, remotePort := values.host, values.remotePort
+	logger.Debug("Resolved remote address", "host", host, "remote_port", remotePort)
+	m.addHosts(host)
+
 	// Get jumphost instance if not already set
-	if m.jumphost == nil {
+	if m.currentJumphost() == nil {
 		instance, err := m.GetJumphost()
 		if err != nil {
-			return fmt.Errorf("failed to find jumphost instance: %w", err)
-		}
-		m.jumphost = instance
-		if m.verbose {
-			log.Printf("Using jumphost instance: %s", *instance.InstanceId)
+			return failure(ErrNoJumphost, fmt.Errorf("failed to find jumphost instance: %w", err))
 		}
+		m.setJumphost(instance)
+		logger.Debug("Using jumphost instance", "instance", *instance.InstanceId)
 	}
 
-	// Find an available local port in the configured range
-	localPort, err := findAvailablePort(serviceConfig.LocalPortRange.Start, serviceConfig.LocalPortRange.End)
+	listener, localPort, err := m.listen(serviceName, serviceConfig, logger)
 	if err != nil {
-		return fmt.Errorf("failed to find available port for %s: %w", serviceName, err)
+		return err
+	}
+
+	t := newActiveTunnel(serviceName, host, remotePort, localPort, listener)
+	t.log = logger
+	t.idleTimeout, t.keepalive = serviceConfig.IdleTimeout, serviceConfig.Keepalive
+	t.healthCheck = serviceConfig.HealthCheck
+	sess, err := m.startSession(ctx, t)
+	if err != nil {
+		listener.Close()
+		m.releasePort(t)
+		return failure(ErrSession, fmt.Errorf("failed to start session for %s: %w", serviceName, err))
+	}
+	t.setSession(sess)
+	if t.healthCheck != nil {
+		if err := m.awaitHealthy(ctx, t, sess); err != nil {
+			t.close(context.Background())
+			m.releasePort(t)
+			return failure(ErrSession, fmt.Errorf("%s is not reachable through the tunnel: %w", serviceName, err))
+		}
+	}
+
+	// Store the tunnel for cleanup, start forwarding connections and keep the
+	// session alive
+	if _, exists := m.tunnels.LoadOrStore(serviceName, t); exists {
+		t.close(context.Background())
+		m.releasePort(t)
+		return fmt.Errorf("tunnel for %s already exists", serviceName)
 	}
-	if m.verbose {
-		log.Printf("Found available local port for %s: %d", serviceName, localPort)
+	go m.serve(t)
+	go m.supervise(t)
+	if t.idleTimeout > 0 {
+		go m.closeWhenIdle(t)
 	}
+	if t.keepalive > 0 {
+		go m.sendKeepalives(t)
+	}
+	if t.healthCheck != nil {
+		go m.monitorHealth(t)
+	}
+
+	local := t.localAddress()
+	logger.Info(fmt.Sprintf("Created tunnel: %s -> %s:%s", local, host, remotePort),
+		"local_address", local, "local_port", localPort, "host", host, "remote_port", remotePort)
+	t.logIdleSettings()
+	return nil
+}
+
+// createLazyTunnel listens on a local port for a service without resolving
+// it or starting a session, which wake does on the first connection
+func (m *Manager) createLazyTunnel(serviceName string, serviceConfig config.ServiceConfig) error {
+	logger := m.log.With("service", serviceName)
+	logger.Debug("Creating lazy tunnel")
 
-	// Use AWS CLI to create the tunnel
-	args := []string{
-		"ssm",
-		"start-session",
-		"--target", *m.jumphost.InstanceId,
-		"--document-name", "AWS-StartPortForwardingSessionToRemoteHost",
-		"--parameters", fmt.Sprintf(`{"host":["%s"],"portNumber":["%s"],"localPortNumber":["%d"]}`, host, remotePort, localPort),
+	listener, localPort, err := m.listen(serviceName, serviceConfig, logger)
+	if err != nil {
+		return err
+	}
+	t := newActiveTunnel(serviceName, "", "", localPort, listener)
+	t.log = logger
+	t.lazy = true
+	t.asleep = true
+	t.service = serviceConfig
+	t.idleTimeout, t.keepalive = serviceConfig.IdleTimeout, serviceConfig.Keepalive
+	t.healthCheck = serviceConfig.HealthCheck
+
+	if _, exists := m.tunnels.LoadOrStore(serviceName, t); exists {
+		t.close(context.Background())
+		m.releasePort(t)
+		return fmt.Errorf("tunnel for %s already exists", serviceName)
+	}
+	go m.serve(t)
+	if t.idleTimeout > 0 {
+		go m.closeWhenIdle(t)
+	}
+	if t.keepalive > 0 {
+		go m.sendKeepalives(t)
+	}
+	if t.healthCheck != nil {
+		go m.monitorHealth(t)
 	}
 
-	if m.verbose {
-		log.Printf("Starting AWS CLI command: aws %s", strings.Join(args, " "))
+	local := t.localAddress()
+	logger.Info(fmt.Sprintf("Created lazy tunnel: %s, the session starts on the first connection", local),
+		"local_address", local, "local_port", localPort)
+	t.logIdleSettings()
+	return nil
+}
+
+// listen binds the first free local port of a service. Binding is what
+// claims the port, so tunnels created concurrently never share one, and the
+// listener is kept for the tunnel so the port is never let go.
+func (m *Manager) listen(serviceName string, serviceConfig config.ServiceConfig, logger *slog.Logger) (net.Listener, int, error) {
+	ports := m.localPorts(serviceConfig)
+	listener, localPort, err := m.reservePort(serviceName, ports)
+	if err != nil && serviceConfig.LocalPort != 0 {
+		return nil, 0, failure(ErrNoPort, fmt.Errorf("local port %d pinned for %s is not available: %w", ports.Start, serviceName, err))
+	}
+	if err != nil {
+		return nil, 0, failure(ErrNoPort, fmt.Errorf("failed to find available port for %s: %w", serviceName, err))
 	}
+	logger.Debug("Bound local port", "local_port", localPort, "address", listener.Addr().String())
+	return listener, localPort, nil
+}
 
-	cmd := exec.Command("aws", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// lazy reports whether the tunnel of a service is created lazily
+func (m *Manager) lazy(serviceConfig config.ServiceConfig) bool {
+	return serviceConfig.Lazy || m.config.TunnelConfig.Lazy
+}
 
-	// Run the command in the background
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start AWS CLI command: %w", err)
+// lazyIdleTimeout returns how long the session of a lazy tunnel stays open
+// without connections
+func (m *Manager) lazyIdleTimeout() time.Duration {
+	if d := m.config.TunnelConfig.LazyIdleTimeout; d > 0 {
+		return d
 	}
+	return defaultLazyIdleTimeout
+}
+
+// localPorts returns the ports a tunnel for the service may listen on, with
+// the environment's port offset applied
+func (m *Manager) localPorts(serviceConfig config.ServiceConfig) config.PortRange {
+	return serviceConfig.LocalPorts().Offset(m.config.PortOffset(m.env))
+}
 
-	if m.verbose {
-		log.Printf("AWS CLI command started successfully with PID: %d", cmd.Process.Pid)
+// reservePort listens on a free port in r on the configured bind address,
+// reserving it across processes when the manager has a PortReserver
+func (m *Manager) reservePort(serviceName string, r config.PortRange) (net.Listener, int, error) {
+	address := m.bindAddress()
+	if m.ports == nil {
+		return listenInRange(address, r.Start, r.End)
 	}
+	return m.ports.Reserve(address, r.Start, r.End, serviceName, m.env)
+}
 
-	// Store the command for cleanup
-	m.tunnels.Store(serviceName, cmd)
+// releasePort gives up the reservation of a closed tunnel's port
+func (m *Manager) releasePort(t *activeTunnel) {
+	if m.ports == nil {
+		return
+	}
+	if err := m.ports.Release(t.localPort); err != nil {
+		t.log.Warn("Failed to release local port", "local_port", t.localPort, "error", err)
+	}
+}
 
-	log.Printf("Created tunnel for %s: localhost:%d -> %s:%s", serviceName, localPort, host, remotePort)
-	return nil
+// bindAddress returns the address tunnels listen on
+func (m *Manager) bindAddress() string {
+	if addr := m.config.TunnelConfig.BindAddress; addr != "" {
+		return addr
+	}
+	return defaultBindAddress
 }
 
 // CreateTunnels creates tunnels for multiple services
 func (m *Manager) CreateTunnels(services []string) error {
-	// Get jumphost instance first
-	instance, err := m.GetJumphost()
-	if err != nil {
-		return fmt.Errorf("failed to find jumphost instance: %w", err)
-	}
-	m.jumphost = instance
-
-	// Log jumphost information
-	instanceName := getInstanceName(instance)
-	log.Printf("Using jumphost: %s (%s)", instanceName, *instance.InstanceId)
+	return m.CreateTunnelsContext(context.Background(), services)
+}
 
-	var lastError error
-	// Create tunnels for each service
+// CreateTunnelsContext creates tunnels for multiple services. Once ctx is
+// done, sessions being started are aborted and the remaining tunnels are not
+// created.
+func (m *Manager) CreateTunnelsContext(ctx context.Context, services []string) error {
+	var errs []error
+	var names []string
+	configs := make(map[string]config.ServiceConfig, len(services))
+	seen := make(map[string]bool, len(services))
 	for _, serviceName := range services {
+		if seen[serviceName] {
+			continue
+		}
+		seen[serviceName] = true
 		serviceConfig, err := m.config.GetServiceConfig(serviceName)
 		if err != nil {
-			log.Printf("Error getting config for %s: %v", serviceName, err)
-			lastError = err
+			m.log.Error("Failed to get service config", "service", serviceName, "error", err)
+			errs = append(errs, failure(ErrConfig, err))
 			continue
 		}
-
-		if err := m.CreateTunnel(serviceName, serviceConfig); err != nil {
-			log.Printf("Error creating tunnel for %s: %v", serviceName, err)
-			lastError = err
+		// Lazy tunnels only need their local port for now
+		if m.lazy(serviceConfig) {
+			if err := m.createLazyTunnel(serviceName, serviceConfig); err != nil {
+				m.log.Error("Failed to create tunnel", "service", serviceName, "error", err)
+				errs = append(errs, err)
+			}
 			continue
 		}
+		configs[serviceName] = serviceConfig
+		names = append(names, serviceName)
+	}
+
+	// Look up the SSM parameters of every service at once
+	resolved, err := m.resolveServices(configs, false)
+	if err != nil {
+		m.log.Error("Failed to resolve services", "error", err)
+		errs = append(errs, err)
+	}
+
+	var pending []string
+	for _, serviceName := range names {
+		if v, ok := resolved[serviceName]; ok {
+			pending = append(pending, serviceName)
+			m.addHosts(v.host)
+		}
+	}
+
+	// Pick the jumphost once the remote hosts are known, so it can be chosen
+	// to suit them
+	if len(pending) > 0 {
+		instance, err := m.GetJumphost()
+		if err != nil {
+			m.log.Error("Failed to find jumphost instance", "error", err)
+			errs = append(errs, failure(ErrNoJumphost, fmt.Errorf("failed to find jumphost instance: %w", err)))
+			pending = nil
+		} else {
+			m.setJumphost(instance)
+			m.log.Info("Using jumphost", "name", getInstanceName(instance), "instance", *instance.InstanceId)
+		}
+	}
+
+	// Create the tunnels with a bounded number of workers, recording each
+	// failure in the position of its service so they are reported in order
+	createErrs := make([]error, len(pending))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < m.concurrency() && w < len(pending); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				serviceName := pending[i]
+				if err := ctx.Err(); err != nil {
+					createErrs[i] = fmt.Errorf("tunnel for %s not created: %w", serviceName, err)
+					continue
+				}
+				if err := m.createTunnel(ctx, serviceName, configs[serviceName], resolved[serviceName]); err != nil {
+					m.log.Error("Failed to create tunnel", "service", serviceName, "error", err)
+					createErrs[i] = err
+				}
+			}
+		}()
 	}
-	
-	if lastError != nil {
-		return fmt.Errorf("one or more tunnels failed to create: %w", lastError)
+	for i := range pending {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := errors.Join(append(errs, createErrs...)...); err != nil {
+		return fmt.Errorf("one or more tunnels failed to create: %w", err)
 	}
 	return nil
 }
 
-// GetJumphost returns the EC2 instance to be used as a jumphost
+// concurrency returns how many tunnels CreateTunnels creates at once
+func (m *Manager) concurrency() int {
+	if n := m.config.TunnelConfig.Concurrency; n > 0 {
+		return n
+	}
+	return defaultConcurrency
+}
+
+// GetJumphost returns the EC2 instance to be used as a jumphost: the
+// configured instance if there is one, and otherwise one of the instances
+// matching the jumphost filter, picked by the configured strategy
 func (m *Manager) GetJumphost() (*types.Instance, error) {
-	filter := m.config.GetJumphostFilter(m.env)
-	if m.verbose {
-		log.Printf("Looking for jumphost with filter: %s", filter)
+	filter, err := m.config.GetJumphostFilter(m.vars)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jumphost filter: %w", err)
 	}
-	return m.client.GetJumphost(m.env, filter)
+	filters := make(awsclient.Filters, len(filter))
+	for i, f := range filter {
+		filters[i] = awsclient.Filter(f)
+	}
+
+	m.mu.Lock()
+	hosts := append([]string(nil), m.hosts...)
+	m.mu.Unlock()
+
+	query := awsclient.JumphostQuery{
+		InstanceID: m.config.TunnelConfig.Jumphost,
+		Filters:    filters,
+		Strategy:   awsclient.JumphostStrategy(m.config.TunnelConfig.JumphostStrategy),
+		Hosts:      hosts,
+	}
+	m.log.Debug("Looking for jumphost", "filter", query.Filters.String(), "strategy", query.Strategy, "instance", query.InstanceID)
+	return m.instances.GetJumphost(query)
 }
 
-// GetServiceDetails retrieves SSM parameter values for a service
-func (m *Manager) GetServiceDetails(serviceName string, serviceConfig config.ServiceConfig) (map[string]string, error) {
-	details := make(map[string]string)
+// addHosts records remote hosts tunnels are opened to
+func (m *Manager) addHosts(hosts ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, host := range hosts {
+		found := false
+		for _, h := range m.hosts {
+			found = found || h == host
+		}
+		if !found {
+			m.hosts = append(m.hosts, host)
+		}
+	}
+	sort.Strings(m.hosts)
+}
 
-	// Get host parameter
-	host, err := serviceConfig.Host.GetValue(m.client, m.env)
+// currentJumphost returns the jumphost sessions are started on
+func (m *Manager) currentJumphost() *types.Instance {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jumphost
+}
+
+// setJumphost replaces the jumphost sessions are started on
+func (m *Manager) setJumphost(instance *types.Instance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jumphost = instance
+}
+
+// ensureJumphost checks that the current jumphost is still running with a
+// usable SSM agent and resolves a new one if it is not
+func (m *Manager) ensureJumphost() error {
+	if current := m.currentJumphost(); current != nil {
+		problem, err := m.instances.JumphostProblem(*current.InstanceId)
+		if err != nil {
+			return fmt.Errorf("failed to check jumphost %s: %w", *current.InstanceId, err)
+		}
+		if problem == "" {
+			return nil
+		}
+		m.log.Warn("Jumphost is no longer usable, looking for a replacement", "instance", *current.InstanceId, "reason", problem)
+	}
+
+	instance, err := m.GetJumphost()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get host: %w", err)
+		return failure(ErrNoJumphost, fmt.Errorf("failed to find jumphost instance: %w", err))
+	}
+	m.setJumphost(instance)
+	m.log.Info("Using jumphost", "name", getInstanceName(instance), "instance", *instance.InstanceId)
+	return nil
+}
+
+// startSession starts a port forwarding session for the tunnel on the
+// current jumphost, giving up when ctx is done
+func (m *Manager) startSession(ctx context.Context, t *activeTunnel) (Session, error) {
+	jumphost := m.currentJumphost()
+	if jumphost == nil {
+		return nil, fmt.Errorf("no jumphost selected")
 	}
-	details["host"] = host
 
-	// Get remote port parameter
-	remotePort, err := serviceConfig.RemotePort.GetValue(m.client, m.env)
+	ctx, cancel := context.WithTimeout(ctx, sessionStartTimeout)
+	defer cancel()
+
+	sess, err := m.sessions.StartSession(ctx, session.Options{
+		Target: *jumphost.InstanceId,
+		Host:   t.host,
+		Port:   t.remotePort,
+		Logger: t.log,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get remote port: %w", err)
+		return nil, err
 	}
-	details["remote_port"] = remotePort
+	t.setJumphost(jumphost)
 
-	// Get service-specific details if configured
-	if len(serviceConfig.ServiceDetails) > 0 {
-		// Replace placeholder in all paths
-		var paramPaths []string
-		for _, path := range serviceConfig.ServiceDetails {
-			paramPath := strings.ReplaceAll(path, "${PLACEHOLDER}", m.env)
-			paramPaths = append(paramPaths, paramPath)
-		}
+	t.log.Debug("Session started", "session", sess.ID())
+	return sess, nil
+}
 
-		if m.verbose {
-			log.Printf("Getting parameters: %v", paramPaths)
-		}
+// GetServiceDetails retrieves SSM parameter values for a service
+func (m *Manager) GetServiceDetails(serviceName string, serviceConfig config.ServiceConfig) (map[string]string, error) {
+	resolved, err := m.resolveServices(map[string]config.ServiceConfig{serviceName: serviceConfig}, true)
+	values, ok := resolved[serviceName]
+	if !ok {
+		return nil, err
+	}
+	if err != nil {
+		m.log.Warn("Failed to get parameters", "service", serviceName, "error", err)
+	}
+	return serviceDetails(m.localPorts(serviceConfig), values), nil
+}
 
-		// Get all parameters
-		parameters, err := m.client.GetParametersByPath(paramPaths)
+// ServiceDetails retrieves the details of several services, looking up the
+// SSM parameters of all of them at once. Details are returned for every
+// service that could be resolved, and the error describes the others along
+// with any missing service-details parameters.
+func (m *Manager) ServiceDetails(services []string) (map[string]map[string]string, error) {
+	var errs []error
+	configs := make(map[string]config.ServiceConfig, len(services))
+	for _, serviceName := range services {
+		serviceConfig, err := m.config.GetServiceConfig(serviceName)
 		if err != nil {
-			log.Printf("Warning: Failed to get parameters: %v", err)
-			return details, nil
+			errs = append(errs, err)
+			continue
 		}
+		configs[serviceName] = serviceConfig
+	}
 
-		// Add all parameters to the details map
-		for _, param := range parameters {
-			if param.Name == nil || param.Value == nil {
-				continue
-			}
-			name := *param.Name
-			// Extract just the parameter name without the path
-			parts := strings.Split(name, "/")
-			if len(parts) > 0 {
-				name = parts[len(parts)-1]
-			}
-			details[name] = *param.Value
-		}
+	resolved, err := m.resolveServices(configs, true)
+	if err != nil {
+		errs = append(errs, err)
 	}
 
-	// Add local port range for reference
-	details["local_port_range"] = fmt.Sprintf("%d-%d", 
-		serviceConfig.LocalPortRange.Start, 
-		serviceConfig.LocalPortRange.End)
+	details := make(map[string]map[string]string, len(resolved))
+	for serviceName, values := range resolved {
+		details[serviceName] = serviceDetails(m.localPorts(configs[serviceName]), values)
+	}
+	return details, errors.Join(errs...)
+}
+
+// serviceDetails lists the resolved values of a service
+func serviceDetails(ports config.PortRange, values *serviceValues) map[string]string {
+	details := make(map[string]string, len(values.details)+3)
+	details["host"] = values.host
+	details["remote_port"] = values.remotePort
+	for name, value := range values.details {
+		details[name] = value
+	}
 
-	return details, nil
+	// Add local port range for reference
+	details["local_port_range"] = ports.String()
+	return details
 }
 
 // Helper function to get instance name from tags
@@ -228,36 +632,105 @@ func getInstanceName(instance *types.Instance) string {
 	return "unnamed"
 }
 
-// isPortAvailable checks if a port is available for use
-func isPortAvailable(port int) bool {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return false
+// listenInRange listens on address on the first port in the given range that
+// can be bound. For a single port the error is the reason it could not be.
+func listenInRange(address string, start, end int) (net.Listener, int, error) {
+	for port := start; port <= end; port++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+		if err == nil {
+			return ln, port, nil
+		}
+		if start == end {
+			return nil, 0, err
+		}
 	}
-	ln.Close()
-	return true
+	return nil, 0, fmt.Errorf("no available ports in range %d-%d", start, end)
 }
 
-// findAvailablePort finds an available port in the given range
-func findAvailablePort(start, end int) (int, error) {
-	for port := start; port <= end; port++ {
-		if isPortAvailable(port) {
-			return port, nil
+// shutdownTimeout bounds CleanupTunnels
+const shutdownTimeout = 15 * time.Second
+
+// CleanupResult is the outcome of closing a single tunnel
+type CleanupResult struct {
+	Service string
+	// Forced is set when the session could not be terminated before the
+	// deadline and was dropped locally instead
+	Forced bool
+	Err    error
+}
+
+// Shutdown closes every active tunnel in parallel. Each session is asked to
+// terminate; sessions still open when ctx expires are dropped locally. A
+// result is returned for every tunnel, sorted by service name.
+func (m *Manager) Shutdown(ctx context.Context) []CleanupResult {
+	var services []string
+	m.tunnels.Range(func(key, value interface{}) bool {
+		services = append(services, key.(string))
+		return true
+	})
+	return m.CloseTunnels(ctx, services)
+}
+
+// CloseTunnels closes the tunnels for the given services in parallel, in the
+// same way as Shutdown. Services without an active tunnel are reported as
+// failed.
+func (m *Manager) CloseTunnels(ctx context.Context, services []string) []CleanupResult {
+	results := make([]CleanupResult, len(services))
+	var wg sync.WaitGroup
+	for i, serviceName := range services {
+		value, ok := m.tunnels.Load(serviceName)
+		if !ok {
+			results[i] = CleanupResult{Service: serviceName, Err: fmt.Errorf("no active tunnel")}
+			continue
 		}
+
+		wg.Add(1)
+		go func(i int, t *activeTunnel) {
+			defer wg.Done()
+
+			done := make(chan error, 1)
+			go func() { done <- t.close(ctx) }()
+
+			result := CleanupResult{Service: t.serviceName}
+			select {
+			case result.Err = <-done:
+			case <-ctx.Done():
+				t.abort()
+				result.Forced = true
+				result.Err = fmt.Errorf("session not terminated before deadline: %w", ctx.Err())
+			}
+			m.tunnels.Delete(t.serviceName)
+			m.releasePort(t)
+
+			if result.Err != nil {
+				t.log.Error("Failed to close tunnel", "error", result.Err)
+			} else {
+				t.log.Debug("Closed tunnel")
+			}
+			results[i] = result
+		}(i, value.(*activeTunnel))
 	}
-	return 0, fmt.Errorf("no available ports in range %d-%d", start, end)
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Service < results[j].Service })
+	return results
+}
+
+// Env returns the environment the manager creates tunnels for
+func (m *Manager) Env() string {
+	return m.env
 }
 
-// CleanupTunnels terminates all active tunnels
+// CleanupTunnels terminates all active tunnels, returning every failure
 func (m *Manager) CleanupTunnels() error {
-	var lastErr error
-	m.tunnels.Range(func(key, value interface{}) bool {
-		cmd := value.(*exec.Cmd)
-		if err := cmd.Process.Kill(); err != nil {
-			lastErr = fmt.Errorf("failed to kill tunnel process: %w", err)
-			return false
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, result := range m.Shutdown(ctx) {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.Service, result.Err))
 		}
-		return true
-	})
-	return lastErr
+	}
+	return errors.Join(errs...)
 }
@@ -1,96 +1,138 @@
-package tunnel
+package tunnel_test
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
 
-	"tunnel-go/pkg/aws"
 	"tunnel-go/pkg/config"
+	"tunnel-go/pkg/ports"
+	"tunnel-go/pkg/tunnel"
+	"tunnel-go/pkg/tunnel/tunneltest"
 )
 
-type mockAWSClient struct {
-	getInstancesOutput []string
-	getParamOutput     string
-	err                error
+// startEcho starts a TCP echo server standing in for the remote host
+func startEcho(t *testing.T) (host, port string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	host, port, _ = net.SplitHostPort(ln.Addr().String())
+	return host, port
 }
 
-func (m *mockAWSClient) GetEC2InstancesByFilter(filter string) ([]string, error) {
-	if m.err != nil {
-		return nil, m.err
+// freePort returns a local port that is currently unused
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
-	return m.getInstancesOutput, nil
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
 }
 
-func (m *mockAWSClient) GetParameter(name string) (string, error) {
-	if m.err != nil {
-		return "", m.err
+// newConfig returns a config with one service per name, each pointing at the
+// echo server through the SSM parameters /<env>/<name>/host and port
+func newConfig(t *testing.T, fake *tunneltest.Fake, names ...string) *config.Config {
+	t.Helper()
+	host, port := startEcho(t)
+
+	cfg := &config.Config{}
+	cfg.TunnelConfig.JumphostFilter = config.NameFilter("${ENV}-jumphost*")
+	cfg.TunnelConfig.Services = make(map[string]config.ServiceConfig)
+	for _, name := range names {
+		p := freePort(t)
+		cfg.TunnelConfig.Services[name] = config.ServiceConfig{
+			Host:           config.ConfigValue{SSMParam: "/${ENV}/${SERVICE}/host"},
+			RemotePort:     config.ConfigValue{SSMParam: "/${ENV}/${SERVICE}/port"},
+			LocalPortRange: config.PortRange{Start: p, End: p},
+		}
+		fake.SetParameter("/test/"+name+"/host", host)
+		fake.SetParameter("/test/"+name+"/port", port)
 	}
-	return m.getParamOutput, nil
+	return cfg
 }
 
-func TestGetJumphosts(t *testing.T) {
+// roundTrip sends a message through the tunnel's local port and checks the echo
+func roundTrip(t *testing.T, localPort int, msg string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", localPort), 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial tunnel: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != msg {
+		t.Errorf("echo = %q, want %q", buf, msg)
+	}
+}
+
+func TestGetJumphost(t *testing.T) {
 	tests := []struct {
-		name       string
-		filter     string
-		mockOutput []string
-		mockErr    error
-		want       []string
-		wantErr    bool
+		name    string
+		err     error
+		want    string
+		wantErr bool
 	}{
 		{
-			name:       "Success",
-			filter:     "test-filter",
-			mockOutput: []string{"10.0.0.1", "10.0.0.2"},
-			want:       []string{"10.0.0.1", "10.0.0.2"},
-			wantErr:    false,
+			name: "Success",
+			want: "i-running",
 		},
 		{
 			name:    "Error",
-			filter:  "test-filter",
-			mockErr: errors.New("test error"),
+			err:     errors.New("test error"),
 			wantErr: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mock := &mockAWSClient{
-				getInstancesOutput: tt.mockOutput,
-				err:                tt.mockErr,
-			}
+			fake := tunneltest.New()
+			fake.AddInstance("i-other", "prod-jumphost")
+			fake.AddInstance("i-stopped", "test-jumphost-1")
+			fake.StopInstance("i-stopped")
+			fake.AddInstance("i-running", "test-jumphost-2")
+			fake.InstanceErr = tt.err
 
-			manager := &Manager{
-				client: aws.NewClient(mock, mock),
-				config: &config.Config{
-					TunnelConfig: struct {
-						Placeholder       string                          `yaml:"placeholder"`
-						CachefileLocation string                          `yaml:"cachefile-location"`
-						LogfileLocation   string                          `yaml:"logfile-location"`
-						JumphostFilter    string                          `yaml:"jumphost-filter"`
-						Services          map[string]config.ServiceConfig `yaml:"services"`
-					}{
-						JumphostFilter: tt.filter,
-					},
-				},
-				env:     "test",
-				verbose: true,
-			}
+			manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), newConfig(t, fake), "test", nil, nil)
 
-			got, err := manager.GetJumphosts()
+			got, err := manager.GetJumphost()
 			if (err != nil) != tt.wantErr {
-				t.Errorf("GetJumphosts() error = %v, wantErr %v", err, tt.wantErr)
-				return
+				t.Fatalf("GetJumphost() error = %v, wantErr %v", err, tt.wantErr)
 			}
-			if !tt.wantErr {
-				if len(got) != len(tt.want) {
-					t.Errorf("GetJumphosts() returned %d jumphosts, want %d", len(got), len(tt.want))
-					return
-				}
-				for i, host := range got {
-					if host != tt.want[i] {
-						t.Errorf("GetJumphosts()[%d] = %v, want %v", i, host, tt.want[i])
-					}
-				}
+			if !tt.wantErr && *got.InstanceId != tt.want {
+				t.Errorf("GetJumphost() = %s, want %s", *got.InstanceId, tt.want)
 			}
 		})
 	}
@@ -98,67 +140,786 @@ func TestGetJumphosts(t *testing.T) {
 
 func TestCreateTunnels(t *testing.T) {
 	tests := []struct {
-		name       string
-		services   []string
-		mockOutput string
-		mockErr    error
-		wantErr    bool
+		name     string
+		services []string
+		setup    func(*tunneltest.Fake)
+		wantErr  bool
+		// wantReason is the FailureReason of the error
+		wantReason string
 	}{
 		{
-			name:       "Success",
-			services:   []string{"service1"},
-			mockOutput: "test-value",
-			wantErr:    false,
+			name:     "Success",
+			services: []string{"service1", "service2"},
 		},
 		{
-			name:     "Error",
+			name:     "ParameterError",
 			services: []string{"service1"},
-			mockErr:  errors.New("test error"),
+			setup:    func(f *tunneltest.Fake) { f.ParameterErr = errors.New("test error") },
 			wantErr:  true,
 		},
+		{
+			name:     "AccessDenied",
+			services: []string{"service1"},
+			setup: func(f *tunneltest.Fake) {
+				f.ParameterErr = &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized to perform ssm:GetParameters"}
+			},
+			wantErr:    true,
+			wantReason: tunnel.ReasonAuth,
+		},
+		{
+			name:       "SessionError",
+			services:   []string{"service1"},
+			setup:      func(f *tunneltest.Fake) { f.SessionErr = errors.New("test error") },
+			wantErr:    true,
+			wantReason: tunnel.ReasonSession,
+		},
+		{
+			name:       "NoJumphost",
+			services:   []string{"service1"},
+			setup:      func(f *tunneltest.Fake) { f.StopInstance("i-1") },
+			wantErr:    true,
+			wantReason: tunnel.ReasonJumphost,
+		},
+		{
+			name:       "UnknownService",
+			services:   []string{"service1", "missing"},
+			wantErr:    true,
+			wantReason: tunnel.ReasonConfig,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mock := &mockAWSClient{
-				getParamOutput: tt.mockOutput,
-				err:            tt.mockErr,
+			fake := tunneltest.New()
+			fake.AddInstance("i-1", "test-jumphost")
+			cfg := newConfig(t, fake, "service1", "service2")
+			if tt.setup != nil {
+				tt.setup(fake)
 			}
 
-			manager := &Manager{
-				client: aws.NewClient(mock, mock),
-				config: &config.Config{
-					TunnelConfig: struct {
-						Placeholder       string                          `yaml:"placeholder"`
-						CachefileLocation string                          `yaml:"cachefile-location"`
-						LogfileLocation   string                          `yaml:"logfile-location"`
-						JumphostFilter    string                          `yaml:"jumphost-filter"`
-						Services          map[string]config.ServiceConfig `yaml:"services"`
-					}{
-						Services: map[string]config.ServiceConfig{
-							"service1": {
-								Host: config.ConfigValue{
-									Value: "test-host",
-								},
-								RemotePort: config.ConfigValue{
-									Value: "3306",
-								},
-								LocalPortRange: config.PortRange{
-									Start: 5000,
-									End:   5009,
-								},
-							},
-						},
-					},
-				},
-				env:     "test",
-				verbose: true,
-			}
+			manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+			defer manager.Shutdown(context.Background())
 
 			err := manager.CreateTunnels(tt.services)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("CreateTunnels() error = %v, wantErr %v", err, tt.wantErr)
+				t.Fatalf("CreateTunnels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if reason := tunnel.FailureReason(err); reason != tt.wantReason {
+				t.Errorf("FailureReason() = %q, want %q", reason, tt.wantReason)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			statuses := manager.Tunnels()
+			if len(statuses) != len(tt.services) {
+				t.Fatalf("Tunnels() = %d tunnels, want %d", len(statuses), len(tt.services))
+			}
+			for _, st := range statuses {
+				if st.JumphostID != "i-1" || !st.Connected || st.Env != "test" {
+					t.Errorf("Tunnels() status = %+v, want connected through i-1", st)
+				}
+				roundTrip(t, st.LocalPort, "hello "+st.Service)
 			}
 		})
 	}
 }
+
+func TestCreateTunnelsLooksUpParametersOnce(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), newConfig(t, fake, "db", "cache", "queue"), "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnels([]string{"db", "cache", "queue"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	if calls := fake.ParameterCalls(); calls != 1 {
+		t.Errorf("parameters looked up in %d calls, want 1", calls)
+	}
+	if n := len(manager.Tunnels()); n != 3 {
+		t.Errorf("Tunnels() = %d tunnels, want 3", n)
+	}
+}
+
+func TestCreateTunnelsReportsAllMissingParameters(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	cfg := newConfig(t, fake, "db", "cache", "queue")
+	delete(fake.Parameters, "/test/db/host")
+	delete(fake.Parameters, "/test/cache/host")
+	delete(fake.Parameters, "/test/cache/port")
+
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	err := manager.CreateTunnels([]string{"db", "cache", "queue"})
+	var missing *tunnel.MissingParametersError
+	if !errors.As(err, &missing) {
+		t.Fatalf("CreateTunnels() error = %v, want *MissingParametersError", err)
+	}
+	want := []tunnel.MissingParameter{
+		{Service: "cache", Field: "host", Name: "/test/cache/host"},
+		{Service: "cache", Field: "remote-port", Name: "/test/cache/port"},
+		{Service: "db", Field: "host", Name: "/test/db/host"},
+	}
+	if fmt.Sprint(missing.Parameters) != fmt.Sprint(want) {
+		t.Errorf("missing parameters = %v, want %v", missing.Parameters, want)
+	}
+
+	// The service whose parameters exist is still created
+	statuses := manager.Tunnels()
+	if len(statuses) != 1 || statuses[0].Service != "queue" {
+		t.Errorf("Tunnels() = %+v, want only queue", statuses)
+	}
+}
+
+func TestServiceDetails(t *testing.T) {
+	fake := tunneltest.New()
+	cfg := newConfig(t, fake, "db", "cache")
+	db := cfg.TunnelConfig.Services["db"]
+	db.ServiceDetails = []string{"/${ENV}/${SERVICE}/user", "/${ENV}/${SERVICE}/schema"}
+	cfg.TunnelConfig.Services["db"] = db
+	fake.SetParameter("/test/db/user", "admin")
+
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	details, err := manager.ServiceDetails([]string{"db", "cache"})
+
+	// The missing detail is reported without dropping the service
+	var missing *tunnel.MissingParametersError
+	if !errors.As(err, &missing) || len(missing.Parameters) != 1 || missing.Parameters[0].Name != "/test/db/schema" {
+		t.Errorf("ServiceDetails() error = %v, want /test/db/schema missing", err)
+	}
+	if details["db"]["user"] != "admin" || details["db"]["host"] == "" {
+		t.Errorf("ServiceDetails() db = %v, want host and user", details["db"])
+	}
+	if _, ok := details["cache"]; !ok {
+		t.Errorf("ServiceDetails() has no details for cache")
+	}
+	if calls := fake.ParameterCalls(); calls != 1 {
+		t.Errorf("parameters looked up in %d calls, want 1", calls)
+	}
+}
+
+func TestCreateTunnelsConcurrently(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	fake.SessionDelay = 50 * time.Millisecond
+
+	names := []string{"s1", "s2", "s3", "s4", "s5", "s6"}
+	cfg := newConfig(t, fake, names...)
+	cfg.TunnelConfig.Concurrency = 3
+
+	// Every service shares one range, so the tunnels have to agree on who
+	// gets which port
+	start := freePort(t)
+	for _, name := range names {
+		svc := cfg.TunnelConfig.Services[name]
+		svc.LocalPortRange = config.PortRange{Start: start, End: start + 20}
+		cfg.TunnelConfig.Services[name] = svc
+	}
+
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnels(names); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+
+	if peak := fake.PeakConcurrentStarts(); peak < 2 || peak > 3 {
+		t.Errorf("%d sessions started at once, want 2-3", peak)
+	}
+
+	ports := make(map[int]string)
+	for _, st := range manager.Tunnels() {
+		if other, ok := ports[st.LocalPort]; ok {
+			t.Errorf("%s and %s both use port %d", st.Service, other, st.LocalPort)
+		}
+		ports[st.LocalPort] = st.Service
+		roundTrip(t, st.LocalPort, "hello "+st.Service)
+	}
+	if len(ports) != len(names) {
+		t.Errorf("%d tunnels created, want %d", len(ports), len(names))
+	}
+}
+
+func TestCreateTunnelsReportsEveryFailure(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	cfg := newConfig(t, fake, "db", "cache", "queue")
+
+	// Ports in use make two of the services fail
+	for _, name := range []string{"db", "queue"} {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", cfg.TunnelConfig.Services[name].LocalPortRange.Start))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+	}
+
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	err := manager.CreateTunnels([]string{"db", "cache", "queue", "missing"})
+	if err == nil {
+		t.Fatal("CreateTunnels() error = nil, want failures")
+	}
+	for _, want := range []string{"missing", "for db", "for queue"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("CreateTunnels() error = %q, want it to mention %q", err, want)
+		}
+	}
+	if statuses := manager.Tunnels(); len(statuses) != 1 || statuses[0].Service != "cache" {
+		t.Errorf("Tunnels() = %+v, want only cache", statuses)
+	}
+}
+
+func TestCreateTunnelReservesPort(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	cfg := newConfig(t, fake, "database")
+	registry := ports.Open(t.TempDir(), "")
+
+	deps := fake.Dependencies()
+	deps.Ports = registry
+	manager := tunnel.NewManagerWithDependencies(deps, cfg, "test", nil, nil)
+
+	if err := manager.CreateTunnels([]string{"database"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	st := manager.Tunnels()[0]
+	if st.BindAddress != "127.0.0.1" {
+		t.Errorf("BindAddress = %q, want the default 127.0.0.1", st.BindAddress)
+	}
+	roundTrip(t, st.LocalPort, "hello")
+
+	reservations, err := registry.Reservations()
+	if err != nil {
+		t.Fatalf("Reservations() error = %v", err)
+	}
+	if res := reservations[st.LocalPort]; res.Service != "database" || res.Env != "test" {
+		t.Errorf("reservation = %+v, want database in test", res)
+	}
+
+	if err := manager.CleanupTunnels(); err != nil {
+		t.Fatalf("CleanupTunnels() error = %v", err)
+	}
+	if reservations, _ = registry.Reservations(); len(reservations) != 0 {
+		t.Errorf("reservations after cleanup = %v, want none", reservations)
+	}
+}
+
+func TestCreateTunnelPinnedPortInUse(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	cfg := newConfig(t, fake, "database")
+
+	// The pinned port is taken, and the range still has a free port the
+	// tunnel must not fall back to
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	svc := cfg.TunnelConfig.Services["database"]
+	svc.LocalPort = taken.Addr().(*net.TCPAddr).Port
+	cfg.TunnelConfig.Services["database"] = svc
+
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	err = manager.CreateTunnels([]string{"database"})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("local port %d pinned for database is not available", svc.LocalPort)) {
+		t.Errorf("CreateTunnels() error = %v, want the pinned port reported", err)
+	}
+	if reason := tunnel.FailureReason(err); reason != tunnel.ReasonPorts {
+		t.Errorf("FailureReason() = %q, want %q", reason, tunnel.ReasonPorts)
+	}
+	if n := len(manager.Tunnels()); n != 0 {
+		t.Errorf("%d tunnels created, want none", n)
+	}
+}
+
+func TestCreateTunnelsJumphostQuery(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost-1")
+	fake.AddInstance("i-2", "test-jumphost-2")
+	cfg := newConfig(t, fake, "service1", "service2")
+	cfg.TunnelConfig.JumphostStrategy = "same-az"
+
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+	if err := manager.CreateTunnels([]string{"service1", "service2"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+
+	// The jumphost is looked up once, after the remote hosts are resolved
+	queries := fake.JumphostQueries()
+	if len(queries) != 1 {
+		t.Fatalf("jumphost looked up %d times, want 1", len(queries))
+	}
+	q := queries[0]
+	if q.Filters.String() != "test-jumphost*" || q.Strategy != "same-az" || len(q.Hosts) != 1 || q.Hosts[0] != "127.0.0.1" {
+		t.Errorf("jumphost query = %+v, want same-az for the echo server host", q)
+	}
+}
+
+func TestCreateTunnelsExplicitJumphost(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost-1")
+	fake.AddInstance("i-2", "test-jumphost-2")
+	cfg := newConfig(t, fake, "service1")
+	cfg.TunnelConfig.Jumphost = "i-2"
+
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+	if err := manager.CreateTunnels([]string{"service1"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	if id := manager.Tunnels()[0].JumphostID; id != "i-2" {
+		t.Errorf("JumphostID = %s, want the configured i-2", id)
+	}
+}
+
+func TestCreateTunnelsJumphostTagFilters(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "bastion")
+	fake.AddInstance("i-2", "bastion")
+	fake.TagInstance("i-1", "Team", "search")
+	fake.TagInstance("i-2", "Team", "payments")
+	cfg := newConfig(t, fake, "service1")
+	cfg.TunnelConfig.JumphostFilter = config.JumphostFilter{
+		{Name: "tag:Name", Values: []string{"bastion"}},
+		{Name: "tag:Team", Values: []string{"${TEAM}"}},
+	}
+	cfg.Variables = map[string]string{"TEAM": "payments"}
+
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+	if err := manager.CreateTunnels([]string{"service1"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	if id := manager.Tunnels()[0].JumphostID; id != "i-2" {
+		t.Errorf("JumphostID = %s, want i-2 tagged for payments", id)
+	}
+}
+
+func TestTunnelStatusCountsBytes(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), newConfig(t, fake, "db"), "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnels([]string{"db"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	roundTrip(t, manager.Tunnels()[0].LocalPort, "12345")
+
+	// The counters are updated as the copy goroutines finish
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := manager.Tunnels()[0]
+		if st.BytesIn == 5 && st.BytesOut == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status bytes in/out = %d/%d, want 5/5", st.BytesIn, st.BytesOut)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTunnelStatusCountsConnections(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	cfg := newConfig(t, fake, "db", "broken")
+	// Nothing listens on the remote port of broken
+	fake.SetParameter("/test/broken/port", strconv.Itoa(freePort(t)))
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnels([]string{"db", "broken"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	statuses := manager.Tunnels()
+	broken, db := statuses[0], statuses[1]
+
+	roundTrip(t, db.LocalPort, "first")
+	roundTrip(t, db.LocalPort, "second")
+	conn, err := net.DialTimeout("tcp", broken.LocalAddress(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial tunnel: %v", err)
+	}
+	defer conn.Close()
+	held, err := net.DialTimeout("tcp", db.LocalAddress(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial tunnel: %v", err)
+	}
+	defer held.Close()
+
+	// The counters are updated as the proxied connections end
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses = manager.Tunnels()
+		broken, db = statuses[0], statuses[1]
+		if db.Connections == 3 && db.ActiveConnections == 1 && broken.ConnectionErrors == 1 && broken.ActiveConnections == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status db = %+v, broken = %+v, want 3 connections to db with one open and a failed one to broken", db, broken)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.ConnectionErrors != 0 || db.ConnectionTime <= 0 || db.LongestConnection > db.ConnectionTime {
+		t.Errorf("status db = %+v, want two closed connections without errors", db)
+	}
+	if avg := db.AverageConnection(); avg != db.ConnectionTime/2 {
+		t.Errorf("AverageConnection() = %s, want %s", avg, db.ConnectionTime/2)
+	}
+}
+
+// waitFor polls cond until it holds, failing with msg after a few seconds
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLazyTunnelDefersLookups(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	cfg := newConfig(t, fake, "db", "cache")
+	cfg.TunnelConfig.Lazy = true
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnels([]string{"db", "cache"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	if n := fake.ParameterCalls(); n != 0 {
+		t.Errorf("parameters looked up %d times before any connection, want 0", n)
+	}
+	if n := len(fake.JumphostQueries()); n != 0 {
+		t.Errorf("jumphost looked up %d times before any connection, want 0", n)
+	}
+	if n := len(fake.Sessions()); n != 0 {
+		t.Errorf("%d sessions started before any connection, want 0", n)
+	}
+	for _, st := range manager.Tunnels() {
+		if !st.Lazy || !st.Idle || st.Connected || st.RemoteAddress() != "-" {
+			t.Errorf("status = %+v, want an idle lazy tunnel", st)
+		}
+	}
+}
+
+func TestLazyTunnelSessionLifecycle(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	cfg := newConfig(t, fake, "db", "cache")
+	db := cfg.TunnelConfig.Services["db"]
+	db.Lazy = true
+	cfg.TunnelConfig.Services["db"] = db
+	cfg.TunnelConfig.LazyIdleTimeout = 200 * time.Millisecond
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnels([]string{"db", "cache"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	// Only cache starts its session right away
+	if sessions := fake.Sessions(); len(sessions) != 1 {
+		t.Fatalf("%d sessions started, want 1 for cache", len(sessions))
+	}
+	status := func() tunnel.TunnelStatus {
+		for _, st := range manager.Tunnels() {
+			if st.Service == "db" {
+				return st
+			}
+		}
+		t.Fatal("no tunnel for db")
+		return tunnel.TunnelStatus{}
+	}
+	localPort := status().LocalPort
+
+	// The first connection starts the session and is forwarded through it
+	roundTrip(t, localPort, "wake up")
+	sessions := fake.Sessions()
+	if len(sessions) != 2 || sessions[1].Options.Host != "127.0.0.1" {
+		t.Fatalf("sessions = %d, want a second one for db", len(sessions))
+	}
+	if st := status(); !st.Connected || st.Idle || st.RemoteHost == "" {
+		t.Errorf("status = %+v, want db connected", st)
+	}
+
+	// Without connections the session ends while the port stays open
+	waitFor(t, "session of db was not ended when idle", func() bool {
+		return status().Idle && sessions[1].Terminated()
+	})
+	if st := status(); st.Connected || st.LocalPort != localPort || st.Reconnects != 0 {
+		t.Errorf("status = %+v, want db idle on port %d", st, localPort)
+	}
+
+	roundTrip(t, localPort, "again")
+	if n := len(fake.Sessions()); n != 3 {
+		t.Errorf("%d sessions started, want a new one for db", n)
+	}
+}
+
+func TestIdleTimeoutClosesTunnel(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	cfg := newConfig(t, fake, "db", "cache")
+	db := cfg.TunnelConfig.Services["db"]
+	db.IdleTimeout = 300 * time.Millisecond
+	db.Keepalive = 50 * time.Millisecond
+	cfg.TunnelConfig.Services["db"] = db
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnels([]string{"db", "cache"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	var st tunnel.TunnelStatus
+	for _, s := range manager.Tunnels() {
+		if s.Service == "db" {
+			st = s
+		}
+	}
+	if st.IdleTimeout != db.IdleTimeout || st.Keepalive != db.Keepalive {
+		t.Errorf("status idle timeout = %s, keepalive = %s, want %s and %s", st.IdleTimeout, st.Keepalive, db.IdleTimeout, db.Keepalive)
+	}
+	// Only the session of db has keepalive connections forwarded through it
+	var dbSession, cacheSession *tunneltest.FakeSession
+	for _, sess := range fake.Sessions() {
+		if sess.ID() == st.SessionID {
+			dbSession = sess
+		} else {
+			cacheSession = sess
+		}
+	}
+	if dbSession == nil || cacheSession == nil {
+		t.Fatalf("no sessions of db and cache")
+	}
+	waitFor(t, "no keepalives sent through the session of db", func() bool {
+		return dbSession.Forwarded() >= 2
+	})
+	if n := cacheSession.Forwarded(); n != 0 {
+		t.Errorf("session of cache forwarded %d connections, want none", n)
+	}
+
+	// An open connection keeps the tunnel past its idle timeout
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(st.LocalPort)))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	time.Sleep(2 * db.IdleTimeout)
+	if n := len(manager.Tunnels()); n != 2 {
+		t.Errorf("%d tunnels while db has a connection, want 2", n)
+	}
+	conn.Close()
+
+	// Once unused for the timeout, db is closed and its session ended while
+	// cache stays open
+	waitFor(t, "db was not closed when idle", func() bool {
+		tunnels := manager.Tunnels()
+		return len(tunnels) == 1 && tunnels[0].Service == "cache"
+	})
+	if !dbSession.Terminated() {
+		t.Error("session of db was not terminated")
+	}
+	if err := manager.CreateTunnel("db", db); err != nil {
+		t.Errorf("CreateTunnel() after idle close error = %v", err)
+	}
+}
+
+func TestHealthCheckOnCreate(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	cfg := newConfig(t, fake, "db", "cache")
+	db := cfg.TunnelConfig.Services["db"]
+	db.HealthCheck = &config.HealthCheck{Type: "tcp", Interval: time.Hour}
+	cfg.TunnelConfig.Services["db"] = db
+	cache := cfg.TunnelConfig.Services["cache"]
+	cache.HealthCheck = &config.HealthCheck{Type: "tcp", Failures: 1}
+	cfg.TunnelConfig.Services["cache"] = cache
+	// Nothing listens on the port of cache
+	fake.SetParameter("/test/cache/port", strconv.Itoa(freePort(t)))
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnel("db", db); err != nil {
+		t.Fatalf("CreateTunnel(db) error = %v", err)
+	}
+	st := manager.Tunnels()[0]
+	if st.HealthCheck != "tcp" || st.HealthCheckedAt.IsZero() || st.HealthError != "" {
+		t.Errorf("status = %+v, want a passed tcp check", st)
+	}
+	// The check does not count as a connection
+	if st.Connections != 0 {
+		t.Errorf("Connections = %d, want 0", st.Connections)
+	}
+
+	err := manager.CreateTunnel("cache", cache)
+	if err == nil || !strings.Contains(err.Error(), "cache is not reachable through the tunnel") {
+		t.Fatalf("CreateTunnel(cache) error = %v, want cache unreachable", err)
+	}
+	if n := len(manager.Tunnels()); n != 1 {
+		t.Errorf("%d tunnels, want only db", n)
+	}
+	sessions := fake.Sessions()
+	if !sessions[len(sessions)-1].Terminated() {
+		t.Error("session of cache was not terminated")
+	}
+	if l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", cache.LocalPortRange.Start)); err != nil {
+		t.Errorf("local port of cache was not released: %v", err)
+	} else {
+		l.Close()
+	}
+}
+
+func TestHealthCheckReconnects(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	cfg := newConfig(t, fake, "db")
+	db := cfg.TunnelConfig.Services["db"]
+	db.HealthCheck = &config.HealthCheck{Type: "tcp", Interval: 50 * time.Millisecond, Timeout: 100 * time.Millisecond, Failures: 2}
+	cfg.TunnelConfig.Services["db"] = db
+
+	// The service stops accepting connections after the tunnel is created
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	fake.SetParameter("/test/db/port", strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnels([]string{"db"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	ln.Close()
+
+	first := fake.Sessions()[0]
+	waitFor(t, "session was not reconnected after failed health checks", func() bool {
+		return first.Terminated() && manager.Tunnels()[0].Reconnects > 0
+	})
+	if st := manager.Tunnels()[0]; !strings.Contains(st.HealthError, "connection closed") {
+		t.Errorf("HealthError = %q, want the connection closed", st.HealthError)
+	}
+}
+
+func TestReconnectAfterSessionDrop(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost-1")
+	fake.AddInstance("i-2", "test-jumphost-2")
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), newConfig(t, fake, "db"), "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnels([]string{"db"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+	localPort := manager.Tunnels()[0].LocalPort
+
+	// Losing the jumphost forces the replacement session onto the other one
+	fake.StopInstance("i-1")
+	fake.Sessions()[0].Drop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(fake.Sessions()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("session was not restarted after being dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	roundTrip(t, localPort, "after reconnect")
+
+	st := manager.Tunnels()[0]
+	if st.Reconnects != 1 || st.JumphostID != "i-2" {
+		t.Errorf("status = %+v, want one reconnect through i-2", st)
+	}
+	if st.LocalPort != localPort {
+		t.Errorf("local port changed from %d to %d", localPort, st.LocalPort)
+	}
+}
+
+func TestReconnectReplacesJumphostWithOfflineAgent(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost-1")
+	fake.AddInstance("i-2", "test-jumphost-2")
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), newConfig(t, fake, "db"), "test", nil, nil)
+	defer manager.Shutdown(context.Background())
+
+	if err := manager.CreateTunnels([]string{"db"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+
+	// The jumphost keeps running, but its agent can no longer start sessions
+	fake.SetAgentProblem("i-1", "has SSM agent status ConnectionLost")
+	fake.Sessions()[0].Drop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for manager.Tunnels()[0].JumphostID != "i-2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("jumphost = %s after its agent went offline, want i-2", manager.Tunnels()[0].JumphostID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseTunnels(t *testing.T) {
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), newConfig(t, fake, "db", "cache"), "test", nil, nil)
+
+	if err := manager.CreateTunnels([]string{"db", "cache"}); err != nil {
+		t.Fatalf("CreateTunnels() error = %v", err)
+	}
+
+	results := manager.CloseTunnels(context.Background(), []string{"db", "missing"})
+	if len(results) != 2 {
+		t.Fatalf("CloseTunnels() = %+v, want two results", results)
+	}
+	for _, r := range results {
+		switch r.Service {
+		case "db":
+			if r.Err != nil || r.Forced {
+				t.Errorf("db result = %+v, want clean close", r)
+			}
+		case "missing":
+			if r.Err == nil {
+				t.Errorf("missing result = %+v, want error", r)
+			}
+		}
+	}
+	if got := manager.Tunnels(); len(got) != 1 || got[0].Service != "cache" {
+		t.Errorf("Tunnels() after close = %+v, want cache only", got)
+	}
+
+	for _, r := range manager.Shutdown(context.Background()) {
+		if r.Err != nil {
+			t.Errorf("Shutdown() %s error = %v", r.Service, r.Err)
+		}
+	}
+	for _, s := range fake.Sessions() {
+		if !s.Terminated() {
+			t.Errorf("session %s was not terminated", s.ID())
+		}
+	}
+	if got := manager.Tunnels(); len(got) != 0 {
+		t.Errorf("Tunnels() after shutdown = %+v, want none", got)
+	}
+}
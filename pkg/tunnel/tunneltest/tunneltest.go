@@ -0,0 +1,479 @@
+// Package tunneltest provides in-memory fakes of the services used by
+// tunnel.Manager, so tunnels can be created and cleaned up without AWS.
+//
+// Sessions started through the fake forward connections directly to the
+// requested host and port, so tests can point services at local servers.
+package tunneltest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	awsclient "tunnel-go/pkg/aws"
+	"tunnel-go/pkg/session"
+	"tunnel-go/pkg/tunnel"
+)
+
+// ErrSessionDropped is reported by sessions ended with Drop
+var ErrSessionDropped = errors.New("session dropped")
+
+// Fake implements tunnel.InstanceFinder, tunnel.ParameterStore and
+// tunnel.SessionStarter in memory. Fields may be changed between calls.
+type Fake struct {
+	mu sync.Mutex
+
+	// Instances are the jumphost candidates
+	Instances []types.Instance
+	// Parameters maps SSM parameter names to values
+	Parameters map[string]string
+
+	// InstanceErr, ParameterErr and SessionErr make the corresponding
+	// calls fail when set
+	InstanceErr  error
+	ParameterErr error
+	SessionErr   error
+
+	// SessionDelay makes starting a session take this long
+	SessionDelay time.Duration
+
+	agentProblems   map[string]string
+	sessions        []*FakeSession
+	jumphostQueries []awsclient.JumphostQuery
+	nextID          int
+	parameterCalls  int
+	starting        int
+	peakStarting    int
+}
+
+// New returns a Fake with no instances or parameters
+func New() *Fake {
+	return &Fake{Parameters: make(map[string]string)}
+}
+
+// Dependencies returns the fake as the services of a tunnel.Manager
+func (f *Fake) Dependencies() tunnel.Dependencies {
+	return tunnel.Dependencies{
+		Instances:  f,
+		Parameters: f,
+		Sessions:   f,
+	}
+}
+
+// Instance returns a running instance with the given ID and Name tag
+func Instance(id, name string) types.Instance {
+	return types.Instance{
+		InstanceId: aws.String(id),
+		State:      &types.InstanceState{Name: types.InstanceStateNameRunning},
+		Tags:       []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+	}
+}
+
+// AddInstance adds a running jumphost candidate
+func (f *Fake) AddInstance(id, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Instances = append(f.Instances, Instance(id, name))
+}
+
+// TagInstance sets a tag of an instance
+func (f *Fake) TagInstance(id, key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.Instances {
+		if *f.Instances[i].InstanceId == id {
+			f.Instances[i].Tags = append(f.Instances[i].Tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+	}
+}
+
+// StopInstance marks an instance as stopped
+func (f *Fake) StopInstance(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.Instances {
+		if *f.Instances[i].InstanceId == id {
+			f.Instances[i].State = &types.InstanceState{Name: types.InstanceStateNameStopped}
+		}
+	}
+}
+
+// SetAgentProblem makes the SSM agent of an instance unusable for problem,
+// or usable again if problem is empty
+func (f *Fake) SetAgentProblem(id, problem string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.agentProblems == nil {
+		f.agentProblems = make(map[string]string)
+	}
+	f.agentProblems[id] = problem
+}
+
+// SetParameter sets an SSM parameter value
+func (f *Fake) SetParameter(name, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Parameters[name] = value
+}
+
+// GetJumphost returns the instance with the query's instance ID if it is
+// usable, or else the first usable instance matching the filters. Instances
+// are usable when running without an agent problem. Only tag filters are
+// supported, with * and ? wildcards like EC2 tag filters; other filters
+// match no instance. The strategy is ignored.
+func (f *Fake) GetJumphost(query awsclient.JumphostQuery) (*types.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.jumphostQueries = append(f.jumphostQueries, query)
+	if f.InstanceErr != nil {
+		return nil, f.InstanceErr
+	}
+	for _, instance := range f.Instances {
+		if !running(instance) || f.agentProblems[*instance.InstanceId] != "" {
+			continue
+		}
+		if query.InstanceID != "" {
+			if *instance.InstanceId == query.InstanceID {
+				found := instance
+				return &found, nil
+			}
+			continue
+		}
+		if matchFilters(query.Filters, instance) {
+			found := instance
+			return &found, nil
+		}
+	}
+	if query.InstanceID != "" {
+		return nil, fmt.Errorf("jumphost %s is not running", query.InstanceID)
+	}
+	return nil, fmt.Errorf("no running instances found matching filter: %s", query.Filters)
+}
+
+// JumphostQueries returns the queries GetJumphost was called with
+func (f *Fake) JumphostQueries() []awsclient.JumphostQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]awsclient.JumphostQuery(nil), f.jumphostQueries...)
+}
+
+// JumphostProblem reports a known instance that is not running or whose
+// agent was made unusable with SetAgentProblem
+func (f *Fake) JumphostProblem(instanceID string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.InstanceErr != nil {
+		return "", f.InstanceErr
+	}
+	for _, instance := range f.Instances {
+		if *instance.InstanceId == instanceID && running(instance) {
+			return f.agentProblems[instanceID], nil
+		}
+	}
+	return "is not running", nil
+}
+
+// GetParameter returns a parameter value
+func (f *Fake) GetParameter(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.parameterCalls++
+	if f.ParameterErr != nil {
+		return "", f.ParameterErr
+	}
+	value, ok := f.Parameters[name]
+	if !ok {
+		return "", fmt.Errorf("failed to get parameter %s: ParameterNotFound", name)
+	}
+	return value, nil
+}
+
+// GetParametersByPath returns the parameters that exist among paths
+func (f *Fake) GetParametersByPath(paths []string) ([]ssmtypes.Parameter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.parameterCalls++
+	if f.ParameterErr != nil {
+		return nil, f.ParameterErr
+	}
+	var parameters []ssmtypes.Parameter
+	for _, name := range paths {
+		if value, ok := f.Parameters[name]; ok {
+			parameters = append(parameters, ssmtypes.Parameter{Name: aws.String(name), Value: aws.String(value)})
+		}
+	}
+	if len(parameters) == 0 {
+		return nil, fmt.Errorf("no parameters found")
+	}
+	return parameters, nil
+}
+
+// GetParameters returns the values of the parameters that exist among names
+// and the names that do not, in sorted order
+func (f *Fake) GetParameters(names []string) (map[string]string, []string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.parameterCalls++
+	if f.ParameterErr != nil {
+		return nil, nil, f.ParameterErr
+	}
+	values := make(map[string]string)
+	var invalid []string
+	for _, name := range names {
+		if value, ok := f.Parameters[name]; ok {
+			values[name] = value
+		} else {
+			invalid = append(invalid, name)
+		}
+	}
+	sort.Strings(invalid)
+	return values, invalid, nil
+}
+
+// ParameterCalls returns how many parameter lookups have been made
+func (f *Fake) ParameterCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.parameterCalls
+}
+
+// StartSession starts a fake session that forwards to opts.Host:opts.Port
+func (f *Fake) StartSession(ctx context.Context, opts session.Options) (tunnel.Session, error) {
+	f.mu.Lock()
+	f.starting++
+	if f.starting > f.peakStarting {
+		f.peakStarting = f.starting
+	}
+	delay := f.SessionDelay
+	f.mu.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.starting--
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.SessionErr != nil {
+		return nil, f.SessionErr
+	}
+	f.nextID++
+	s := &FakeSession{
+		id:      fmt.Sprintf("fake-session-%d", f.nextID),
+		Options: opts,
+		done:    make(chan struct{}),
+	}
+	f.sessions = append(f.sessions, s)
+	return s, nil
+}
+
+// PeakConcurrentStarts returns the most sessions that were being started at
+// the same time
+func (f *Fake) PeakConcurrentStarts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.peakStarting
+}
+
+// Sessions returns every session started so far, in order
+func (f *Fake) Sessions() []*FakeSession {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*FakeSession(nil), f.sessions...)
+}
+
+// Targets returns the sorted, de-duplicated instance IDs sessions were started on
+func (f *Fake) Targets() []string {
+	seen := make(map[string]bool)
+	var targets []string
+	for _, s := range f.Sessions() {
+		if !seen[s.Options.Target] {
+			seen[s.Options.Target] = true
+			targets = append(targets, s.Options.Target)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// FakeSession is a tunnel.Session that connects directly to the remote address
+type FakeSession struct {
+	id string
+	// Options are the options the session was started with
+	Options session.Options
+
+	mu         sync.Mutex
+	done       chan struct{}
+	err        error
+	terminated bool
+	conns      []net.Conn
+}
+
+// ID returns the session ID
+func (s *FakeSession) ID() string {
+	return s.id
+}
+
+// Forward proxies conn to the session's host and port
+func (s *FakeSession) Forward(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+
+	var d net.Dialer
+	remote, err := d.DialContext(ctx, "tcp", net.JoinHostPort(s.Options.Host, s.Options.Port))
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer remote.Close()
+
+	s.mu.Lock()
+	if s.isDone() {
+		s.mu.Unlock()
+		return ErrSessionDropped
+	}
+	s.conns = append(s.conns, remote)
+	s.mu.Unlock()
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(remote, conn)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, remote)
+		errc <- err
+	}()
+	if err := <-errc; err != nil && !isClosed(err) {
+		return err
+	}
+	return nil
+}
+
+// Forwarded returns how many connections were forwarded to the remote address
+func (s *FakeSession) Forwarded() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Done is closed when the session ends
+func (s *FakeSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended
+func (s *FakeSession) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Terminate ends the session as if TerminateSession was called
+func (s *FakeSession) Terminate(ctx context.Context) error {
+	s.end(nil, true)
+	return nil
+}
+
+// Abort ends the session without terminating it
+func (s *FakeSession) Abort() {
+	s.end(nil, false)
+}
+
+// Close terminates the session
+func (s *FakeSession) Close() error {
+	return s.Terminate(context.Background())
+}
+
+// Drop ends the session as if the data channel was lost
+func (s *FakeSession) Drop() {
+	s.end(ErrSessionDropped, false)
+}
+
+// Terminated reports whether the session was ended with Terminate or Close
+func (s *FakeSession) Terminated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.terminated
+}
+
+// end closes the session and its forwarded connections once
+func (s *FakeSession) end(err error, terminated bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if terminated {
+		s.terminated = true
+	}
+	if s.isDone() {
+		return
+	}
+	s.err = err
+	close(s.done)
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *FakeSession) isDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func running(instance types.Instance) bool {
+	return instance.State != nil && instance.State.Name == types.InstanceStateNameRunning
+}
+
+// matchFilters reports whether instance has a matching tag for every filter
+func matchFilters(filters awsclient.Filters, instance types.Instance) bool {
+	if len(filters) == 0 {
+		return false
+	}
+	for _, filter := range filters {
+		key, ok := strings.CutPrefix(filter.Name, "tag:")
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, tag := range instance.Tags {
+			if aws.ToString(tag.Key) != key {
+				continue
+			}
+			for _, pattern := range filter.Values {
+				if m, _ := path.Match(pattern, aws.ToString(tag.Value)); m {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func isClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,29 @@
+// Package version compares the dotted version numbers of SSM agents.
+package version
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Compare compares dotted version numbers, returning -1, 0 or 1. Missing
+// parts and parts that are not numbers count as 0.
+func Compare(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
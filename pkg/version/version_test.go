@@ -0,0 +1,23 @@
+package version
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"3.1.1374.0", "3.1.1374.0", 0},
+		{"3.1.1446.0", "3.1.1374.0", 1},
+		{"3.0.1390.0", "3.1.1374.0", -1},
+		{"3.10.0.0", "3.9.0.0", 1},
+		{"3.1", "3.1.0.0", 0},
+		{"3.1", "3.0.196.0", 1},
+		{"", "3.1.1374.0", -1},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
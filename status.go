@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"tunnel-go/pkg/config"
+	"tunnel-go/pkg/daemon"
+	"tunnel-go/pkg/tunnel"
+)
+
+// Output formats supported by status and list
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// checkOutputFormat exits if format is not a supported output format
+func checkOutputFormat(format string) {
+	if format != outputTable && format != outputJSON {
+		configError("Unknown output format %q (expected %s or %s)", format, outputTable, outputJSON)
+	}
+}
+
+// daemonClient returns a client for the daemon running for configPath
+func daemonClient(configPath string) *daemon.Client {
+	paths, err := daemon.PathsFor(configPath)
+	if err != nil {
+		log.Fatalf("Failed to locate daemon files: %v", err)
+	}
+	return daemon.NewClient(paths.Socket)
+}
+
+// runStatus prints the tunnels of the daemon running for configPath
+func runStatus(configPath, format string) int {
+	resp, err := daemonClient(configPath).List()
+	if errors.Is(err, daemon.ErrNotRunning) {
+		log.Printf("No daemon running for %s", configPath)
+		return 1
+	}
+	if err != nil {
+		log.Printf("Failed to get status: %v", err)
+		return 1
+	}
+
+	if format == outputJSON {
+		return printJSON(resp.Tunnels)
+	}
+
+	if len(resp.Tunnels) == 0 {
+		fmt.Printf("Daemon (pid %d, environment %s) has no active tunnels\n", resp.PID, resp.Env)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tENV\tJUMPHOST\tLOCAL\tREMOTE\tUPTIME\tIN\tOUT\tCONNS\tIDLE\tKEEPALIVE\tAVG CONN\tERRORS\tRECONNECTS")
+	for _, t := range resp.Tunnels {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d/%d\t%s\t%s\t%s\t%d\t%d\n",
+			t.Service, t.Env, formatJumphost(t), t.LocalAddress(), t.RemoteAddress(),
+			formatUptime(t), formatBytes(t.BytesIn), formatBytes(t.BytesOut),
+			t.ActiveConnections, t.Connections, formatIdle(t), formatKeepalive(t), formatAverageConnection(t), t.ConnectionErrors, t.Reconnects)
+	}
+	w.Flush()
+	return 0
+}
+
+// runStop closes tunnels on the daemon running for configPath
+func runStop(configPath string, services []string, all bool) int {
+	client := daemonClient(configPath)
+
+	if all {
+		resp, err := client.List()
+		if errors.Is(err, daemon.ErrNotRunning) {
+			log.Printf("No daemon running for %s", configPath)
+			return 1
+		}
+		if err != nil {
+			log.Printf("Failed to list tunnels: %v", err)
+			return 1
+		}
+		for _, t := range resp.Tunnels {
+			services = append(services, t.Service)
+		}
+		if len(services) == 0 {
+			fmt.Println("No active tunnels")
+			return 0
+		}
+	}
+
+	resp, err := client.Remove(services)
+	if errors.Is(err, daemon.ErrNotRunning) {
+		log.Printf("No daemon running for %s", configPath)
+		return 1
+	}
+
+	exitCode := 0
+	if resp != nil {
+		for _, r := range resp.Results {
+			switch {
+			case r.Forced:
+				fmt.Printf("%s: forced close (%s)\n", r.Service, r.Error)
+				exitCode = 1
+			case r.Error != "":
+				fmt.Printf("%s: close failed (%s)\n", r.Service, r.Error)
+				exitCode = 1
+			default:
+				fmt.Printf("%s: closed\n", r.Service)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to stop tunnels: %v", err)
+		exitCode = 1
+	}
+	return exitCode
+}
+
+// serviceEntry is a configured service as shown by list
+type serviceEntry struct {
+	Service        string           `json:"service"`
+	Host           string           `json:"host"`
+	RemotePort     string           `json:"remote_port"`
+	LocalPortRange config.PortRange `json:"local_port_range"`
+}
+
+// runList prints the services configured in cfg, with the local ports they
+// get in env
+func runList(cfg *config.Config, env, format string) int {
+	var names []string
+	for name := range cfg.TunnelConfig.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := []serviceEntry{}
+	for _, name := range names {
+		svc := cfg.TunnelConfig.Services[name]
+		entries = append(entries, serviceEntry{
+			Service:        name,
+			Host:           describeValue(svc.Host),
+			RemotePort:     describeValue(svc.RemotePort),
+			LocalPortRange: svc.LocalPorts().Offset(cfg.PortOffset(env)),
+		})
+	}
+
+	if format == outputJSON {
+		return printJSON(entries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tHOST\tREMOTE PORT\tLOCAL PORTS")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Service, e.Host, e.RemotePort, e.LocalPortRange)
+	}
+	w.Flush()
+	return 0
+}
+
+// describeValue shows a config value, or the SSM parameter it is read from
+func describeValue(v config.ConfigValue) string {
+	switch {
+	case v.SSMParam != "":
+		return "ssm:" + v.SSMParam
+	case v.Value != "":
+		return v.Value
+	default:
+		return "-"
+	}
+}
+
+// printJSON writes v as indented JSON to stdout
+func printJSON(v interface{}) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Failed to encode output: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// formatJumphost shows the jumphost name and instance ID
+func formatJumphost(t tunnel.TunnelStatus) string {
+	if t.JumphostID == "" {
+		return "-"
+	}
+	if t.JumphostName == "" || t.JumphostName == "unnamed" {
+		return t.JumphostID
+	}
+	return fmt.Sprintf("%s (%s)", t.JumphostName, t.JumphostID)
+}
+
+// formatUptime shows the tunnel uptime rounded to seconds, marking lazy
+// tunnels waiting for a connection, tunnels that are reconnecting and those
+// whose service failed its last health check
+func formatUptime(t tunnel.TunnelStatus) string {
+	uptime := t.Uptime().Round(time.Second).String()
+	switch {
+	case t.Idle:
+		uptime += " (idle)"
+	case !t.Connected:
+		uptime += " (reconnecting)"
+	case t.HealthError != "":
+		uptime += " (unhealthy)"
+	}
+	return uptime
+}
+
+// formatIdle shows how long the tunnel has had no connection, or - while one
+// is open, followed by the idle timeout after which it is closed
+func formatIdle(t tunnel.TunnelStatus) string {
+	idle := "-"
+	if t.ActiveConnections == 0 {
+		idle = t.IdleFor().Round(time.Second).String()
+	}
+	if t.IdleTimeout > 0 {
+		idle += "/" + t.IdleTimeout.String()
+	}
+	return idle
+}
+
+// formatKeepalive shows the keepalive interval, or - if none is set
+func formatKeepalive(t tunnel.TunnelStatus) string {
+	if t.Keepalive <= 0 {
+		return "-"
+	}
+	return t.Keepalive.String()
+}
+
+// formatAverageConnection shows the average duration of closed connections,
+// or - if none has closed yet
+func formatAverageConnection(t tunnel.TunnelStatus) string {
+	if t.Connections == t.ActiveConnections {
+		return "-"
+	}
+	avg := t.AverageConnection()
+	if avg < time.Second {
+		return avg.Round(time.Millisecond).String()
+	}
+	return avg.Round(time.Second).String()
+}
+
+// formatBytes shows a byte count using binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// splitServices parses a comma-separated services flag
+func splitServices(value string) []string {
+	var services []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			services = append(services, s)
+		}
+	}
+	return services
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"tunnel-go/pkg/config"
+)
+
+// runValidateConfig checks the config file and prints every problem found
+func runValidateConfig(configPath string) int {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return 1
+	}
+
+	if err := cfg.Validate(); err != nil {
+		printValidationErrors(configPath, err)
+		return 1
+	}
+
+	fmt.Printf("%s is valid\n", configPath)
+	return 0
+}
+
+// printValidationErrors prints validation errors prefixed with the config
+// path, in the file:line:column form understood by editors
+func printValidationErrors(configPath string, err error) {
+	var errs config.ValidationErrors
+	if !errors.As(err, &errs) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		return
+	}
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", configPath, e)
+	}
+	fmt.Fprintf(os.Stderr, "%d problem(s) found in %s\n", len(errs), configPath)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"tunnel-go/pkg/daemon"
+	"tunnel-go/pkg/tunnel"
+)
+
+// Exit codes telling scripts why tunnel-go failed. Invalid flags exit with
+// exitConfig.
+const (
+	exitFailure  = 1
+	exitConfig   = 3
+	exitAuth     = 4
+	exitJumphost = 5
+	exitPorts    = 6
+	exitSession  = 7
+	exitTimeout  = 8
+)
+
+// defaultWaitTimeout bounds create-tunnel -wait when -timeout is not given
+const defaultWaitTimeout = 2 * time.Minute
+
+// readyPollInterval is the pause between checks of the tunnels' status
+const readyPollInterval = 200 * time.Millisecond
+
+// reasonTimeout is the reason in the ready line when the tunnels were not
+// ready within -timeout
+const reasonTimeout = daemon.ReasonTimeout
+
+// waitOptions are the -wait and -timeout flags of create-tunnel
+type waitOptions struct {
+	enabled bool
+	timeout time.Duration
+}
+
+// context returns a context ending after the timeout if waiting is enabled,
+// and one that never ends otherwise
+func (w waitOptions) context() (context.Context, context.CancelFunc) {
+	if !w.enabled {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), w.timeout)
+}
+
+// exitCode returns the exit code for a reason returned by
+// tunnel.FailureReason
+func exitCode(reason string) int {
+	switch reason {
+	case tunnel.ReasonConfig:
+		return exitConfig
+	case tunnel.ReasonAuth:
+		return exitAuth
+	case tunnel.ReasonJumphost:
+		return exitJumphost
+	case tunnel.ReasonPorts:
+		return exitPorts
+	case tunnel.ReasonSession:
+		return exitSession
+	default:
+		return exitFailure
+	}
+}
+
+// readyLine is the single JSON line create-tunnel -wait prints to stdout
+type readyLine struct {
+	Ready   bool          `json:"ready"`
+	Env     string        `json:"env,omitempty"`
+	Tunnels []readyTunnel `json:"tunnels,omitempty"`
+	// Reason is reasonTimeout or a reason returned by tunnel.FailureReason,
+	// and Error the message, when Ready is false
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readyTunnel describes a tunnel in the ready line
+type readyTunnel struct {
+	Service       string `json:"service"`
+	LocalAddress  string `json:"local_address"`
+	LocalPort     int    `json:"local_port"`
+	RemoteAddress string `json:"remote_address"`
+}
+
+// printReady prints the ready line for tunnels
+func printReady(env string, tunnels []tunnel.TunnelStatus) {
+	line := readyLine{Ready: true, Env: env, Tunnels: []readyTunnel{}}
+	for _, t := range tunnels {
+		line.Tunnels = append(line.Tunnels, readyTunnel{
+			Service:       t.Service,
+			LocalAddress:  t.LocalAddress(),
+			LocalPort:     t.LocalPort,
+			RemoteAddress: t.RemoteAddress(),
+		})
+	}
+	writeReadyLine(line)
+}
+
+// printNotReady prints the ready line for a failure and returns its exit code
+func printNotReady(env, reason string, err error) int {
+	writeReadyLine(readyLine{Env: env, Reason: reason, Error: err.Error()})
+	if reason == reasonTimeout {
+		return exitTimeout
+	}
+	return exitCode(reason)
+}
+
+// writeReadyLine writes line as JSON on a single line of stdout
+func writeReadyLine(line readyLine) {
+	data, err := json.Marshal(line)
+	if err != nil {
+		log.Printf("Failed to encode ready line: %v", err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// waitReady polls the tunnels of services through list until each has an
+// established session, and one with a health check last passed it, or ctx is
+// done. Lazy tunnels are ready while they wait for their first connection,
+// as that is what starts their session. Failures to list the tunnels are
+// retried like tunnels that are not ready. It returns the tunnels of
+// services.
+func waitReady(ctx context.Context, services []string, list func() ([]tunnel.TunnelStatus, error)) ([]tunnel.TunnelStatus, error) {
+	for {
+		tunnels, err := list()
+		if err == nil {
+			selected := selectTunnels(tunnels, services)
+			if err = notReady(selected, services); err == nil {
+				return selected, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// notReady returns why tunnels, those of services, are not all ready
+func notReady(tunnels []tunnel.TunnelStatus, services []string) error {
+	found := make(map[string]bool, len(tunnels))
+	for _, t := range tunnels {
+		found[t.Service] = true
+		switch {
+		case t.Lazy && t.Idle:
+		case !t.Connected:
+			return fmt.Errorf("%s has no established session", t.Service)
+		case t.HealthError != "":
+			return fmt.Errorf("%s failed its health check: %s", t.Service, t.HealthError)
+		}
+	}
+	for _, service := range services {
+		if !found[service] {
+			return fmt.Errorf("%s has no tunnel", service)
+		}
+	}
+	return nil
+}
+
+// selectTunnels returns the tunnels of services, in the order of services
+func selectTunnels(tunnels []tunnel.TunnelStatus, services []string) []tunnel.TunnelStatus {
+	var selected []tunnel.TunnelStatus
+	for _, service := range services {
+		for _, t := range tunnels {
+			if t.Service == service {
+				selected = append(selected, t)
+			}
+		}
+	}
+	return selected
+}
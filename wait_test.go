@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"tunnel-go/pkg/config"
+	"tunnel-go/pkg/tunnel"
+	"tunnel-go/pkg/tunnel/tunneltest"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   int
+	}{
+		{tunnel.ReasonConfig, exitConfig},
+		{tunnel.ReasonAuth, exitAuth},
+		{tunnel.ReasonJumphost, exitJumphost},
+		{tunnel.ReasonPorts, exitPorts},
+		{tunnel.ReasonSession, exitSession},
+		{"", exitFailure},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.reason); got != tt.want {
+			t.Errorf("exitCode(%q) = %d, want %d", tt.reason, got, tt.want)
+		}
+	}
+	if got := printNotReady("dev", reasonTimeout, errors.New("too slow")); got != exitTimeout {
+		t.Errorf("printNotReady(timeout) = %d, want %d", got, exitTimeout)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		tunnels []tunnel.TunnelStatus
+		wantErr bool
+	}{
+		{
+			name:    "connected",
+			tunnels: []tunnel.TunnelStatus{{Service: "db", Connected: true}},
+		},
+		{
+			name:    "lazy and idle",
+			tunnels: []tunnel.TunnelStatus{{Service: "db", Lazy: true, Idle: true}},
+		},
+		{
+			name:    "not connected",
+			tunnels: []tunnel.TunnelStatus{{Service: "db"}},
+			wantErr: true,
+		},
+		{
+			name:    "health check failing",
+			tunnels: []tunnel.TunnelStatus{{Service: "db", Connected: true, HealthCheck: "tcp", HealthError: "refused"}},
+			wantErr: true,
+		},
+		{
+			name:    "missing",
+			tunnels: []tunnel.TunnelStatus{{Service: "cache", Connected: true}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			list := func() ([]tunnel.TunnelStatus, error) { return tt.tunnels, nil }
+
+			got, err := waitReady(ctx, []string{"db"}, list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("waitReady() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (len(got) != 1 || got[0].Service != "db") {
+				t.Errorf("waitReady() = %+v, want the db tunnel", got)
+			}
+		})
+	}
+}
+
+func TestWaitReadyPolls(t *testing.T) {
+	calls := 0
+	list := func() ([]tunnel.TunnelStatus, error) {
+		calls++
+		switch calls {
+		case 1:
+			return nil, errors.New("daemon busy")
+		case 2:
+			return []tunnel.TunnelStatus{{Service: "db"}}, nil
+		default:
+			return []tunnel.TunnelStatus{{Service: "db", Connected: true}}, nil
+		}
+	}
+
+	if _, err := waitReady(context.Background(), []string{"db"}, list); err != nil {
+		t.Fatalf("waitReady() error = %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("waitReady() listed the tunnels %d times, want 3", calls)
+	}
+}
+
+func TestRunCreateTunnelTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	fake := tunneltest.New()
+	fake.AddInstance("i-1", "test-jumphost")
+	fake.SetParameter("/test/db/host", "db.internal")
+	fake.SetParameter("/test/db/port", "5432")
+	fake.SessionDelay = time.Minute
+
+	cfg := &config.Config{}
+	cfg.TunnelConfig.JumphostFilter = config.NameFilter("${ENV}-jumphost*")
+	cfg.TunnelConfig.Services = map[string]config.ServiceConfig{
+		"db": {
+			Host:           config.ConfigValue{SSMParam: "/${ENV}/${SERVICE}/host"},
+			RemotePort:     config.ConfigValue{SSMParam: "/${ENV}/${SERVICE}/port"},
+			LocalPortRange: config.PortRange{Start: port, End: port},
+		},
+	}
+	manager := tunnel.NewManagerWithDependencies(fake.Dependencies(), cfg, "test", nil, nil)
+
+	start := time.Now()
+	code := runCreateTunnel(manager, []string{"db"}, waitOptions{enabled: true, timeout: 100 * time.Millisecond})
+	if code != exitTimeout {
+		t.Errorf("runCreateTunnel() = %d, want %d", code, exitTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runCreateTunnel() took %s after the timeout", elapsed)
+	}
+	if n := len(manager.Tunnels()); n != 0 {
+		t.Errorf("Tunnels() = %d tunnels after the timeout, want 0", n)
+	}
+}